@@ -0,0 +1,247 @@
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// OverflowPolicy decides which message is dropped when a full MessageBuffer
+// receives another message.
+type OverflowPolicy string
+
+const (
+	// DropOldest replaces the oldest buffered message with the new one.
+	DropOldest OverflowPolicy = "dropOldest"
+	// DropNewest discards the new message and keeps the buffered ones.
+	DropNewest OverflowPolicy = "dropNewest"
+)
+
+// DefaultBufferSize is the number of messages buffered per topic between two
+// frames when no buffer size is configured.
+const DefaultBufferSize = 10000
+
+func (p OverflowPolicy) validate() error {
+	switch p {
+	case "", DropOldest, DropNewest:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid buffer overflow policy %q: must be %q or %q", p, DropOldest, DropNewest)
+	}
+}
+
+// MessageBuffer is a bounded, concurrency-safe ring buffer of messages shared
+// by all subscribers of an MQTT topic. The MQTT client adds messages from its
+// callback goroutine while every subscriber drains them through its own
+// BufferReader. A message is kept until all readers have read it, so the
+// capacity bounds the backlog of the slowest reader.
+//
+// Messages are numbered in the order they were added. head is the number of
+// the next message and tail the number of the oldest buffered message.
+type MessageBuffer struct {
+	mu       sync.Mutex
+	messages []Message // ring storage, grows up to capacity
+	start    int       // index of the message numbered tail
+	head     uint64
+	tail     uint64
+	capacity int
+	policy   OverflowPolicy
+
+	// dropped counts messages dropped since the buffer was created,
+	// droppedNewest only those rejected by DropNewest.
+	dropped       uint64
+	droppedNewest uint64
+
+	// positions counts the readers waiting for each message number. Readers
+	// drain at the same ticks, so there are only a few distinct positions.
+	positions map[uint64]int
+	readers   int
+}
+
+// NewMessageBuffer returns a buffer holding up to capacity messages. A
+// capacity of zero or less uses DefaultBufferSize and an empty policy uses
+// DropOldest.
+func NewMessageBuffer(capacity int, policy OverflowPolicy) *MessageBuffer {
+	if capacity <= 0 {
+		capacity = DefaultBufferSize
+	}
+	if policy == "" {
+		policy = DropOldest
+	}
+	return &MessageBuffer{
+		capacity:  capacity,
+		policy:    policy,
+		positions: make(map[uint64]int),
+	}
+}
+
+// Add buffers a message for all readers, dropping one according to the
+// overflow policy when the buffer is full. Messages added while there are no
+// readers are discarded.
+func (b *MessageBuffer) Add(m Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readers == 0 {
+		return
+	}
+
+	size := int(b.head - b.tail)
+	if size == b.capacity {
+		if b.policy == DropNewest {
+			b.dropped++
+			b.droppedNewest++
+			return
+		}
+		// Readers that did not read the oldest message yet notice the gap
+		// on their next drain.
+		b.release(b.tail + 1)
+		b.dropped++
+		size--
+	}
+
+	if size == len(b.messages) {
+		b.grow()
+	}
+	b.messages[(b.start+size)%len(b.messages)] = m
+	b.head++
+}
+
+// grow makes room for one more message. The storage grows with the backlog
+// instead of being allocated up front, as most topics never fill it.
+func (b *MessageBuffer) grow() {
+	size := int(b.head - b.tail)
+	if b.start == 0 {
+		b.messages = append(b.messages, Message{})
+		return
+	}
+	messages := make([]Message, size+1, min(2*size+1, b.capacity))
+	for i := 0; i < size; i++ {
+		messages[i] = b.messages[(b.start+i)%len(b.messages)]
+	}
+	b.messages = messages[:size+1]
+	b.start = 0
+}
+
+// release drops the messages numbered below tail.
+func (b *MessageBuffer) release(tail uint64) {
+	for ; b.tail < tail; b.tail++ {
+		b.messages[b.start] = Message{}
+		b.start = (b.start + 1) % len(b.messages)
+	}
+	if b.tail == b.head {
+		// Reuse the storage from the start so it can grow in order again.
+		b.messages = b.messages[:0]
+		b.start = 0
+	}
+}
+
+// releaseRead drops the messages read by all readers.
+func (b *MessageBuffer) releaseRead() {
+	if b.readers == 0 {
+		b.release(b.head)
+		return
+	}
+	tail := b.head
+	for position := range b.positions {
+		tail = min(tail, position)
+	}
+	if tail > b.tail {
+		b.release(tail)
+	}
+}
+
+// move moves a reader from one position to another.
+func (b *MessageBuffer) move(from, to uint64) {
+	if b.positions[from]--; b.positions[from] == 0 {
+		delete(b.positions, from)
+	}
+	b.positions[to]++
+}
+
+// Len returns the number of messages that are not read by all readers yet.
+func (b *MessageBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.head - b.tail)
+}
+
+// Dropped returns the number of messages dropped since the buffer was
+// created.
+func (b *MessageBuffer) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// NewReader returns a reader receiving the messages added from now on.
+func (b *MessageBuffer) NewReader() *BufferReader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readers++
+	b.positions[b.head]++
+	return &BufferReader{
+		buffer:        b,
+		next:          b.head,
+		droppedNewest: b.droppedNewest,
+	}
+}
+
+// BufferReader reads the messages of a MessageBuffer for one subscriber.
+type BufferReader struct {
+	buffer        *MessageBuffer
+	next          uint64 // number of the next message to read
+	droppedNewest uint64 // the buffer's droppedNewest at the last drain
+	closed        bool
+}
+
+// Drain returns the messages added since the previous drain, oldest first,
+// together with the number of messages this reader missed because the buffer
+// was full.
+func (r *BufferReader) Drain() ([]Message, uint64) {
+	b := r.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.closed {
+		return nil, 0
+	}
+
+	from := max(r.next, b.tail)
+	dropped := from - r.next + b.droppedNewest - r.droppedNewest
+
+	messages := make([]Message, b.head-from)
+	for i := range messages {
+		messages[i] = b.messages[(b.start+int(from-b.tail)+i)%len(b.messages)]
+	}
+
+	previous := r.next
+	b.move(previous, b.head)
+	r.next = b.head
+	r.droppedNewest = b.droppedNewest
+	if previous <= b.tail {
+		// This reader may have been the slowest one.
+		b.releaseRead()
+	}
+
+	return messages, dropped
+}
+
+// Close detaches the reader from the buffer so it no longer holds back
+// messages.
+func (r *BufferReader) Close() {
+	b := r.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	b.readers--
+	if b.positions[r.next]--; b.positions[r.next] == 0 {
+		delete(b.positions, r.next)
+	}
+	b.releaseRead()
+}
@@ -0,0 +1,218 @@
+package mqtt
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func bufferedValues(messages []Message) []string {
+	values := make([]string, 0, len(messages))
+	for _, m := range messages {
+		values = append(values, string(m.Value))
+	}
+	return values
+}
+
+func addValues(b *MessageBuffer, values ...string) {
+	for _, v := range values {
+		b.Add(Message{Timestamp: time.Now(), Value: []byte(v)})
+	}
+}
+
+func TestMessageBuffer(t *testing.T) {
+	t.Run("drains messages in order", func(t *testing.T) {
+		b := NewMessageBuffer(3, DropOldest)
+		r := b.NewReader()
+		addValues(b, "1", "2")
+		require.Equal(t, 2, b.Len())
+
+		messages, dropped := r.Drain()
+		require.Equal(t, []string{"1", "2"}, bufferedValues(messages))
+		require.Zero(t, dropped)
+		require.Zero(t, b.Len())
+
+		messages, _ = r.Drain()
+		require.Empty(t, messages)
+	})
+
+	t.Run("discards messages without readers", func(t *testing.T) {
+		b := NewMessageBuffer(3, DropOldest)
+		addValues(b, "1")
+		r := b.NewReader()
+		addValues(b, "2")
+
+		messages, _ := r.Drain()
+		require.Equal(t, []string{"2"}, bufferedValues(messages))
+	})
+
+	t.Run("drop oldest keeps the newest messages", func(t *testing.T) {
+		b := NewMessageBuffer(3, DropOldest)
+		r := b.NewReader()
+		addValues(b, "1", "2", "3", "4", "5")
+
+		messages, dropped := r.Drain()
+		require.Equal(t, []string{"3", "4", "5"}, bufferedValues(messages))
+		require.Equal(t, uint64(2), dropped)
+		require.Equal(t, uint64(2), b.Dropped())
+	})
+
+	t.Run("drop newest keeps the oldest messages", func(t *testing.T) {
+		b := NewMessageBuffer(3, DropNewest)
+		r := b.NewReader()
+		addValues(b, "1", "2", "3", "4", "5")
+
+		messages, dropped := r.Drain()
+		require.Equal(t, []string{"1", "2", "3"}, bufferedValues(messages))
+		require.Equal(t, uint64(2), dropped)
+	})
+
+	t.Run("counts dropped messages per drain and in total", func(t *testing.T) {
+		b := NewMessageBuffer(2, DropOldest)
+		r := b.NewReader()
+		addValues(b, "1", "2", "3")
+		_, dropped := r.Drain()
+		require.Equal(t, uint64(1), dropped)
+
+		addValues(b, "4", "5", "6", "7")
+		messages, dropped := r.Drain()
+		require.Equal(t, []string{"6", "7"}, bufferedValues(messages))
+		require.Equal(t, uint64(2), dropped)
+		require.Equal(t, uint64(3), b.Dropped())
+	})
+
+	t.Run("readers drain independently", func(t *testing.T) {
+		b := NewMessageBuffer(10, DropOldest)
+		fast := b.NewReader()
+		slow := b.NewReader()
+
+		addValues(b, "1", "2")
+		messages, _ := fast.Drain()
+		require.Equal(t, []string{"1", "2"}, bufferedValues(messages))
+		// the slow reader still needs both messages
+		require.Equal(t, 2, b.Len())
+
+		addValues(b, "3")
+		messages, _ = fast.Drain()
+		require.Equal(t, []string{"3"}, bufferedValues(messages))
+
+		messages, _ = slow.Drain()
+		require.Equal(t, []string{"1", "2", "3"}, bufferedValues(messages))
+		require.Zero(t, b.Len())
+	})
+
+	t.Run("capacity bounds the backlog of the slowest reader", func(t *testing.T) {
+		b := NewMessageBuffer(3, DropOldest)
+		fast := b.NewReader()
+		slow := b.NewReader()
+
+		for i := 1; i <= 5; i++ {
+			addValues(b, strconv.Itoa(i))
+			messages, dropped := fast.Drain()
+			require.Equal(t, []string{strconv.Itoa(i)}, bufferedValues(messages))
+			require.Zero(t, dropped)
+		}
+
+		messages, dropped := slow.Drain()
+		require.Equal(t, []string{"3", "4", "5"}, bufferedValues(messages))
+		require.Equal(t, uint64(2), dropped)
+	})
+
+	t.Run("drop newest is reported to every reader", func(t *testing.T) {
+		b := NewMessageBuffer(2, DropNewest)
+		fast := b.NewReader()
+		slow := b.NewReader()
+
+		addValues(b, "1", "2")
+		_, _ = fast.Drain()
+		addValues(b, "3")
+
+		messages, dropped := fast.Drain()
+		require.Empty(t, messages)
+		require.Equal(t, uint64(1), dropped)
+
+		messages, dropped = slow.Drain()
+		require.Equal(t, []string{"1", "2"}, bufferedValues(messages))
+		require.Equal(t, uint64(1), dropped)
+	})
+
+	t.Run("closed readers do not hold back messages", func(t *testing.T) {
+		b := NewMessageBuffer(10, DropOldest)
+		r := b.NewReader()
+		closed := b.NewReader()
+
+		addValues(b, "1", "2")
+		_, _ = r.Drain()
+		require.Equal(t, 2, b.Len())
+
+		closed.Close()
+		require.Zero(t, b.Len())
+		messages, _ := closed.Drain()
+		require.Empty(t, messages)
+	})
+
+	t.Run("wraps around after partial drains", func(t *testing.T) {
+		b := NewMessageBuffer(4, DropOldest)
+		fast := b.NewReader()
+		slow := b.NewReader()
+
+		addValues(b, "1", "2", "3")
+		_, _ = fast.Drain()
+		_, _ = slow.Drain()
+		addValues(b, "4", "5")
+		_, _ = slow.Drain()
+		addValues(b, "6", "7")
+
+		messages, dropped := fast.Drain()
+		require.Equal(t, []string{"4", "5", "6", "7"}, bufferedValues(messages))
+		require.Zero(t, dropped)
+		messages, _ = slow.Drain()
+		require.Equal(t, []string{"6", "7"}, bufferedValues(messages))
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		b := NewMessageBuffer(0, "")
+		require.Equal(t, DefaultBufferSize, b.capacity)
+		require.Equal(t, DropOldest, b.policy)
+	})
+
+	t.Run("concurrent add and drain", func(t *testing.T) {
+		b := NewMessageBuffer(100, DropOldest)
+		readers := []*BufferReader{b.NewReader(), b.NewReader()}
+		const total = 10000
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < total; i++ {
+				addValues(b, strconv.Itoa(i))
+			}
+		}()
+
+		received := make([]uint64, len(readers))
+		drain := func() {
+			for i, r := range readers {
+				messages, dropped := r.Drain()
+				received[i] += uint64(len(messages)) + dropped
+			}
+		}
+		for received[0] < total || received[1] < total {
+			drain()
+		}
+		wg.Wait()
+		drain()
+
+		require.Equal(t, []uint64{total, total}, received)
+	})
+}
+
+func TestOverflowPolicy_Validate(t *testing.T) {
+	require.NoError(t, OverflowPolicy("").validate())
+	require.NoError(t, DropOldest.validate())
+	require.NoError(t, DropNewest.validate())
+	require.Error(t, OverflowPolicy("dropAll").validate())
+}
@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// maxNesting is the number of nested arrays and maps of binary payloads
+// decoded, so crafted payloads cannot exhaust the stack.
+const maxNesting = 1000
+
+var (
+	errTruncated     = errors.New("unexpected end of payload")
+	errTooDeep       = fmt.Errorf("more than %d nested levels", maxNesting)
+	errTrailingBytes = errors.New("trailing bytes after the payload")
+)
+
+// cborBreak is the argument of a CBOR head ending an indefinite-length item.
+const cborBreak = 0xff
+
+// decodeCBOR decodes a CBOR payload (RFC 8949) into JSON, so it is framed
+// like JSON payloads. Map keys that are integers become strings, byte
+// strings are base64 strings and date/time tags are RFC 3339 strings or
+// Unix times. Other tags are left out, keeping their content.
+func decodeCBOR(payload []byte) ([]byte, error) {
+	stream := jsoniter.ConfigDefault.BorrowStream(nil)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+	d := cborDecoder{b: payload, stream: stream}
+	if err := d.value(0); err != nil {
+		return nil, err
+	}
+	if len(d.b) > 0 {
+		return nil, errTrailingBytes
+	}
+	return append([]byte(nil), stream.Buffer()...), nil
+}
+
+type cborDecoder struct {
+	b      []byte
+	stream *jsoniter.Stream
+}
+
+// head reads the head of the next item: its major type, additional
+// information and argument. Indefinite lengths have no argument.
+func (d *cborDecoder) head() (major, info byte, arg uint64, err error) {
+	if len(d.b) == 0 {
+		return 0, 0, 0, errTruncated
+	}
+	major, info = d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(d.b) < n {
+			return 0, 0, 0, errTruncated
+		}
+		arg = readUint(d.b[:n])
+		d.b = d.b[n:]
+		return major, info, arg, nil
+	case info == 31 && major >= 2 && major <= 5:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid CBOR additional information %d", info)
+	}
+}
+
+// length checks that a string of n bytes fits the rest of the payload.
+func (d *cborDecoder) length(n uint64) (int, error) {
+	if n > uint64(len(d.b)) {
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+// atBreak consumes the break ending an indefinite-length item, if it is
+// next.
+func (d *cborDecoder) atBreak() (bool, error) {
+	if len(d.b) == 0 {
+		return false, errTruncated
+	}
+	if d.b[0] == cborBreak {
+		d.b = d.b[1:]
+		return true, nil
+	}
+	return false, nil
+}
+
+func (d *cborDecoder) value(depth int) error {
+	if depth > maxNesting {
+		return errTooDeep
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case 0:
+		d.stream.WriteUint64(arg)
+	case 1:
+		if arg > math.MaxInt64 {
+			writeFloat(d.stream, -1-float64(arg), 64)
+		} else {
+			d.stream.WriteInt64(-1 - int64(arg))
+		}
+	case 2, 3:
+		s, err := d.str(major, info, arg)
+		if err != nil {
+			return err
+		}
+		if major == 2 {
+			d.stream.WriteString(base64.StdEncoding.EncodeToString(s))
+		} else {
+			d.stream.WriteString(string(s))
+		}
+	case 4, 5:
+		return d.collection(major, info, arg, depth)
+	case 6:
+		return d.tag(arg, depth)
+	case 7:
+		return d.simple(info, arg)
+	}
+	return nil
+}
+
+// collection reads an array or a map. Every item takes a byte at least, so
+// the items of a crafted length run out with the payload.
+func (d *cborDecoder) collection(major, info byte, arg uint64, depth int) error {
+	if major == 4 {
+		d.stream.WriteArrayStart()
+	} else {
+		d.stream.WriteObjectStart()
+	}
+	for i := uint64(0); ; i++ {
+		if info == 31 {
+			end, err := d.atBreak()
+			if err != nil {
+				return err
+			}
+			if end {
+				break
+			}
+		} else if i == arg {
+			break
+		}
+		if i > 0 {
+			d.stream.WriteMore()
+		}
+		if major == 5 {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			d.stream.WriteObjectField(key)
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	if major == 4 {
+		d.stream.WriteArrayEnd()
+	} else {
+		d.stream.WriteObjectEnd()
+	}
+	return nil
+}
+
+// str reads the content of a byte or text string, concatenating the chunks
+// of indefinite-length strings.
+func (d *cborDecoder) str(major, info byte, arg uint64) ([]byte, error) {
+	if info != 31 {
+		n, err := d.length(arg)
+		if err != nil {
+			return nil, err
+		}
+		s := d.b[:n]
+		d.b = d.b[n:]
+		return s, nil
+	}
+	var s []byte
+	for {
+		if end, err := d.atBreak(); err != nil || end {
+			return s, err
+		}
+		chunkMajor, chunkInfo, chunkArg, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkInfo == 31 {
+			return nil, errors.New("invalid CBOR indefinite-length string chunk")
+		}
+		chunk, err := d.str(chunkMajor, chunkInfo, chunkArg)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+}
+
+// key reads a map key: a string, or an integer formatted as a string.
+func (d *cborDecoder) key() (string, error) {
+	major, info, arg, err := d.head()
+	if err != nil {
+		return "", err
+	}
+	switch major {
+	case 0:
+		return strconv.FormatUint(arg, 10), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return "", errors.New("unsupported CBOR map key: integer out of range")
+		}
+		return strconv.FormatInt(-1-int64(arg), 10), nil
+	case 2:
+		s, err := d.str(major, info, arg)
+		return base64.StdEncoding.EncodeToString(s), err
+	case 3:
+		s, err := d.str(major, info, arg)
+		return string(s), err
+	default:
+		return "", fmt.Errorf("unsupported CBOR map key of major type %d", major)
+	}
+}
+
+// tag reads a tagged item. Bignums are integers if they are positive and
+// fit 64 bits, or floats.
+func (d *cborDecoder) tag(tag uint64, depth int) error {
+	switch tag {
+	case 2, 3:
+		major, info, arg, err := d.head()
+		if err != nil {
+			return err
+		}
+		if major != 2 {
+			return errors.New("invalid CBOR bignum")
+		}
+		b, err := d.str(major, info, arg)
+		if err != nil {
+			return err
+		}
+		var u uint64
+		f := 0.0
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+			f = f*256 + float64(c)
+		}
+		switch {
+		case tag == 2 && len(b) <= 8:
+			d.stream.WriteUint64(u)
+		case tag == 2:
+			writeFloat(d.stream, f, 64)
+		default:
+			writeFloat(d.stream, -1-f, 64)
+		}
+		return nil
+	default:
+		// Tag 0 holds an RFC 3339 string and tag 1 a Unix time, as is.
+		return d.value(depth + 1)
+	}
+}
+
+// simple reads a simple value or a float.
+func (d *cborDecoder) simple(info byte, arg uint64) error {
+	switch info {
+	case 20:
+		d.stream.WriteFalse()
+	case 21:
+		d.stream.WriteTrue()
+	case 22, 23:
+		d.stream.WriteNil()
+	case 25:
+		writeFloat(d.stream, halfToFloat(uint16(arg)), 32)
+	case 26:
+		writeFloat(d.stream, float64(math.Float32frombits(uint32(arg))), 32)
+	case 27:
+		writeFloat(d.stream, math.Float64frombits(arg), 64)
+	default:
+		return fmt.Errorf("unsupported CBOR simple value %d", arg)
+	}
+	return nil
+}
+
+// halfToFloat converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float64 {
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+0x400, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// readUint reads a big-endian unsigned integer of 1, 2, 4 or 8 bytes.
+func readUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	default:
+		return binary.BigEndian.Uint64(b)
+	}
+}
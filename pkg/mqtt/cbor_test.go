@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+// payloadOf concatenates bytes, given as ints, and strings.
+func payloadOf(parts ...interface{}) []byte {
+	var b []byte
+	for _, p := range parts {
+		switch p := p.(type) {
+		case int:
+			b = append(b, byte(p))
+		case string:
+			b = append(b, p...)
+		}
+	}
+	return b
+}
+
+// The same payload in JSON, CBOR and MessagePack:
+//
+//	{"device": "dev-1", "temperature": 21.5, "count": 3, "ok": true, "tags": ["a", "b"], "nested": {"level": -2}}
+var (
+	sampleJSON = []byte(`{"device":"dev-1","temperature":21.5,"count":3,"ok":true,"tags":["a","b"],"nested":{"level":-2}}`)
+	sampleCBOR = payloadOf(0xa6,
+		0x66, "device", 0x65, "dev-1",
+		0x6b, "temperature", 0xf9, 0x4d, 0x60,
+		0x65, "count", 0x03,
+		0x62, "ok", 0xf5,
+		0x64, "tags", 0x82, 0x61, "a", 0x61, "b",
+		0x66, "nested", 0xa1, 0x65, "level", 0x21,
+	)
+	sampleMessagePack = payloadOf(0x86,
+		0xa6, "device", 0xa5, "dev-1",
+		0xab, "temperature", 0xcb, 0x40, 0x35, 0x80, 0, 0, 0, 0, 0,
+		0xa5, "count", 0x03,
+		0xa2, "ok", 0xc3,
+		0xa4, "tags", 0x92, 0xa1, "a", 0xa1, "b",
+		0xa6, "nested", 0x81, 0xa5, "level", 0xfe,
+	)
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"sample", sampleCBOR, `{"device":"dev-1","temperature":21.5,"count":3,"ok":true,"tags":["a","b"],"nested":{"level":-2}}`},
+		{"uint64", payloadOf(0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff), `18446744073709551615`},
+		{"negative", payloadOf(0x38, 0x63), `-100`},
+		{"whole half float", payloadOf(0xf9, 0x3c, 0x00), `1.0`},
+		{"NaN", payloadOf(0xfa, 0x7f, 0xc0, 0x00, 0x00), `"NaN"`},
+		{"bytes", payloadOf(0x43, 1, 2, 3), `"AQID"`},
+		{"indefinite text", payloadOf(0x7f, 0x62, "ab", 0x61, "c", 0xff), `"abc"`},
+		{"indefinite array", payloadOf(0x9f, 0x01, 0x02, 0xff), `[1,2]`},
+		{"integer key", payloadOf(0xa1, 0x01, 0xf6), `{"1":null}`},
+		{"undefined", payloadOf(0xf7), `null`},
+		{"epoch tag", payloadOf(0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0), `1363896240`},
+		{"date tag", payloadOf(0xc0, 0x74, "2013-03-21T20:04:00Z"), `"2013-03-21T20:04:00Z"`},
+		{"self-described", payloadOf(0xd9, 0xd9, 0xf7, 0x80), `[]`},
+		{"bignum", payloadOf(0xc2, 0x49, 1, 0, 0, 0, 0, 0, 0, 0, 0), `18446744073709552000.0`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := decodeCBOR(tc.payload)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(b))
+		})
+	}
+
+	for name, payload := range map[string][]byte{
+		"truncated":     payloadOf(0x1a, 0x01),
+		"truncated map": payloadOf(0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+		"trailing":      payloadOf(0x01, 0x02),
+		"reserved":      payloadOf(0x1c),
+		"break":         payloadOf(0xff),
+		"nested":        append(bytes.Repeat([]byte{0x81}, maxNesting+1), 0x00),
+		"map key":       payloadOf(0xa1, 0x80, 0x00),
+	} {
+		_, err := decodeCBOR(payload)
+		require.Error(t, err, name)
+	}
+}
+
+func Test_framer_binaryFormats(t *testing.T) {
+	frame := func(format PayloadFormat, payload []byte) *data.Frame {
+		t.Helper()
+		f := newFramer(FrameOptions{Format: format, Flatten: true}, topicPattern{})
+		frame, err := f.toFrame([]Message{{Timestamp: time.Unix(0, 0), Value: payload}}, log.DefaultLogger)
+		require.NoError(t, err)
+		return frame
+	}
+	want := frame(PayloadFormatJSON, sampleJSON)
+	require.Equal(t, want, frame(PayloadFormatCBOR, sampleCBOR))
+	require.Equal(t, want, frame(PayloadFormatMessagePack, sampleMessagePack))
+	for _, payload := range [][]byte{sampleJSON, sampleCBOR, sampleMessagePack} {
+		require.Equal(t, want, frame(PayloadFormatAuto, payload))
+	}
+
+	undecodable := frame(PayloadFormatCBOR, sampleJSON)
+	require.Len(t, undecodable.Meta.Notices, 1)
+	require.Equal(t, "1 messages were left out because they could not be decoded as CBOR", undecodable.Meta.Notices[0].Text)
+}
+
+func TestDetectPayload(t *testing.T) {
+	for _, payload := range [][]byte{
+		[]byte("on"),
+		[]byte("°C"),
+		// A MessagePack string, and a CBOR and MessagePack integer.
+		payloadOf(0xa2, "on"),
+		payloadOf(0xcc, 0x01),
+		{},
+	} {
+		require.Equal(t, payload, detectPayload(payload))
+	}
+}
@@ -4,61 +4,368 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"math"
 	"math/rand"
+	"net/url"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/protobuf/reflect/protoregistry"
 )
 
 type Client interface {
 	GetTopic(string) (*Topic, bool)
 	IsConnected() bool
-	Subscribe(string, log.Logger) (*Topic, error)
+	Status() ConnectionStatus
+	WaitConnected(context.Context) error
+	Subscribe(string, FrameOptions, log.Logger) (*Topic, error)
+	Latest(context.Context, *Topic, time.Duration, log.Logger) (data.Frames, error)
+	Range(context.Context, *Topic, time.Time, time.Time, time.Duration, log.Logger) (data.Frames, error)
 	Unsubscribe(string, log.Logger) error
 	Dispose()
 }
 
+// ProtocolVersion is the MQTT protocol level sent in the CONNECT packet.
+type ProtocolVersion uint
+
+const (
+	// ProtocolVersionDefault lets the client negotiate 3.1.1 and fall back to 3.1.
+	ProtocolVersionDefault ProtocolVersion = 0
+	ProtocolVersion31      ProtocolVersion = 3
+	ProtocolVersion311     ProtocolVersion = 4
+	ProtocolVersion5       ProtocolVersion = 5
+)
+
+const (
+	defaultKeepAlive            = 60 * time.Second
+	defaultPingTimeout          = 60 * time.Second
+	defaultMaxReconnectInterval = 10 * time.Second
+	defaultConnectTimeout       = 30 * time.Second
+)
+
 type Options struct {
-	URI           string `json:"uri"`
-	Username      string `json:"username"`
-	Password      string `json:"password"`
-	ClientID      string `json:"clientID"`
-	TLSCACert     string `json:"tlsCACert"`
-	TLSClientCert string `json:"tlsClientCert"`
-	TLSClientKey  string `json:"tlsClientKey"`
-	TLSSkipVerify bool   `json:"tlsSkipVerify"`
+	URI string `json:"uri"`
+	// FailoverURIs are tried in order after URI when connecting or
+	// reconnecting to a clustered broker.
+	FailoverURIs    []string        `json:"failoverURIs"`
+	Username        string          `json:"username"`
+	Password        string          `json:"password"`
+	ClientID        string          `json:"clientID"`
+	ProtocolVersion ProtocolVersion `json:"protocolVersion"`
+	TLSCACert       string          `json:"tlsCACert"`
+	TLSClientCert   string          `json:"tlsClientCert"`
+	TLSClientKey    string          `json:"tlsClientKey"`
+	TLSSkipVerify   bool            `json:"tlsSkipVerify"`
+
+	// Connection tuning, in seconds. Zero values use the defaults above.
+	KeepAlive            int  `json:"keepAlive"`
+	PingTimeout          int  `json:"pingTimeout"`
+	MaxReconnectInterval int  `json:"maxReconnectInterval"`
+	ConnectTimeout       int  `json:"connectTimeout"`
+	CleanSession         bool `json:"cleanSession"`
+
+	// BufferSize is the number of messages buffered per topic between two
+	// frames. Zero uses DefaultBufferSize.
+	BufferSize int `json:"bufferSize"`
+	// BufferOverflow decides which message is dropped when a topic buffer
+	// is full. Empty uses DropOldest.
+	BufferOverflow OverflowPolicy `json:"bufferOverflow"`
+
+	// HistoryDuration is how long, in seconds, the messages of every topic
+	// are kept so streams start with the messages received before. Zero
+	// disables the history.
+	HistoryDuration int `json:"historyDuration"`
+	// HistorySize is the maximum number of messages kept per topic. Zero
+	// uses DefaultBufferSize.
+	HistorySize int `json:"historySize"`
+	// HistoryStorage decides where the history is kept. Empty uses
+	// HistoryMemory.
+	HistoryStorage HistoryStorage `json:"historyStorage"`
+	// HistoryDiskSize is the maximum size, in megabytes, of the history of
+	// every topic with HistoryDisk. Zero uses DefaultHistoryDiskSize.
+	HistoryDiskSize int `json:"historyDiskSize"`
+	// HistoryDir is the directory the history is stored in with
+	// HistoryDisk. It is set by the data source, not by the user.
+	HistoryDir string `json:"-"`
+
+	// ProtoDescriptorSet is a base64 encoded protobuf FileDescriptorSet
+	// holding the message types of protobuf payloads. It is read from the
+	// secure JSON data.
+	ProtoDescriptorSet string `json:"-"`
+
+	// Last Will and Testament, published by the broker when the connection
+	// drops without a clean disconnect. Disabled when WillTopic is empty.
+	WillTopic   string `json:"willTopic"`
+	WillPayload string `json:"willPayload"`
+	WillQoS     byte   `json:"willQoS"`
+	WillRetain  bool   `json:"willRetain"`
+
+	// Birth message, published after every successful connect. Disabled
+	// when BirthTopic is empty.
+	BirthTopic   string `json:"birthTopic"`
+	BirthPayload string `json:"birthPayload"`
+	BirthQoS     byte   `json:"birthQoS"`
+	BirthRetain  bool   `json:"birthRetain"`
+}
+
+// Validate checks that the broker URIs, the connection tuning settings and
+// the will and birth messages are usable.
+func (o *Options) Validate() error {
+	for _, uri := range o.brokerURIs() {
+		if _, err := url.Parse(uri); err != nil {
+			return backend.DownstreamErrorf("invalid MQTT broker URI %s: %w", uri, err)
+		}
+	}
+	if o.KeepAlive < 0 || o.KeepAlive > math.MaxUint16 {
+		return backend.DownstreamErrorf("invalid keep alive %d: must be between 0 and %d seconds", o.KeepAlive, math.MaxUint16)
+	}
+	if o.PingTimeout < 0 {
+		return backend.DownstreamErrorf("invalid ping timeout %d: must not be negative", o.PingTimeout)
+	}
+	if o.MaxReconnectInterval < 0 {
+		return backend.DownstreamErrorf("invalid max reconnect interval %d: must not be negative", o.MaxReconnectInterval)
+	}
+	if o.ConnectTimeout < 0 {
+		return backend.DownstreamErrorf("invalid connect timeout %d: must not be negative", o.ConnectTimeout)
+	}
+	if o.BufferSize < 0 {
+		return backend.DownstreamErrorf("invalid buffer size %d: must not be negative", o.BufferSize)
+	}
+	if err := o.BufferOverflow.validate(); err != nil {
+		return err
+	}
+	if o.HistoryDuration < 0 {
+		return backend.DownstreamErrorf("invalid history duration %d: must not be negative", o.HistoryDuration)
+	}
+	if o.HistorySize < 0 {
+		return backend.DownstreamErrorf("invalid history size %d: must not be negative", o.HistorySize)
+	}
+	if err := o.HistoryStorage.validate(); err != nil {
+		return err
+	}
+	if o.HistoryDiskSize < 0 {
+		return backend.DownstreamErrorf("invalid history disk size %d: must not be negative", o.HistoryDiskSize)
+	}
+	if o.HistoryStorage == HistoryDisk && o.HistoryDir == "" {
+		return backend.DownstreamErrorf("no directory to store the history on disk")
+	}
+	if err := validatePublish("will", o.WillTopic, o.WillQoS); err != nil {
+		return err
+	}
+	if err := validatePublish("birth", o.BirthTopic, o.BirthQoS); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validatePublish checks the topic and QoS of a message the client publishes.
+func validatePublish(name string, topic string, qos byte) error {
+	if qos > 2 {
+		return backend.DownstreamErrorf("invalid %s QoS %d, must be 0, 1 or 2", name, qos)
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return backend.DownstreamErrorf("invalid %s topic %s: must not contain wildcards", name, topic)
+	}
+	return nil
+}
+
+// brokerURIs returns the primary broker URI followed by the failover URIs.
+func (o *Options) brokerURIs() []string {
+	uris := []string{o.URI}
+	for _, uri := range o.FailoverURIs {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+func (o *Options) keepAlive() time.Duration {
+	return seconds(o.KeepAlive, defaultKeepAlive)
+}
+
+func (o *Options) pingTimeout() time.Duration {
+	return seconds(o.PingTimeout, defaultPingTimeout)
+}
+
+func (o *Options) maxReconnectInterval() time.Duration {
+	return seconds(o.MaxReconnectInterval, defaultMaxReconnectInterval)
+}
+
+func (o *Options) connectTimeout() time.Duration {
+	return seconds(o.ConnectTimeout, defaultConnectTimeout)
+}
+
+func seconds(v int, def time.Duration) time.Duration {
+	if v == 0 {
+		return def
+	}
+	return time.Duration(v) * time.Second
+}
+
+// exponentialBackoff returns the delay before reconnect attempt n. It starts
+// at one second and doubles up to the given maximum, like paho's 3.1.1 client.
+func exponentialBackoff(maxInterval time.Duration) func(int) time.Duration {
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+		delay := time.Second << min(attempt-1, 30)
+		if delay > maxInterval {
+			delay = maxInterval
+		}
+		return delay
+	}
+}
+
+// messageHandler is called for every message received on a subscribed topic.
+type messageHandler func(topic string, payload []byte)
+
+// connection is the protocol specific part of the client. It is implemented
+// on top of paho.mqtt.golang for MQTT 3.1/3.1.1 and paho.golang for MQTT 5.
+// Connections connect in the background and report their progress through
+// the connectionState they are created with.
+//
+// Subscribe registers the handler of the topic filter, replacing the one it
+// had. A nil handler subscribes again with the handler registered before, as
+// the MQTT 5 router would deliver every message once per registration.
+type connection interface {
+	Subscribe(topic string, qos byte, handler messageHandler) error
+	Unsubscribe(topic string) error
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	Disconnect()
+}
+
+// subscription is an active subscription to an MQTT topic.
+type subscription struct {
+	qos     byte
+	handler messageHandler
 }
 
 type client struct {
-	client paho.Client
+	conn   connection
+	state  *connectionState
 	topics TopicMap
+
+	// subscriptions holds every MQTT topic the client is subscribed to, so
+	// they can be restored when the broker did not keep the session.
+	// Topics shared between several panels use the highest QoS requested.
+	subscriptions map[string]subscription
+	// failed holds the error of every subscription that could not be
+	// restored after the last reconnect.
+	failed map[string]error
+	// lingering holds the timers ending the subscriptions kept for their
+	// history after the last stream stopped, by MQTT topic.
+	lingering map[string]*time.Timer
+	subMu     sync.Mutex
+
+	// queries numbers the queries for the latest messages and time ranges.
+	queries atomic.Uint64
+
+	// protoTypes holds the message types of protobuf payloads, nil
+	// without a descriptor set.
+	protoTypes *protoregistry.Files
+	// sparkplug holds the Sparkplug B births received on any topic, so
+	// the aliases of edge nodes born before a query started are resolved.
+	sparkplug sparkplugRegistry
+
+	birth  *birthMessage
+	logger log.Logger
+}
+
+// birthMessage is published after every successful connect.
+type birthMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
 }
 
 func NewClient(ctx context.Context, o Options) (Client, error) {
 	logger := log.DefaultLogger.FromContext(ctx)
-	opts := paho.NewClientOptions()
 
-	opts.AddBroker(o.URI)
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
 
 	clientID := o.ClientID
 	if clientID == "" {
 		clientID = fmt.Sprintf("grafana_%d", rand.Int())
 	}
-	opts.SetClientID(clientID)
 
-	if o.Username != "" {
-		opts.SetUsername(o.Username)
+	tlsConfig, err := newTLSConfig(o)
+	if err != nil {
+		return nil, err
 	}
 
-	if o.Password != "" {
-		opts.SetPassword(o.Password)
+	var protoTypes *protoregistry.Files
+	if o.ProtoDescriptorSet != "" {
+		protoTypes, err = parseDescriptorSet(o.ProtoDescriptorSet)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	logger.Info("MQTT Connecting", "clientID", clientID, "protocolVersion", o.ProtocolVersion)
+
+	c := &client{
+		state:         newConnectionState(),
+		subscriptions: make(map[string]subscription),
+		failed:        make(map[string]error),
+		lingering:     make(map[string]*time.Timer),
+		protoTypes:    protoTypes,
+		logger:        logger,
+	}
+	c.topics.BufferSize = o.BufferSize
+	c.topics.BufferOverflow = o.BufferOverflow
+	c.topics.HistoryDuration = time.Duration(o.HistoryDuration) * time.Second
+	c.topics.HistorySize = o.HistorySize
+	if o.HistoryStorage == HistoryDisk && o.HistoryDuration > 0 {
+		c.topics.HistoryDir = o.HistoryDir
+		c.topics.HistoryMaxBytes = int64(o.HistoryDiskSize) << 20
+		if err := pruneDiskHistory(o.HistoryDir, c.topics.HistoryDuration); err != nil {
+			logger.Warn("Failed to remove expired MQTT message history", "dir", o.HistoryDir, "error", err)
+		}
+	}
+	if o.BirthTopic != "" {
+		c.birth = &birthMessage{
+			topic:   o.BirthTopic,
+			payload: []byte(o.BirthPayload),
+			qos:     o.BirthQoS,
+			retain:  o.BirthRetain,
+		}
+	}
+	c.state.onConnect = c.onConnect
+
+	var conn connection
+	switch o.ProtocolVersion {
+	case ProtocolVersionDefault, ProtocolVersion31, ProtocolVersion311:
+		conn, err = newV3Connection(logger, o, clientID, tlsConfig, c.state)
+	case ProtocolVersion5:
+		conn, err = newV5Connection(logger, o, clientID, tlsConfig, c.state)
+	default:
+		return nil, backend.DownstreamErrorf("unsupported MQTT protocol version: %d", o.ProtocolVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn = conn
+
+	return c, nil
+}
+
+func newTLSConfig(o Options) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: o.TLSSkipVerify,
 	}
@@ -78,99 +385,285 @@ func NewClient(ctx context.Context, o Options) (Client, error) {
 		tlsConfig.RootCAs = caCertPool
 	}
 
-	opts.SetTLSConfig(tlsConfig)
-	opts.SetPingTimeout(60 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(false)
-	opts.SetMaxReconnectInterval(10 * time.Second)
-	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
-		logger.Warn("MQTT Connection lost", "error", err)
-	})
-	opts.SetReconnectingHandler(func(c paho.Client, options *paho.ClientOptions) {
-		logger.Debug("MQTT Reconnecting")
-	})
+	return tlsConfig, nil
+}
 
-	logger.Info("MQTT Connecting", "clientID", clientID)
+func (c *client) IsConnected() bool {
+	return c.state.get().State == StateConnected
+}
 
-	pahoClient := paho.NewClient(opts)
-	if token := pahoClient.Connect(); token.Wait() && token.Error() != nil {
-		return nil, backend.DownstreamErrorf("error connecting to MQTT broker: %s", token.Error())
+// Status returns the current connection state, the last connection error and
+// the subscriptions that could not be restored after reconnecting.
+func (c *client) Status() ConnectionStatus {
+	status := c.state.get()
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if len(c.failed) > 0 {
+		status.FailedSubscriptions = make(map[string]error, len(c.failed))
+		for topic, err := range c.failed {
+			status.FailedSubscriptions[topic] = err
+		}
 	}
-
-	return &client{
-		client: pahoClient,
-	}, nil
+	return status
 }
 
-func (c *client) IsConnected() bool {
-	return c.client.IsConnectionOpen()
+// WaitConnected blocks until the client is connected to the broker or ctx is
+// done.
+func (c *client) WaitConnected(ctx context.Context) error {
+	return c.state.wait(ctx)
 }
 
-func (c *client) HandleMessage(topic string, payload []byte) {
+// HandleMessage buffers a message received on the concrete topic for the
+// subscribers of topicPath, the encoded topic they subscribed to.
+func (c *client) HandleMessage(topicPath, topic string, payload []byte) {
 	message := Message{
 		Timestamp: time.Now(),
+		Topic:     topic,
 		Value:     payload,
 	}
 
-	c.topics.AddMessage(topic, message)
+	if strings.HasPrefix(topic, sparkplugNamespace+"/") {
+		c.sparkplug.observe(topic, payload)
+	}
+	c.topics.AddMessage(topicPath, message)
 }
 
 func (c *client) GetTopic(reqPath string) (*Topic, bool) {
 	return c.topics.Load(reqPath)
 }
 
-func (c *client) Subscribe(reqPath string, logger log.Logger) (*Topic, error) {
+func (c *client) Subscribe(reqPath string, options FrameOptions, logger log.Logger) (*Topic, error) {
 	// Check if there's already a topic with this exact key (reqPath)
 	if existingTopic, ok := c.topics.Load(reqPath); ok {
 		return existingTopic, nil
 	}
 
 	chunks := strings.Split(reqPath, "/")
-	if len(chunks) < 2 {
+	if len(chunks) < 3 {
 		return nil, backend.DownstreamErrorf("invalid path: %s", reqPath)
 	}
 	interval, err := time.ParseDuration(chunks[0])
 	if err != nil {
 		return nil, backend.DownstreamErrorf("invalid interval %s: %s", chunks[0], err)
 	}
+	qos, err := parseQoS(chunks[1])
+	if err != nil {
+		return nil, backend.DownstreamErrorf("invalid QoS %s: %s", chunks[1], err)
+	}
 
 	// For MQTT subscription, we only need the actual topic path (without streaming key)
 	// The streaming key is used for topic uniqueness in storage, but MQTT only cares about the topic path
-	topicPath := path.Join(chunks[1:]...)
-
-	// Create topic with the reqPath as the key for storage
-	// The actual topic components will be parsed when needed
+	topicPath := chunks[2]
 	t := &Topic{
-		Path:     topicPath,
-		Interval: interval,
+		Path:         topicPath,
+		StreamingKey: path.Join(chunks[3:]...),
+		QoS:          qos,
+		Interval:     interval,
+		FrameOptions: options,
 	}
+	if err := c.subscribe(reqPath, t, false, logger); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
 
+// subscribe subscribes to the topic and stores it under the given key. With
+// reuse, a subscription to the topic at the QoS or higher is shared without
+// subscribing again.
+func (c *client) subscribe(key string, t *Topic, reuse bool, logger log.Logger) error {
+	topicPath := t.Path
 	topic, err := decodeTopic(t.Path, logger)
 	if err != nil {
-		return nil, backend.DownstreamErrorf("error decoding MQTT topic name %s: %s", t.Path, err)
+		return backend.DownstreamErrorf("error decoding MQTT topic name %s: %s", t.Path, err)
 	}
 
-	logger.Debug("Subscribing to MQTT topic", "topic", topic)
+	t.pattern, err = parseTopicPattern(topic)
+	if err != nil {
+		return err
+	}
+	if t.Format == PayloadFormatProtobuf {
+		t.message, err = findMessageType(c.protoTypes, t.MessageType)
+		if err != nil {
+			return err
+		}
+	}
+	if t.Format == PayloadFormatSparkplug {
+		t.sparkplug = &c.sparkplug
+	}
+	if t.pattern.filter != topic {
+		// Subscribe to the filter the placeholders compile to. Topics are
+		// buffered by filter, so panels naming the levels differently share
+		// the subscription and its buffer.
+		topic = t.pattern.filter
+		t.Path = base64.RawURLEncoding.EncodeToString([]byte(topic))
+		topicPath = t.Path
+	}
 
-	if token := c.client.Subscribe(topic, 0, func(_ paho.Client, m paho.Message) {
-		// by wrapping HandleMessage we can directly get the correct topicPath for the incoming topic
-		// and don't need to regex it against + and #.
-		c.HandleMessage(topicPath, []byte(m.Payload()))
-	}); token.Wait() && token.Error() != nil {
-		return nil, backend.DownstreamErrorf("error subscribing to MQTT topic %s: %s", topic, token.Error())
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	// MQTT replaces an existing subscription to the same topic, so a panel
+	// asking for a lower QoS must not downgrade the shared subscription.
+	qos := t.QoS
+	if current, ok := c.subscriptions[topic]; ok {
+		if _, failed := c.failed[topic]; reuse && !failed && current.qos >= qos {
+			c.topics.Store(key, t)
+			return nil
+		}
+		qos = max(qos, current.qos)
+	}
+
+	logger.Debug("Subscribing to MQTT topic", "topic", topic, "qos", qos)
+
+	sub := subscription{
+		qos: qos,
+		handler: func(topic string, payload []byte) {
+			// by wrapping HandleMessage we can directly get the correct topicPath for the incoming topic
+			// and don't need to regex it against + and #. All panels subscribed to the topic share
+			// its buffer, so it does not matter which of them registered the handler.
+			c.HandleMessage(topicPath, topic, payload)
+		},
+	}
+	// The connection keeps the handler of a topic subscribed to already.
+	handler := sub.handler
+	if current, ok := c.subscriptions[topic]; ok {
+		sub.handler, handler = current.handler, nil
+	}
+	// Store the topic before subscribing, so retained messages delivered
+	// right after the SUBACK are buffered.
+	c.topics.Store(key, t)
+	if err := c.conn.Subscribe(topic, sub.qos, handler); err != nil {
+		c.topics.Delete(key)
+		return err
+	}
+	c.subscriptions[topic] = sub
+	delete(c.failed, topic)
+	return nil
+}
+
+// Latest returns data frames with the latest message of every topic matching
+// the topic filter. It subscribes to the filter for the duration of the call,
+// so the broker delivers the retained messages, and returns as soon as there
+// is a message. A filter with wildcards may match topics whose messages are
+// still on their way, so its messages are collected until the timeout.
+func (c *client) Latest(ctx context.Context, t *Topic, timeout time.Duration, logger log.Logger) (data.Frames, error) {
+	return c.query(ctx, t, timeout, logger, func(ctx context.Context, t *Topic) (data.Frames, error) {
+		return c.waitLatest(ctx, t, logger)
+	})
+}
+
+// Range returns data frames with the messages received between from and to,
+// taken from the history of the topic filter. When there are none, for
+// example because the history is disabled or the filter was not subscribed
+// before, it returns the latest messages like Latest, as long as they were
+// received in the time range.
+func (c *client) Range(ctx context.Context, t *Topic, from, to time.Time, timeout time.Duration, logger log.Logger) (data.Frames, error) {
+	return c.query(ctx, t, timeout, logger, func(ctx context.Context, t *Topic) (data.Frames, error) {
+		if t.history != nil {
+			messages, err := t.history.Range(from, to)
+			if err != nil {
+				return nil, err
+			}
+			if len(messages) > 0 {
+				return t.toFrames(messages, logger)
+			}
+		}
+		messages, err := c.latestMessages(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		messages = slices.DeleteFunc(messages, func(m Message) bool {
+			return m.Timestamp.Before(from) || m.Timestamp.After(to)
+		})
+		frames, err := t.toFrames(messages, logger)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 && t.history == nil {
+			frames[0].AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     "No message of the topic was received in the time range. Enable the history to keep the messages of topics.",
+			})
+		}
+		return frames, nil
+	})
+}
+
+// query subscribes to the topic filter of a query while it runs. Every query
+// has its own topic key, so it never shares a topic with a stream.
+func (c *client) query(ctx context.Context, t *Topic, timeout time.Duration, logger log.Logger, run func(context.Context, *Topic) (data.Frames, error)) (data.Frames, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := c.state.wait(ctx); err != nil {
+		return nil, backend.DownstreamErrorf("not connected to the MQTT broker after %s", timeout)
+	}
+
+	t = &Topic{
+		Path:         t.Path,
+		QoS:          t.QoS,
+		FrameOptions: t.FrameOptions,
+	}
+	key := path.Join("query", strconv.FormatUint(c.queries.Add(1), 10))
+	// The latest messages of a topic subscribed to already are buffered,
+	// subscribing again would make the broker send the retained messages
+	// to the streams sharing the subscription again.
+	if err := c.subscribe(key, t, true, logger); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.Unsubscribe(key, logger); err != nil {
+			logger.Error("Failed to unsubscribe from MQTT topic", "topic", t.Path, "error", err)
+		}
+	}()
+
+	return run(ctx, t)
+}
+
+// waitLatest returns data frames with the latest messages of the topic.
+func (c *client) waitLatest(ctx context.Context, t *Topic, logger log.Logger) (data.Frames, error) {
+	messages, err := c.latestMessages(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return t.toFrames(messages, logger)
+}
+
+// latestMessages returns the latest messages of the topic, waiting for
+// messages until the context is done. A filter without wildcards returns as
+// soon as there is a message.
+func (c *client) latestMessages(ctx context.Context, t *Topic) ([]Message, error) {
+	latest, ok := c.topics.latest(t.Path)
+	if !ok {
+		return nil, backend.DownstreamErrorf("no subscription for MQTT topic %s", t.Path)
+	}
+	wildcard := strings.ContainsAny(t.pattern.filter, "+#")
+	for {
+		changed := latest.wait()
+		messages := latest.get()
+		if len(messages) > 0 && !wildcard {
+			return messages, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return latest.get(), nil
+		}
 	}
-	// Store the topic using reqPath as the key (which includes streaming key)
-	c.topics.Map.Store(reqPath, t)
-	return t, nil
 }
 
 func (c *client) Unsubscribe(reqPath string, logger log.Logger) error {
-	t, ok := c.GetTopic(reqPath)
+	// Subscribe and Unsubscribe are serialized so a topic cannot be
+	// subscribed to again between checking for other subscriptions and
+	// unsubscribing from the broker.
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	t, ok := c.topics.Delete(reqPath)
 	if !ok {
 		return nil // No error if topic doesn't exist
 	}
-	c.topics.Delete(t.Key())
 
 	if exists := c.topics.HasSubscription(t.Path); exists {
 		// There are still other subscriptions to this path,
@@ -178,21 +671,111 @@ func (c *client) Unsubscribe(reqPath string, logger log.Logger) error {
 		return nil
 	}
 
-	logger.Debug("Unsubscribing from MQTT topic", "topic", t.Path)
-
 	topic, err := decodeTopic(t.Path, logger)
 	if err != nil {
 		return backend.DownstreamErrorf("error decoding MQTT topic name %s: %s", t.Path, err)
 	}
 
-	if token := c.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
-		return backend.DownstreamErrorf("error unsubscribing from MQTT topic %s: %s", t.Path, token.Error())
+	if c.topics.HistoryDuration > 0 {
+		c.linger(t.Path, topic)
+		return nil
 	}
 
-	return nil
+	logger.Debug("Unsubscribing from MQTT topic", "topic", topic)
+
+	delete(c.subscriptions, topic)
+	delete(c.failed, topic)
+
+	return c.conn.Unsubscribe(topic)
+}
+
+// linger keeps the subscription to a topic without streams for the history
+// duration, so streams started in the meantime find the messages received
+// since. It must be called with subMu held.
+func (c *client) linger(topicPath, topic string) {
+	if timer, ok := c.lingering[topic]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(c.topics.HistoryDuration, func() {
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+
+		if c.lingering[topic] != timer {
+			return // replaced by a later linger
+		}
+		delete(c.lingering, topic)
+		if !c.topics.Release(topicPath) {
+			return // streamed again
+		}
+
+		c.logger.Debug("Unsubscribing from MQTT topic", "topic", topic)
+		delete(c.subscriptions, topic)
+		delete(c.failed, topic)
+		if err := c.conn.Unsubscribe(topic); err != nil {
+			c.logger.Error("Failed to unsubscribe from MQTT topic", "topic", topic, "error", err)
+		}
+	})
+	c.lingering[topic] = timer
+}
+
+// onConnect announces the client with the birth message and restores the
+// subscriptions every time the connection comes up.
+func (c *client) onConnect() {
+	if c.birth != nil {
+		if err := c.conn.Publish(c.birth.topic, c.birth.qos, c.birth.retain, c.birth.payload); err != nil {
+			c.logger.Error("Failed to publish MQTT birth message", "topic", c.birth.topic, "error", err)
+		}
+	}
+	c.resubscribe()
+}
+
+// resubscribe re-issues every active subscription after (re)connecting. The
+// broker only restores subscriptions when it kept the session, which it does
+// not do for clean sessions, for a new client ID or after the session expired.
+// Subscriptions that fail are kept and retried on the next reconnect.
+func (c *client) resubscribe() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+
+	if len(c.subscriptions) == 0 {
+		return
+	}
+
+	c.logger.Debug("Restoring MQTT subscriptions", "count", len(c.subscriptions))
+
+	for topic, sub := range c.subscriptions {
+		if err := c.conn.Subscribe(topic, sub.qos, nil); err != nil {
+			c.logger.Error("Failed to restore MQTT subscription", "topic", topic, "error", err)
+			c.failed[topic] = err
+			continue
+		}
+		delete(c.failed, topic)
+	}
+}
+
+// parseQoS parses a QoS level from a topic key.
+func parseQoS(s string) (byte, error) {
+	qos, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	if qos > 2 {
+		return 0, fmt.Errorf("must be 0, 1 or 2")
+	}
+	return byte(qos), nil
 }
 
 func (c *client) Dispose() {
 	log.DefaultLogger.Info("MQTT Disconnecting")
-	c.client.Disconnect(250)
+	c.subMu.Lock()
+	for _, timer := range c.lingering {
+		timer.Stop()
+	}
+	c.subMu.Unlock()
+	c.conn.Disconnect()
+	if err := c.topics.Close(); err != nil {
+		log.DefaultLogger.Error("Failed to close MQTT message history", "error", err)
+	}
 }
@@ -1,12 +1,18 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"path"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 // Mock client that implements our Client interface directly
@@ -24,37 +30,47 @@ func (m *mockClient) IsConnected() bool {
 	return m.connected
 }
 
-func (m *mockClient) Subscribe(reqPath string, logger log.Logger) (*Topic, error) {
+func (m *mockClient) Subscribe(reqPath string, options FrameOptions, logger log.Logger) (*Topic, error) {
 	// Check if already exists
 	if existingTopic, ok := m.topics.Load(reqPath); ok {
 		return existingTopic, nil
 	}
 
+	// The key is interval/qos/base64topic followed by the streaming key, as
+	// for the real client.
 	chunks := strings.Split(reqPath, "/")
-	if len(chunks) < 2 {
+	if len(chunks) < 3 {
 		return nil, nil
 	}
 	interval, err := time.ParseDuration(chunks[0])
 	if err != nil {
 		return nil, err
 	}
+	qos, err := parseQoS(chunks[1])
+	if err != nil {
+		return nil, err
+	}
+	topic, err := decodeTopic(chunks[2], logger)
+	if err != nil {
+		return nil, err
+	}
 
-	topicPath := path.Join(chunks[1:]...)
 	t := &Topic{
-		Path:     topicPath,
-		Interval: interval,
-		Messages: []Message{},
+		Path:         chunks[2],
+		StreamingKey: path.Join(chunks[3:]...),
+		QoS:          qos,
+		Interval:     interval,
+		FrameOptions: options,
 	}
 
 	// Track MQTT subscription (simplified for testing)
 	if m.subscriptions == nil {
 		m.subscriptions = make(map[string]bool)
 	}
-	// For testing, assume we decode the topic properly
-	m.subscriptions["test/topic"] = true
+	m.subscriptions[topic] = true
 
 	// Store with reqPath as key
-	m.topics.Map.Store(reqPath, t)
+	m.topics.Store(reqPath, t)
 	return t, nil
 }
 
@@ -93,16 +109,18 @@ func TestClient_Subscribe_WithStreamingKey(t *testing.T) {
 		reqPath      string
 		expectTopic  bool
 		expectedPath string
+		expectedKey  string
 	}{
 		{
 			name:         "subscribe with streaming key",
-			reqPath:      "1s/dGVzdC90b3BpYw/user1/hash123/org456",
+			reqPath:      "1s/0/dGVzdC90b3BpYw/user1/hash123/org456",
 			expectTopic:  true,
-			expectedPath: "dGVzdC90b3BpYw/user1/hash123/org456",
+			expectedPath: "dGVzdC90b3BpYw",
+			expectedKey:  "user1/hash123/org456",
 		},
 		{
 			name:         "subscribe without streaming key",
-			reqPath:      "5s/dGVzdC90b3BpYw",
+			reqPath:      "5s/0/dGVzdC90b3BpYw",
 			expectTopic:  true,
 			expectedPath: "dGVzdC90b3BpYw",
 		},
@@ -113,14 +131,19 @@ func TestClient_Subscribe_WithStreamingKey(t *testing.T) {
 		},
 		{
 			name:        "invalid interval",
-			reqPath:     "invalid-interval/dGVzdC90b3BpYw",
+			reqPath:     "invalid-interval/0/dGVzdC90b3BpYw",
+			expectTopic: false,
+		},
+		{
+			name:        "invalid QoS",
+			reqPath:     "1s/3/dGVzdC90b3BpYw",
 			expectTopic: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			topic, err := c.Subscribe(tt.reqPath, log.DefaultLogger)
+			topic, err := c.Subscribe(tt.reqPath, FrameOptions{}, log.DefaultLogger)
 			if err != nil && tt.expectTopic {
 				t.Fatalf("Subscribe failed: %v", err)
 			}
@@ -140,6 +163,9 @@ func TestClient_Subscribe_WithStreamingKey(t *testing.T) {
 				if storedTopic.Path != tt.expectedPath {
 					t.Errorf("Expected topic path %s, got %s", tt.expectedPath, storedTopic.Path)
 				}
+				if storedTopic.StreamingKey != tt.expectedKey {
+					t.Errorf("Expected streaming key %s, got %s", tt.expectedKey, storedTopic.StreamingKey)
+				}
 			} else {
 				if topic != nil {
 					t.Errorf("Expected nil topic for invalid input, but got %v", topic)
@@ -152,10 +178,10 @@ func TestClient_Subscribe_WithStreamingKey(t *testing.T) {
 func TestClient_Subscribe_Deduplication(t *testing.T) {
 	c := newMockClient()
 
-	reqPath := "1s/dGVzdC90b3BpYw/user1/hash123/org456"
+	reqPath := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
 
 	// Subscribe first time
-	topic1, err := c.Subscribe(reqPath, log.DefaultLogger)
+	topic1, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -164,7 +190,7 @@ func TestClient_Subscribe_Deduplication(t *testing.T) {
 	}
 
 	// Subscribe second time - should return same topic
-	topic2, err := c.Subscribe(reqPath, log.DefaultLogger)
+	topic2, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -177,11 +203,7 @@ func TestClient_Subscribe_Deduplication(t *testing.T) {
 	}
 
 	// Verify only one topic is stored
-	count := 0
-	c.topics.Range(func(key, value any) bool {
-		count++
-		return true
-	})
+	count := c.topics.Len()
 
 	if count != 1 {
 		t.Errorf("Expected 1 stored topic, got %d", count)
@@ -192,19 +214,19 @@ func TestClient_Subscribe_MultipleStreamingKeys(t *testing.T) {
 	c := newMockClient()
 
 	// Same MQTT topic, same interval, different streaming keys
-	reqPath1 := "1s/dGVzdC90b3BpYw/user1/hash123/org456"
-	reqPath2 := "1s/dGVzdC90b3BpYw/user2/hash456/org456"
-	reqPath3 := "1s/dGVzdC90b3BpYw/user1/hash123/org789"
+	reqPath1 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+	reqPath2 := "1s/0/dGVzdC90b3BpYw/user2/hash456/org456"
+	reqPath3 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org789"
 
-	topic1, err := c.Subscribe(reqPath1, log.DefaultLogger)
+	topic1, err := c.Subscribe(reqPath1, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic2, err := c.Subscribe(reqPath2, log.DefaultLogger)
+	topic2, err := c.Subscribe(reqPath2, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic3, err := c.Subscribe(reqPath3, log.DefaultLogger)
+	topic3, err := c.Subscribe(reqPath3, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -219,11 +241,7 @@ func TestClient_Subscribe_MultipleStreamingKeys(t *testing.T) {
 	}
 
 	// Verify all three topics are stored separately
-	count := 0
-	c.topics.Range(func(key, value any) bool {
-		count++
-		return true
-	})
+	count := c.topics.Len()
 
 	if count != 3 {
 		t.Errorf("Expected 3 stored topics, got %d", count)
@@ -246,7 +264,7 @@ func TestClient_Subscribe_MultipleStreamingKeys(t *testing.T) {
 func TestClient_GetTopic(t *testing.T) {
 	c := newMockClient()
 
-	reqPath := "2s/dGVzdC90b3BpYw/streaming/key/123"
+	reqPath := "2s/0/dGVzdC90b3BpYw/streaming/key/123"
 
 	// Topic doesn't exist yet
 	_, found := c.GetTopic(reqPath)
@@ -255,7 +273,7 @@ func TestClient_GetTopic(t *testing.T) {
 	}
 
 	// Create topic
-	topic, err := c.Subscribe(reqPath, log.DefaultLogger)
+	topic, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -277,35 +295,712 @@ func TestClient_GetTopic(t *testing.T) {
 func TestClient_MessageHandling_WithStreamingKeys(t *testing.T) {
 	c := newMockClient()
 
-	// Create topics with same MQTT path but different streaming keys
-	reqPath1 := "1s/dGVzdC90b3BpYw/user1/hash123/org456"
-	reqPath2 := "1s/dGVzdC90b3BpYw/user2/hash456/org456"
+	// Create topics with same MQTT path but different streaming keys, and
+	// one for another MQTT path
+	reqPath1 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+	reqPath2 := "1s/0/dGVzdC90b3BpYw/user2/hash456/org456"
+	reqPath3 := "1s/0/b3RoZXIvdG9waWM/user1/hash123/org456"
 
-	topic1, err := c.Subscribe(reqPath1, log.DefaultLogger)
+	topic1, err := c.Subscribe(reqPath1, FrameOptions{}, log.DefaultLogger)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	topic2, err := c.Subscribe(reqPath2, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic2, err := c.Subscribe(reqPath2, log.DefaultLogger)
+	topic3, err := c.Subscribe(reqPath3, FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
 
-	if topic1 == nil || topic2 == nil {
-		t.Fatal("Expected both topics to be created")
+	if topic1 == nil || topic2 == nil || topic3 == nil {
+		t.Fatal("Expected all topics to be created")
 	}
 
 	// Simulate MQTT message arrival
-	mqttTopicPath := "dGVzdC90b3BpYw/user1/hash123/org456" // This is what HandleMessage receives
+	mqttTopicPath := "dGVzdC90b3BpYw" // This is what HandleMessage receives
 	c.HandleMessage(mqttTopicPath, []byte("test message"))
 
-	// Check that only the matching topic received the message
+	// Check that only the topics of the MQTT path received the message
 	updatedTopic1, _ := c.GetTopic(reqPath1)
 	updatedTopic2, _ := c.GetTopic(reqPath2)
+	updatedTopic3, _ := c.GetTopic(reqPath3)
 
-	if len(updatedTopic1.Messages) != 1 {
-		t.Errorf("Expected 1 message in topic1, got %d", len(updatedTopic1.Messages))
+	messages1, _ := updatedTopic1.Drain()
+	messages2, _ := updatedTopic2.Drain()
+	messages3, _ := updatedTopic3.Drain()
+	if len(messages1) != 1 {
+		t.Errorf("Expected 1 message in topic1, got %d", len(messages1))
 	}
-	if len(updatedTopic2.Messages) != 0 {
-		t.Errorf("Expected 0 messages in topic2, got %d", len(updatedTopic2.Messages))
+	if len(messages2) != 1 {
+		t.Errorf("Expected 1 message in topic2, got %d", len(messages2))
+	}
+	if len(messages3) != 0 {
+		t.Errorf("Expected 0 messages in topic3, got %d", len(messages3))
+	}
+}
+
+// fakeConnection records the subscriptions made by the client
+type fakeConnection struct {
+	subscriptions map[string]byte
+	subscribed    int
+	// handlers holds the handlers of every topic filter. Like the MQTT 5
+	// router, every handler registered for a filter is called.
+	handlers  map[string][]messageHandler
+	published []string
+	retained  []Message // delivered on every subscribe
+	err       error     // returned by Subscribe and Publish when set
+}
+
+func (f *fakeConnection) Subscribe(topic string, qos byte, handler messageHandler) error {
+	if handler != nil {
+		f.handlers[topic] = append(f.handlers[topic], handler)
+	}
+	if f.err != nil {
+		return f.err
+	}
+	f.subscriptions[topic] = qos
+	f.subscribed++
+	for _, m := range f.retained {
+		f.deliver(topic, m.Topic, m.Value)
+	}
+	return nil
+}
+
+// deliver calls the handlers of the topic filter with a message.
+func (f *fakeConnection) deliver(filter, topic string, payload []byte) {
+	for _, handler := range f.handlers[filter] {
+		handler(topic, payload)
+	}
+}
+
+func (f *fakeConnection) Unsubscribe(topic string) error {
+	delete(f.subscriptions, topic)
+	delete(f.handlers, topic)
+	return nil
+}
+
+func (f *fakeConnection) Publish(topic string, _ byte, _ bool, payload []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.published = append(f.published, topic+" "+string(payload))
+	return nil
+}
+
+func (f *fakeConnection) Disconnect() {}
+
+func newFakeConnectionClient() (*client, *fakeConnection) {
+	conn := &fakeConnection{subscriptions: make(map[string]byte), handlers: make(map[string][]messageHandler)}
+	return &client{
+		conn:          conn,
+		state:         newConnectionState(),
+		subscriptions: make(map[string]subscription),
+		failed:        make(map[string]error),
+		lingering:     make(map[string]*time.Timer),
+		logger:        log.DefaultLogger,
+	}, conn
+}
+
+func TestClient_Subscribe_Placeholders(t *testing.T) {
+	// site/{site}/dev/{device} and site/+/dev/+
+	withPlaceholders := "1s/0/c2l0ZS97c2l0ZX0vZGV2L3tkZXZpY2V9/user1/hash123/org456"
+	withWildcards := "1s/0/c2l0ZS8rL2Rldi8r/user2/hash456/org456"
+
+	t.Run("subscribes to the compiled filter", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		topic, err := c.Subscribe(withPlaceholders, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, map[string]byte{"site/+/dev/+": 0}, conn.subscriptions)
+		require.Equal(t, "c2l0ZS8rL2Rldi8r", topic.Path)
+	})
+
+	t.Run("shares the buffer with the wildcard filter", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		topic1, err := c.Subscribe(withPlaceholders, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		topic2, err := c.Subscribe(withWildcards, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 2, conn.subscribed)
+
+		c.subscriptions["site/+/dev/+"].handler("site/berlin/dev/1", []byte("42"))
+
+		messages1, _ := topic1.Drain()
+		messages2, _ := topic2.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages1))
+		require.Equal(t, []string{"42"}, bufferedValues(messages2))
+
+		require.NoError(t, c.Unsubscribe(withWildcards, log.DefaultLogger))
+		require.Contains(t, conn.subscriptions, "site/+/dev/+")
+		require.NoError(t, c.Unsubscribe(withPlaceholders, log.DefaultLogger))
+		require.Empty(t, conn.subscriptions)
+	})
+
+	t.Run("literal braces", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		// site/dev-{device}
+		_, err := c.Subscribe("1s/0/c2l0ZS9kZXYte2RldmljZX0/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Contains(t, conn.subscriptions, "site/dev-{device}")
+	})
+}
+
+func TestClient_Subscribe_Protobuf(t *testing.T) {
+	options := FrameOptions{Format: PayloadFormatProtobuf, MessageType: "acme.telemetry.Reading"}
+
+	t.Run("decodes the payloads of the message type", func(t *testing.T) {
+		c, _ := newFakeConnectionClient()
+		c.protoTypes = telemetryTypes(t)
+
+		topic, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", options, log.DefaultLogger)
+		require.NoError(t, err)
+		c.subscriptions["test/topic"].handler("test/topic", reading(t, topic.message, func(m *dynamicpb.Message) {
+			m.Set(topic.message.Fields().ByName("device"), protoreflect.ValueOfString("dev-1"))
+		}))
+
+		frame, err := topic.ToDataFrame(log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, "device", frame.Fields[1].Name)
+		require.Equal(t, "dev-1", *frame.Fields[1].At(0).(*string))
+	})
+
+	t.Run("unknown message type", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", options, log.DefaultLogger)
+		require.ErrorContains(t, err, "no protobuf descriptor set configured")
+		require.Empty(t, conn.subscriptions)
+	})
+}
+
+func TestClient_Subscribe_Sparkplug(t *testing.T) {
+	c, _ := newFakeConnectionClient()
+	// The edge node was born before the query started.
+	c.HandleMessage("spBv1.0/g1/NBIRTH/n1", "spBv1.0/g1/NBIRTH/n1", plantBirth)
+
+	topic, err := c.Subscribe("1s/0/c3BCdjEuMC9nMS8rL24x/user1/hash123/org456", FrameOptions{Format: PayloadFormatSparkplug}, log.DefaultLogger)
+	require.NoError(t, err)
+	c.subscriptions["spBv1.0/g1/+/n1"].handler("spBv1.0/g1/NDATA/n1", encodeSparkplug(1700000060000,
+		spMetric{alias: 1, kind: sparkplugDoubleValue, value: 21.0},
+	))
+
+	frame, err := topic.ToDataFrame(log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, "Temperature", frame.Fields[1].Name)
+	require.Equal(t, data.Labels{"group_id": "g1", "edge_node_id": "n1"}, frame.Fields[1].Labels)
+	require.Equal(t, 21.0, *frame.Fields[1].At(0).(*float64))
+}
+
+func TestClient_Subscribe_SparkplugDeath(t *testing.T) {
+	c, _ := newFakeConnectionClient()
+	// The edge node and its device were born before the query started.
+	c.HandleMessage("spBv1.0/g1/NBIRTH/n1", "spBv1.0/g1/NBIRTH/n1", plantBirth)
+	c.HandleMessage("spBv1.0/g1/DBIRTH/n1/pump", "spBv1.0/g1/DBIRTH/n1/pump", pumpBirth)
+
+	options := FrameOptions{Format: PayloadFormatSparkplug, TopicMode: TopicModeField}
+	topic, err := c.Subscribe("1s/0/c3BCdjEuMC9nMS8rL24x/user1/hash123/org456", options, log.DefaultLogger)
+	require.NoError(t, err)
+	c.subscriptions["spBv1.0/g1/+/n1"].handler("spBv1.0/g1/NDEATH/n1", encodeSparkplug(1700000060000, bdSeq(7)))
+
+	frame, err := topic.ToDataFrame(log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, 2, frame.Rows())
+	var devices []string
+	for _, field := range frame.Fields[1:] {
+		if field.Name != onlineFieldName {
+			continue
+		}
+		for i := 0; i < field.Len(); i++ {
+			if online, ok := field.At(i).(*bool); ok && online != nil {
+				require.False(t, *online)
+				devices = append(devices, field.Labels[sparkplugDeviceLabel])
+			}
+		}
+	}
+	require.Equal(t, []string{"", "pump"}, devices)
+	topics := frame.Fields[1]
+	require.Equal(t, topicFieldName, topics.Name)
+	require.Equal(t, "spBv1.0/g1/NDEATH/n1", topics.At(0))
+	require.Equal(t, "spBv1.0/g1/DDEATH/n1/pump", topics.At(1))
+}
+
+func TestClient_Subscribe_QoS(t *testing.T) {
+	t.Run("subscribes with the requested QoS", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		topic, err := c.Subscribe("1s/1/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, byte(1), topic.QoS)
+		require.Equal(t, byte(1), conn.subscriptions["test/topic"])
+	})
+
+	t.Run("shared subscription upgrades to the highest QoS", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, byte(0), conn.subscriptions["test/topic"])
+
+		_, err = c.Subscribe("1s/2/dGVzdC90b3BpYw/user2/hash456/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, byte(2), conn.subscriptions["test/topic"])
+
+		_, err = c.Subscribe("1s/1/dGVzdC90b3BpYw/user3/hash789/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, byte(2), conn.subscriptions["test/topic"])
+	})
+
+	t.Run("invalid QoS", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe("1s/3/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.Error(t, err)
+		require.Empty(t, conn.subscriptions)
+	})
+}
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		wantErr bool
+	}{
+		{name: "defaults", options: Options{}},
+		{name: "tuned", options: Options{KeepAlive: 5, PingTimeout: 2, MaxReconnectInterval: 30, ConnectTimeout: 10, CleanSession: true}},
+		{name: "negative keep alive", options: Options{KeepAlive: -1}, wantErr: true},
+		{name: "keep alive too large", options: Options{KeepAlive: 65536}, wantErr: true},
+		{name: "negative ping timeout", options: Options{PingTimeout: -1}, wantErr: true},
+		{name: "negative max reconnect interval", options: Options{MaxReconnectInterval: -1}, wantErr: true},
+		{name: "negative connect timeout", options: Options{ConnectTimeout: -1}, wantErr: true},
+		{name: "buffer", options: Options{BufferSize: 100, BufferOverflow: DropNewest}},
+		{name: "negative buffer size", options: Options{BufferSize: -1}, wantErr: true},
+		{name: "invalid buffer overflow policy", options: Options{BufferOverflow: "dropAll"}, wantErr: true},
+		{name: "history", options: Options{HistoryDuration: 3600, HistorySize: 1000}},
+		{name: "negative history duration", options: Options{HistoryDuration: -1}, wantErr: true},
+		{name: "negative history size", options: Options{HistorySize: -1}, wantErr: true},
+		{name: "history on disk", options: Options{HistoryDuration: 3600, HistoryStorage: HistoryDisk, HistoryDir: "/tmp/history"}},
+		{name: "history on disk without directory", options: Options{HistoryDuration: 3600, HistoryStorage: HistoryDisk}, wantErr: true},
+		{name: "invalid history storage", options: Options{HistoryStorage: "cloud"}, wantErr: true},
+		{name: "negative history disk size", options: Options{HistoryDiskSize: -1}, wantErr: true},
+		{name: "will and birth", options: Options{WillTopic: "grafana/status", WillQoS: 1, WillRetain: true, BirthTopic: "grafana/status", BirthQoS: 2}},
+		{name: "invalid will QoS", options: Options{WillTopic: "grafana/status", WillQoS: 3}, wantErr: true},
+		{name: "wildcard will topic", options: Options{WillTopic: "grafana/+"}, wantErr: true},
+		{name: "invalid birth QoS", options: Options{BirthTopic: "grafana/status", BirthQoS: 3}, wantErr: true},
+		{name: "wildcard birth topic", options: Options{BirthTopic: "grafana/#"}, wantErr: true},
+		{name: "failover URIs", options: Options{URI: "tcp://broker-1:1883", FailoverURIs: []string{"tcp://broker-2:1883"}}},
+		{name: "invalid failover URI", options: Options{URI: "tcp://broker-1:1883", FailoverURIs: []string{"tcp://broker 2:1883"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Validate()
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
 	}
 }
+
+func TestOptions_BrokerURIs(t *testing.T) {
+	o := Options{URI: "tcp://broker-1:1883"}
+	require.Equal(t, []string{"tcp://broker-1:1883"}, o.brokerURIs())
+
+	o.FailoverURIs = []string{" tcp://broker-2:1883", "", "tls://broker-3:8883"}
+	require.Equal(t, []string{"tcp://broker-1:1883", "tcp://broker-2:1883", "tls://broker-3:8883"}, o.brokerURIs())
+}
+
+func TestOptions_Durations(t *testing.T) {
+	o := Options{}
+	require.Equal(t, 60*time.Second, o.keepAlive())
+	require.Equal(t, 60*time.Second, o.pingTimeout())
+	require.Equal(t, 10*time.Second, o.maxReconnectInterval())
+	require.Equal(t, 30*time.Second, o.connectTimeout())
+
+	o = Options{KeepAlive: 5, PingTimeout: 2, MaxReconnectInterval: 120, ConnectTimeout: 3}
+	require.Equal(t, 5*time.Second, o.keepAlive())
+	require.Equal(t, 2*time.Second, o.pingTimeout())
+	require.Equal(t, 2*time.Minute, o.maxReconnectInterval())
+	require.Equal(t, 3*time.Second, o.connectTimeout())
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := exponentialBackoff(10 * time.Second)
+
+	require.Equal(t, time.Duration(0), backoff(0))
+	require.Equal(t, 1*time.Second, backoff(1))
+	require.Equal(t, 2*time.Second, backoff(2))
+	require.Equal(t, 8*time.Second, backoff(4))
+	require.Equal(t, 10*time.Second, backoff(5))
+	require.Equal(t, 10*time.Second, backoff(100))
+}
+
+func TestClient_Resubscribe(t *testing.T) {
+	t.Run("restores every active subscription", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe("1s/1/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		_, err = c.Subscribe("1s/2/b3RoZXIvdG9waWM/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		// the broker dropped the session
+		conn.subscriptions = make(map[string]byte)
+		conn.subscribed = 0
+
+		c.resubscribe()
+		require.Equal(t, 2, conn.subscribed)
+		require.Equal(t, map[string]byte{"test/topic": 1, "other/topic": 2}, conn.subscriptions)
+		require.Empty(t, c.Status().FailedSubscriptions)
+	})
+
+	t.Run("delivers every message once after reconnects", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		topic, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		_, err = c.Subscribe("1s/1/dGVzdC90b3BpYw/user2/hash456/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		c.resubscribe()
+		c.resubscribe()
+		require.Equal(t, 4, conn.subscribed)
+
+		conn.deliver("test/topic", "test/topic", []byte("42"))
+		messages, _ := topic.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages))
+	})
+
+	t.Run("does not restore unsubscribed topics", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		reqPath := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+		_, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.NoError(t, c.Unsubscribe(reqPath, log.DefaultLogger))
+		conn.subscribed = 0
+
+		c.resubscribe()
+		require.Equal(t, 0, conn.subscribed)
+	})
+
+	t.Run("reports failed subscriptions until they are restored", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		conn.err = errors.New("not authorized")
+		c.resubscribe()
+		require.Equal(t, map[string]error{"test/topic": conn.err}, c.Status().FailedSubscriptions)
+
+		conn.err = nil
+		c.resubscribe()
+		require.Empty(t, c.Status().FailedSubscriptions)
+		require.Equal(t, byte(0), conn.subscriptions["test/topic"])
+	})
+
+	t.Run("runs when the connection comes up", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+		c.state.onConnect = c.resubscribe
+
+		_, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		conn.subscribed = 0
+
+		c.state.set(StateConnected, nil)
+		require.Eventually(t, func() bool {
+			c.subMu.Lock()
+			defer c.subMu.Unlock()
+			return conn.subscribed == 1
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestClient_OnConnect(t *testing.T) {
+	t.Run("publishes the birth message on every connect", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+		c.birth = &birthMessage{topic: "grafana/status", payload: []byte("online"), qos: 1, retain: true}
+
+		c.onConnect()
+		c.onConnect()
+		require.Equal(t, []string{"grafana/status online", "grafana/status online"}, conn.published)
+	})
+
+	t.Run("without birth message", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		c.onConnect()
+		require.Empty(t, conn.published)
+	})
+}
+
+func TestClient_SharedTopic(t *testing.T) {
+	reqPath1 := "1m0s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+	reqPath2 := "1s/1/dGVzdC90b3BpYw/user2/hash456/org456"
+
+	t.Run("every subscriber receives the messages of the topic", func(t *testing.T) {
+		c, _ := newFakeConnectionClient()
+
+		topic1, err := c.Subscribe(reqPath1, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		topic2, err := c.Subscribe(reqPath2, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, "dGVzdC90b3BpYw", topic1.Path)
+		require.Equal(t, "user1/hash123/org456", topic1.StreamingKey)
+
+		c.HandleMessage("dGVzdC90b3BpYw", "test/topic", []byte("42"))
+
+		messages1, _ := topic1.Drain()
+		messages2, _ := topic2.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages1))
+		require.Equal(t, []string{"42"}, bufferedValues(messages2))
+		require.Equal(t, "test/topic", messages1[0].Topic)
+	})
+
+	t.Run("unsubscribing keeps the topic for the other subscribers", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+
+		_, err := c.Subscribe(reqPath1, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		_, err = c.Subscribe(reqPath2, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Unsubscribe(reqPath1, log.DefaultLogger))
+		_, ok := c.GetTopic(reqPath1)
+		require.False(t, ok)
+		require.Contains(t, conn.subscriptions, "test/topic")
+
+		require.NoError(t, c.Unsubscribe(reqPath2, log.DefaultLogger))
+		require.NotContains(t, conn.subscriptions, "test/topic")
+		require.Zero(t, c.topics.Len())
+	})
+}
+
+func TestClient_Latest(t *testing.T) {
+	newConnectedClient := func(retained ...Message) (*client, *fakeConnection) {
+		c, conn := newFakeConnectionClient()
+		c.state.set(StateConnected, nil)
+		conn.retained = retained
+		return c, conn
+	}
+
+	t.Run("returns the retained message without waiting", func(t *testing.T) {
+		c, conn := newConnectedClient(Message{Topic: "test/topic", Value: []byte("42")})
+
+		start := time.Now()
+		frames, err := c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Less(t, time.Since(start), time.Minute)
+		require.Equal(t, 1, frame.Rows())
+		require.Empty(t, conn.subscriptions)
+		require.Zero(t, c.topics.Len())
+	})
+
+	t.Run("collects the messages of a wildcard filter until the timeout", func(t *testing.T) {
+		c, _ := newConnectedClient(
+			Message{Topic: "plant/b/temperature", Value: []byte("2")},
+			Message{Topic: "plant/a/temperature", Value: []byte("1")},
+			Message{Topic: "plant/b/temperature", Value: []byte("3")},
+		)
+
+		// plant/+/temperature
+		topic := &Topic{Path: "cGxhbnQvKy90ZW1wZXJhdHVyZQ", FrameOptions: FrameOptions{TopicMode: TopicModeField}}
+		frames, err := c.Latest(context.Background(), topic, 50*time.Millisecond, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, 2, frame.Rows())
+		require.Equal(t, "plant/a/temperature", frame.Fields[1].At(0))
+		require.Equal(t, "plant/b/temperature", frame.Fields[1].At(1))
+		require.Equal(t, int64(3), *frame.Fields[2].At(1).(*int64))
+	})
+
+	t.Run("returns an empty frame without messages", func(t *testing.T) {
+		c, _ := newConnectedClient()
+
+		frames, err := c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, 10*time.Millisecond, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Zero(t, frame.Rows())
+	})
+
+	t.Run("does not disturb streams on the same topic", func(t *testing.T) {
+		c, conn := newConnectedClient()
+		reqPath := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+		stream, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		c.HandleMessage("dGVzdC90b3BpYw", "test/topic", []byte("42"))
+
+		frames, err := c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		frame := frames[0]
+		require.Equal(t, 1, frame.Rows())
+
+		require.Contains(t, conn.subscriptions, "test/topic")
+		messages, _ := stream.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages))
+	})
+
+	t.Run("shares the subscription of a stream", func(t *testing.T) {
+		c, conn := newConnectedClient(Message{Topic: "test/topic", Value: []byte("42")})
+		reqPath := "1s/1/dGVzdC90b3BpYw/user1/hash123/org456"
+		stream, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 1, conn.subscribed)
+
+		frames, err := c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 1, frames[0].Rows())
+		require.Equal(t, 1, conn.subscribed)
+
+		// The retained message is not sent to the stream again.
+		messages, _ := stream.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages))
+		require.Equal(t, byte(1), conn.subscriptions["test/topic"])
+	})
+
+	t.Run("subscribes again for a higher QoS", func(t *testing.T) {
+		c, conn := newConnectedClient()
+		_, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		_, err = c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw", QoS: 1}, 10*time.Millisecond, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 2, conn.subscribed)
+	})
+
+	t.Run("fails when not connected", func(t *testing.T) {
+		c, _ := newFakeConnectionClient()
+
+		_, err := c.Latest(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, 10*time.Millisecond, log.DefaultLogger)
+		require.ErrorContains(t, err, "not connected to the MQTT broker")
+	})
+}
+
+func TestClient_Range(t *testing.T) {
+	now := time.Now()
+	newConnectedClient := func(retained ...Message) (*client, *fakeConnection) {
+		c, conn := newFakeConnectionClient()
+		c.topics.HistoryDuration = time.Hour
+		c.state.set(StateConnected, nil)
+		conn.retained = retained
+		return c, conn
+	}
+
+	t.Run("returns the messages of the time range from the history", func(t *testing.T) {
+		c, _ := newConnectedClient()
+		reqPath := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+		_, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		for i, value := range []string{"1", "2", "3"} {
+			c.topics.AddMessage("dGVzdC90b3BpYw", Message{
+				Timestamp: now.Add(time.Duration(i-3) * time.Minute),
+				Topic:     "test/topic",
+				Value:     []byte(value),
+			})
+		}
+
+		frames, err := c.Range(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, now.Add(-150*time.Second), now, time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		require.Equal(t, 2, frames[0].Rows())
+		require.Equal(t, int64(2), *frames[0].Fields[1].At(0).(*int64))
+	})
+
+	t.Run("falls back to the latest messages of the time range", func(t *testing.T) {
+		c, _ := newConnectedClient(Message{Topic: "test/topic", Value: []byte("42")})
+		// The history of a new subscription is empty.
+		c.topics.HistoryDuration = 0
+
+		frames, err := c.Range(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, now, now.Add(time.Hour), time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		require.Equal(t, 1, frames[0].Rows())
+
+		frames, err = c.Range(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, now.Add(-2*time.Hour), now.Add(-time.Hour), time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		require.Zero(t, frames[0].Rows())
+		require.Len(t, frames[0].Meta.Notices, 1)
+		require.Contains(t, frames[0].Meta.Notices[0].Text, "Enable the history")
+	})
+
+	t.Run("shares the subscription of a stream", func(t *testing.T) {
+		c, conn := newConnectedClient(Message{Topic: "test/topic", Value: []byte("42")})
+		stream, err := c.Subscribe("1s/0/dGVzdC90b3BpYw/user1/hash123/org456", FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		frames, err := c.Range(context.Background(), &Topic{Path: "dGVzdC90b3BpYw"}, now, now.Add(time.Hour), time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 1, frames[0].Rows())
+		require.Equal(t, 1, conn.subscribed)
+		messages, _ := stream.Drain()
+		require.Equal(t, []string{"42"}, bufferedValues(messages))
+	})
+
+	t.Run("returns a frame per topic", func(t *testing.T) {
+		c, _ := newConnectedClient(
+			Message{Topic: "plant/b/temperature", Value: []byte("2")},
+			Message{Topic: "plant/a/temperature", Value: []byte("1")},
+		)
+
+		// plant/+/temperature
+		topic := &Topic{Path: "cGxhbnQvKy90ZW1wZXJhdHVyZQ", FrameOptions: FrameOptions{TopicMode: TopicModeFrame}}
+		frames, err := c.Range(context.Background(), topic, now.Add(-time.Minute), now.Add(time.Minute), time.Minute, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frames, 2)
+		require.Equal(t, "plant/b/temperature", frames[0].Name)
+		require.Equal(t, "plant/a/temperature", frames[1].Name)
+		require.Len(t, frames[0].Fields, 2)
+	})
+}
+
+func TestClient_HistoryLinger(t *testing.T) {
+	reqPath := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+
+	t.Run("keeps the subscription for the history duration", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+		c.topics.HistoryDuration = 50 * time.Millisecond
+
+		_, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.NoError(t, c.Unsubscribe(reqPath, log.DefaultLogger))
+
+		c.subMu.Lock()
+		require.Contains(t, conn.subscriptions, "test/topic")
+		c.subMu.Unlock()
+
+		require.Eventually(t, func() bool {
+			c.subMu.Lock()
+			defer c.subMu.Unlock()
+			return len(conn.subscriptions) == 0
+		}, time.Second, 5*time.Millisecond)
+		require.Empty(t, c.subscriptions)
+	})
+
+	t.Run("streams started in the meantime keep the subscription", func(t *testing.T) {
+		c, conn := newFakeConnectionClient()
+		c.topics.HistoryDuration = 20 * time.Millisecond
+
+		_, err := c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.NoError(t, c.Unsubscribe(reqPath, log.DefaultLogger))
+		_, err = c.Subscribe(reqPath, FrameOptions{}, log.DefaultLogger)
+		require.NoError(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+		c.subMu.Lock()
+		defer c.subMu.Unlock()
+		require.Contains(t, conn.subscriptions, "test/topic")
+		require.Empty(t, c.lingering)
+	})
+}
@@ -0,0 +1,139 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// v3Connection is a connection speaking MQTT 3.1 or 3.1.1.
+type v3Connection struct {
+	client paho.Client
+	done   chan struct{}
+	broker atomic.Pointer[url.URL] // broker of the last connection attempt
+}
+
+// newV3Connection creates the connection and starts connecting in the
+// background. Once connected, paho's auto reconnect takes over. paho tries
+// the brokers in order on every (re)connect.
+func newV3Connection(logger log.Logger, o Options, clientID string, tlsConfig *tls.Config, state *connectionState) (*v3Connection, error) {
+	c := &v3Connection{
+		done: make(chan struct{}),
+	}
+	opts := paho.NewClientOptions()
+
+	for _, uri := range o.brokerURIs() {
+		opts.AddBroker(uri)
+	}
+	opts.SetClientID(clientID)
+	opts.SetProtocolVersion(uint(o.ProtocolVersion))
+
+	if o.Username != "" {
+		opts.SetUsername(o.Username)
+	}
+
+	if o.Password != "" {
+		opts.SetPassword(o.Password)
+	}
+
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetPingTimeout(o.pingTimeout())
+	opts.SetKeepAlive(o.keepAlive())
+	opts.SetConnectTimeout(o.connectTimeout())
+	opts.SetAutoReconnect(true)
+	opts.SetCleanSession(o.CleanSession)
+	opts.SetMaxReconnectInterval(o.maxReconnectInterval())
+	if o.WillTopic != "" {
+		opts.SetBinaryWill(o.WillTopic, []byte(o.WillPayload), o.WillQoS, o.WillRetain)
+	}
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		c.broker.Store(broker)
+		return tlsCfg
+	})
+	opts.SetOnConnectHandler(func(_ paho.Client) {
+		broker := c.broker.Load()
+		logger.Info("MQTT Connected", "broker", broker.Redacted())
+		state.connected(broker)
+	})
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		logger.Warn("MQTT Connection lost", "error", err)
+		state.set(StateConnecting, backend.DownstreamErrorf("connection lost: %s", err))
+	})
+	opts.SetReconnectingHandler(func(_ paho.Client, _ *paho.ClientOptions) {
+		logger.Debug("MQTT Reconnecting")
+	})
+
+	c.client = paho.NewClient(opts)
+	go c.connect(logger, exponentialBackoff(o.maxReconnectInterval()), state)
+
+	return c, nil
+}
+
+// connect retries the initial connection until it succeeds or the connection
+// is disconnected. paho only reconnects automatically after the first
+// successful connection.
+func (c *v3Connection) connect(logger log.Logger, backoff func(int) time.Duration, state *connectionState) {
+	for attempt := 1; ; attempt++ {
+		token := c.client.Connect()
+		token.Wait()
+
+		err := token.Error()
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		logger.Warn("MQTT Connection failed", "error", err, "attempt", attempt)
+		state.set(StateFailed, backend.DownstreamErrorf("error connecting to MQTT broker: %s", err))
+
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *v3Connection) Subscribe(topic string, qos byte, handler messageHandler) error {
+	token := c.client.Subscribe(topic, qos, func(_ paho.Client, m paho.Message) {
+		handler(m.Topic(), m.Payload())
+	})
+	if token.Wait() && token.Error() != nil {
+		return backend.DownstreamErrorf("error subscribing to MQTT topic %s: %s", topic, token.Error())
+	}
+	// MQTT 3.1.1 brokers reject a subscription with the 0x80 return code
+	// rather than an error, so check what was actually granted.
+	if st, ok := token.(*paho.SubscribeToken); ok && st.Result()[topic] == 0x80 {
+		return backend.DownstreamErrorf("error subscribing to MQTT topic %s: subscription rejected by broker", topic)
+	}
+	return nil
+}
+
+func (c *v3Connection) Unsubscribe(topic string) error {
+	if token := c.client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		return backend.DownstreamErrorf("error unsubscribing from MQTT topic %s: %s", topic, token.Error())
+	}
+	return nil
+}
+
+func (c *v3Connection) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if token := c.client.Publish(topic, qos, retain, payload); token.Wait() && token.Error() != nil {
+		return backend.DownstreamErrorf("error publishing to MQTT topic %s: %s", topic, token.Error())
+	}
+	return nil
+}
+
+func (c *v3Connection) Disconnect() {
+	close(c.done)
+	c.client.Disconnect(250)
+}
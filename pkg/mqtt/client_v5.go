@@ -0,0 +1,389 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	paholog "github.com/eclipse/paho.golang/paho/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	// v5OperationTimeout bounds SUBSCRIBE and UNSUBSCRIBE round trips.
+	v5OperationTimeout = 10 * time.Second
+	// v5SessionExpiry keeps the session (and its subscriptions) on the broker
+	// across short reconnects, mirroring CleanSession(false) on 3.1.1.
+	v5SessionExpiry = uint32(time.Hour / time.Second)
+)
+
+// reasonCodes are the MQTT 5 reason codes that signal a failure, see
+// https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901031
+var reasonCodes = map[byte]string{
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8C: "bad authentication method",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0x9F: "connection rate exceeded",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// reasonError describes a failure reason code and the optional reason string
+// sent along with it by the broker.
+func reasonError(code byte, reason string) error {
+	text, ok := reasonCodes[code]
+	if !ok {
+		text = "unknown reason"
+	}
+	if reason != "" {
+		return fmt.Errorf("reason code 0x%02X (%s): %s", code, text, reason)
+	}
+	return fmt.Errorf("reason code 0x%02X (%s)", code, text)
+}
+
+// v5Pinger keeps the connection alive like paho.DefaultPinger, but gives up
+// when a PINGRESP does not arrive within the configured ping timeout instead
+// of waiting for a full keep alive period.
+type v5Pinger struct {
+	timeout time.Duration
+
+	mu                 sync.Mutex
+	lastPacketSent     time.Time
+	lastPacketReceived time.Time
+	lastPingResponse   time.Time
+}
+
+func (p *v5Pinger) Run(ctx context.Context, conn net.Conn, keepAlive uint16) error {
+	if keepAlive == 0 {
+		return nil
+	}
+	if conn == nil {
+		return fmt.Errorf("conn is nil")
+	}
+
+	interval := time.Duration(keepAlive) * time.Second
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var lastPingSent time.Time
+	errCh := make(chan error, 1)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errCh:
+			return err
+		case now := <-timer.C:
+			p.mu.Lock()
+			lastPingResponse := p.lastPingResponse
+			pingDue := p.lastPacketReceived.Add(interval)
+			if p.lastPacketSent.Before(p.lastPacketReceived) {
+				pingDue = p.lastPacketSent.Add(interval)
+			}
+			p.mu.Unlock()
+
+			if !lastPingSent.IsZero() && lastPingSent.After(lastPingResponse) {
+				waited := now.Sub(lastPingSent)
+				if waited >= p.timeout {
+					return fmt.Errorf("PINGRESP timed out after %s", waited.Round(time.Millisecond))
+				}
+				timer.Reset(p.timeout - waited)
+				continue
+			}
+
+			if now.Before(pingDue) {
+				timer.Reset(pingDue.Sub(now))
+				continue
+			}
+
+			lastPingSent = time.Now()
+			go func() {
+				if _, err := packets.NewControlPacket(packets.PINGREQ).WriteTo(conn); err != nil {
+					errCh <- fmt.Errorf("failed to send PINGREQ: %w", err)
+				}
+			}()
+			timer.Reset(min(interval, p.timeout))
+		}
+	}
+}
+
+func (p *v5Pinger) PacketSent() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPacketSent = time.Now()
+}
+
+func (p *v5Pinger) PacketReceived() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPacketReceived = time.Now()
+}
+
+func (p *v5Pinger) PingResp() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastPingResponse = time.Now()
+}
+
+func (p *v5Pinger) SetDebug(_ paholog.Logger) {}
+
+// v5Manager is the part of autopaho.ConnectionManager used by v5Connection.
+type v5Manager interface {
+	Subscribe(context.Context, *paho.Subscribe) (*paho.Suback, error)
+	Unsubscribe(context.Context, *paho.Unsubscribe) (*paho.Unsuback, error)
+	Publish(context.Context, *paho.Publish) (*paho.PublishResponse, error)
+	Disconnect(context.Context) error
+}
+
+// v5Connection is a connection speaking MQTT 5.
+type v5Connection struct {
+	cm     v5Manager
+	router *paho.StandardRouter
+	broker atomic.Pointer[url.URL] // broker of the last connection attempt
+
+	// handlers holds the handler of every topic filter. The router appends
+	// the handlers registered for a filter, so it has a single one per
+	// filter calling the handler of the last subscription.
+	handlersMu sync.RWMutex
+	handlers   map[string]messageHandler
+}
+
+// newV5Connection creates the connection. autopaho connects in the background,
+// trying the brokers in order, and keeps reconnecting until the connection is
+// disconnected.
+func newV5Connection(logger log.Logger, o Options, clientID string, tlsConfig *tls.Config, state *connectionState) (*v5Connection, error) {
+	var brokerURLs []*url.URL
+	for _, uri := range o.brokerURIs() {
+		brokerURL, err := url.Parse(uri)
+		if err != nil {
+			return nil, backend.DownstreamErrorf("invalid MQTT broker URI %s: %w", uri, err)
+		}
+		brokerURLs = append(brokerURLs, brokerURL)
+	}
+
+	c := &v5Connection{
+		router:   paho.NewStandardRouter(),
+		handlers: make(map[string]messageHandler),
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    brokerURLs,
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     uint16(o.keepAlive() / time.Second),
+		CleanStartOnInitialConnection: o.CleanSession,
+		SessionExpiryInterval:         v5SessionExpiry,
+		ConnectTimeout:                o.connectTimeout(),
+		ReconnectBackoff:              exponentialBackoff(o.maxReconnectInterval()),
+		ConnectUsername:               o.Username,
+		ConnectPacketBuilder: func(cp *paho.Connect, broker *url.URL) (*paho.Connect, error) {
+			c.broker.Store(broker)
+			return cp, nil
+		},
+		OnConnectionUp: func(_ *autopaho.ConnectionManager, _ *paho.Connack) {
+			broker := c.broker.Load()
+			logger.Info("MQTT Connected", "broker", broker.Redacted())
+			state.connected(broker)
+		},
+		OnConnectionDown: func() bool {
+			logger.Debug("MQTT Reconnecting")
+			state.set(StateConnecting, nil)
+			return true
+		},
+		OnConnectError: func(err error) {
+			var connackErr *autopaho.ConnackError
+			if errors.As(err, &connackErr) {
+				err = reasonError(connackErr.ReasonCode, connackErr.Reason)
+			}
+			logger.Warn("MQTT Connection failed", "error", err)
+			state.set(StateFailed, backend.DownstreamErrorf("error connecting to MQTT broker: %s", err))
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:    clientID,
+			PingHandler: &v5Pinger{timeout: o.pingTimeout()},
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					c.router.Route(pr.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				logger.Warn("MQTT Connection lost", "error", err)
+				state.set(StateConnecting, backend.DownstreamErrorf("connection lost: %s", err))
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				reason := ""
+				if d.Properties != nil {
+					reason = d.Properties.ReasonString
+				}
+				err := reasonError(d.ReasonCode, reason)
+				logger.Warn("MQTT Connection lost", "error", err)
+				state.set(StateConnecting, backend.DownstreamErrorf("connection lost: %s", err))
+			},
+		},
+	}
+	if o.Password != "" {
+		cfg.ConnectPassword = []byte(o.Password)
+	}
+	if o.WillTopic != "" {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   o.WillTopic,
+			Payload: []byte(o.WillPayload),
+			QoS:     o.WillQoS,
+			Retain:  o.WillRetain,
+		}
+	}
+	if o.CleanSession {
+		// A session expiry of zero ends the session when the network
+		// connection closes, which is what clean session means in 3.1.1.
+		cfg.SessionExpiryInterval = 0
+	}
+
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, backend.DownstreamErrorf("error connecting to MQTT broker: %s", err)
+	}
+	c.cm = cm
+
+	return c, nil
+}
+
+func (c *v5Connection) Subscribe(topic string, qos byte, handler messageHandler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v5OperationTimeout)
+	defer cancel()
+
+	// Register the handler first so retained messages delivered right after
+	// the SUBACK are not lost.
+	var (
+		previous   messageHandler
+		subscribed bool
+	)
+	if handler != nil {
+		previous, subscribed = c.setHandler(topic, handler)
+	}
+
+	suback, err := c.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		reason := ""
+		if suback.Properties != nil {
+			reason = suback.Properties.ReasonString
+		}
+		err = reasonError(suback.Reasons[0], reason)
+	}
+	if err != nil {
+		// A failed subscription to a filter subscribed to before, such as
+		// when upgrading its QoS, leaves the earlier subscription working.
+		if subscribed {
+			c.setHandler(topic, previous)
+		} else if handler != nil {
+			c.removeHandler(topic)
+		}
+		return backend.DownstreamErrorf("error subscribing to MQTT topic %s: %s", topic, err)
+	}
+	return nil
+}
+
+// setHandler sets the handler of the topic filter and returns the previous
+// one, if the filter had one. The router calls the handlers holding its lock,
+// so it is only used without holding handlersMu. The client serializes
+// subscribing and unsubscribing.
+func (c *v5Connection) setHandler(topic string, handler messageHandler) (messageHandler, bool) {
+	c.handlersMu.Lock()
+	previous, ok := c.handlers[topic]
+	c.handlers[topic] = handler
+	c.handlersMu.Unlock()
+
+	if !ok {
+		c.router.RegisterHandler(topic, func(p *paho.Publish) {
+			c.handlersMu.RLock()
+			handler, ok := c.handlers[topic]
+			c.handlersMu.RUnlock()
+			if ok {
+				handler(p.Topic, p.Payload)
+			}
+		})
+	}
+	return previous, ok
+}
+
+// removeHandler removes the handler of the topic filter.
+func (c *v5Connection) removeHandler(topic string) {
+	c.handlersMu.Lock()
+	delete(c.handlers, topic)
+	c.handlersMu.Unlock()
+
+	c.router.UnregisterHandler(topic)
+}
+
+func (c *v5Connection) Unsubscribe(topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v5OperationTimeout)
+	defer cancel()
+
+	c.removeHandler(topic)
+
+	unsuback, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{
+		Topics: []string{topic},
+	})
+	if unsuback != nil && len(unsuback.Reasons) > 0 && unsuback.Reasons[0] >= 0x80 {
+		reason := ""
+		if unsuback.Properties != nil {
+			reason = unsuback.Properties.ReasonString
+		}
+		err = reasonError(unsuback.Reasons[0], reason)
+	}
+	if err != nil {
+		return backend.DownstreamErrorf("error unsubscribing from MQTT topic %s: %s", topic, err)
+	}
+	return nil
+}
+
+func (c *v5Connection) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v5OperationTimeout)
+	defer cancel()
+
+	if _, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	}); err != nil {
+		return backend.DownstreamErrorf("error publishing to MQTT topic %s: %s", topic, err)
+	}
+	return nil
+}
+
+func (c *v5Connection) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	_ = c.cm.Disconnect(ctx)
+}
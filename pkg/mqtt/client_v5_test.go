@@ -0,0 +1,107 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasonError(t *testing.T) {
+	t.Run("known reason code", func(t *testing.T) {
+		err := reasonError(0x87, "")
+		require.EqualError(t, err, "reason code 0x87 (not authorized)")
+	})
+
+	t.Run("known reason code with reason string", func(t *testing.T) {
+		err := reasonError(0x8F, "no access to $SYS")
+		require.EqualError(t, err, "reason code 0x8F (topic filter invalid): no access to $SYS")
+	})
+
+	t.Run("unknown reason code", func(t *testing.T) {
+		err := reasonError(0xFE, "")
+		require.EqualError(t, err, "reason code 0xFE (unknown reason)")
+	})
+}
+
+// fakeV5Manager answers SUBSCRIBE packets with the reason code in reason.
+type fakeV5Manager struct {
+	reason     byte
+	subscribed int
+}
+
+func (m *fakeV5Manager) Subscribe(context.Context, *paho.Subscribe) (*paho.Suback, error) {
+	m.subscribed++
+	return &paho.Suback{Reasons: []byte{m.reason}}, nil
+}
+
+func (m *fakeV5Manager) Unsubscribe(context.Context, *paho.Unsubscribe) (*paho.Unsuback, error) {
+	return &paho.Unsuback{Reasons: []byte{0}}, nil
+}
+
+func (m *fakeV5Manager) Publish(context.Context, *paho.Publish) (*paho.PublishResponse, error) {
+	return &paho.PublishResponse{}, nil
+}
+
+func (m *fakeV5Manager) Disconnect(context.Context) error {
+	return nil
+}
+
+func TestV5Connection_Subscribe(t *testing.T) {
+	newConnection := func() (*v5Connection, *fakeV5Manager) {
+		m := &fakeV5Manager{}
+		return &v5Connection{cm: m, router: paho.NewStandardRouter(), handlers: make(map[string]messageHandler)}, m
+	}
+	var delivered []string
+	handler := func(topic string, payload []byte) {
+		delivered = append(delivered, topic+" "+string(payload))
+	}
+	publish := func(c *v5Connection) {
+		c.router.Route(&packets.Publish{Topic: "test/topic", Payload: []byte("42"), Properties: &packets.Properties{}})
+	}
+
+	t.Run("delivers every message once to a topic subscribed again", func(t *testing.T) {
+		delivered = nil
+		c, m := newConnection()
+		for qos := byte(0); qos < 3; qos++ {
+			require.NoError(t, c.Subscribe("test/+", qos, handler))
+		}
+		require.Equal(t, 3, m.subscribed)
+
+		publish(c)
+		require.Equal(t, []string{"test/topic 42"}, delivered)
+	})
+
+	t.Run("a failed subscription keeps the earlier one", func(t *testing.T) {
+		delivered = nil
+		c, m := newConnection()
+		require.NoError(t, c.Subscribe("test/+", 0, handler))
+		m.reason = 0x9B
+		require.ErrorContains(t, c.Subscribe("test/+", 2, handler), "QoS not supported")
+
+		publish(c)
+		require.Equal(t, []string{"test/topic 42"}, delivered)
+	})
+
+	t.Run("a failed subscription does not deliver messages", func(t *testing.T) {
+		delivered = nil
+		c, m := newConnection()
+		m.reason = 0x87
+		require.ErrorContains(t, c.Subscribe("test/+", 0, handler), "not authorized")
+
+		publish(c)
+		require.Empty(t, delivered)
+	})
+
+	t.Run("unsubscribing stops the delivery", func(t *testing.T) {
+		delivered = nil
+		c, _ := newConnection()
+		require.NoError(t, c.Subscribe("test/+", 0, handler))
+		require.NoError(t, c.Unsubscribe("test/+"))
+
+		publish(c)
+		require.Empty(t, delivered)
+	})
+}
@@ -3,18 +3,277 @@ package mqtt
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// TopicMode controls how the messages of the different topics matched by a
+// wildcard subscription are told apart in the data frame.
+type TopicMode string
+
+const (
+	// TopicModeNone merges the messages of all topics into the same fields.
+	TopicModeNone TopicMode = ""
+	// TopicModeField adds the topic of each message as a string field.
+	TopicModeField TopicMode = "field"
+	// TopicModeLabel keeps separate fields per topic, labeled with the topic.
+	TopicModeLabel TopicMode = "label"
+	// TopicModeFrame returns one frame per topic. Live channels carry a
+	// single frame, so streamed frames include the topic field like
+	// TopicModeField and the frontend splits them.
+	TopicModeFrame TopicMode = "frame"
+)
+
+// topicFieldName is the name of the field holding the topic of each message.
+const topicFieldName = "Topic"
+
+// topicLabel is the label holding the topic in TopicModeLabel.
+const topicLabel = "topic"
+
+func (m TopicMode) validate() error {
+	switch m {
+	case TopicModeNone, TopicModeField, TopicModeLabel, TopicModeFrame:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid topic mode %q: must be %q, %q or %q", m, TopicModeField, TopicModeLabel, TopicModeFrame)
+	}
+}
+
+// ArrayMode controls how JSON arrays are converted to fields.
+type ArrayMode string
+
+const (
+	// ArrayModeJSON keeps arrays as JSON fields.
+	ArrayModeJSON ArrayMode = ""
+	// ArrayModeIndex flattens every array element into a field of its own,
+	// named after its index.
+	ArrayModeIndex ArrayMode = "index"
+)
+
+func (m ArrayMode) validate() error {
+	switch m {
+	case ArrayModeJSON, ArrayModeIndex:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid array mode %q: must be empty or %q", m, ArrayModeIndex)
+	}
+}
+
+// PayloadFormat is the encoding of the message payloads.
+type PayloadFormat string
+
+const (
+	// PayloadFormatJSON reads JSON payloads. Other payloads are string
+	// values.
+	PayloadFormatJSON PayloadFormat = ""
+	// PayloadFormatProtobuf decodes binary protobuf payloads of a message
+	// type from the descriptor set of the data source.
+	PayloadFormatProtobuf PayloadFormat = "protobuf"
+	// PayloadFormatSparkplug decodes Sparkplug B payloads into a field per
+	// metric name.
+	PayloadFormatSparkplug PayloadFormat = "sparkplug"
+	// PayloadFormatCBOR decodes CBOR payloads.
+	PayloadFormatCBOR PayloadFormat = "cbor"
+	// PayloadFormatMessagePack decodes MessagePack payloads.
+	PayloadFormatMessagePack PayloadFormat = "msgpack"
+	// PayloadFormatAuto reads JSON payloads and decodes CBOR and
+	// MessagePack payloads holding a map or an array. Other payloads are
+	// string values.
+	PayloadFormatAuto PayloadFormat = "auto"
+	// PayloadFormatLineProtocol parses InfluxDB line protocol payloads into
+	// a row per line.
+	PayloadFormatLineProtocol PayloadFormat = "influx"
+)
+
+func (f PayloadFormat) validate() error {
+	switch f {
+	case PayloadFormatJSON, PayloadFormatProtobuf, PayloadFormatSparkplug, PayloadFormatCBOR, PayloadFormatMessagePack, PayloadFormatAuto, PayloadFormatLineProtocol:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid payload format %q: must be empty, %q, %q, %q, %q, %q or %q", f,
+			PayloadFormatProtobuf, PayloadFormatSparkplug, PayloadFormatCBOR, PayloadFormatMessagePack, PayloadFormatAuto, PayloadFormatLineProtocol)
+	}
+}
+
+// defaultSeparator joins the keys of flattened nested values.
+const defaultSeparator = "."
+
+// FrameOptions are the query options controlling how the messages of a topic
+// are converted to data frames.
+type FrameOptions struct {
+	TopicMode TopicMode `json:"topicMode,omitempty"`
+
+	// Format is the encoding of the payloads. Decoded protobuf, CBOR and
+	// MessagePack payloads are framed like JSON payloads, with all the options below. Sparkplug B
+	// metrics and line protocol fields are fields of their own and have
+	// their timestamp, so they cannot be selected, exploded or get a time
+	// field. TimeFormat is the precision of line protocol timestamps.
+	Format PayloadFormat `json:"format,omitempty"`
+	// MessageType is the full name of the protobuf message type of the
+	// payloads, such as "acme.telemetry.Reading".
+	MessageType string `json:"messageType,omitempty"`
+
+	// Flatten turns the values of nested JSON objects into fields of their
+	// own, named after their path, such as "sensor.temperature". Without
+	// it, only the keys of the outer object become fields and nested
+	// values are JSON fields.
+	Flatten bool `json:"flatten,omitempty"`
+	// Separator joins the keys of flattened values. Empty uses ".".
+	Separator string `json:"separator,omitempty"`
+	// MaxDepth is the number of nested levels flattened, deeper values are
+	// JSON fields. Zero flattens all levels.
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// Arrays controls how arrays are converted to fields when flattening.
+	Arrays ArrayMode `json:"arrays,omitempty"`
+
+	// Fields selects the values of JSON payloads that become fields. Empty
+	// turns all values into fields.
+	Fields []FieldSelector `json:"fields,omitempty"`
+
+	// TimeField is a JSONPath to the timestamp in JSON payloads. Empty, or
+	// a timestamp that cannot be parsed, uses the receive time.
+	TimeField string `json:"timeField,omitempty"`
+	// TimeFormat is the format of the timestamp.
+	TimeFormat TimeFormat `json:"timeFormat,omitempty"`
+	// TimeZone is the IANA time zone of timestamps whose layout has no time
+	// zone. Empty uses UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Explode turns every element of an array in JSON payloads into a row
+	// of its own. It is "$" for payloads that are arrays, or a JSONPath to
+	// an array in the payload, such as "$.samples". Fields and the time
+	// field are then selected in the elements.
+	Explode string `json:"explode,omitempty"`
+
+	// ForceFloat reads all numbers as floats. By default integers are read
+	// as 64-bit integers, so they keep their precision above 2^53.
+	ForceFloat bool `json:"forceFloat,omitempty"`
+
+	// TypeMismatch decides what happens to values whose type differs from
+	// the type of their field. Empty uses TypeMismatchNull.
+	TypeMismatch TypeMismatchPolicy `json:"typeMismatch,omitempty"`
+}
+
+// Validate returns an error if the options are invalid.
+func (o FrameOptions) Validate() error {
+	if err := o.TopicMode.validate(); err != nil {
+		return err
+	}
+	if err := o.Format.validate(); err != nil {
+		return err
+	}
+	if o.Format == PayloadFormatProtobuf && !protoreflect.FullName(o.MessageType).IsValid() {
+		return backend.DownstreamErrorf("invalid protobuf message type %q: must be a full name, such as acme.telemetry.Reading", o.MessageType)
+	}
+	if o.Format == PayloadFormatSparkplug && (len(o.Fields) > 0 || o.TimeField != "" || o.Explode != "") {
+		return backend.DownstreamErrorf("invalid options: Sparkplug B payloads cannot select fields, a time field or an array to explode")
+	}
+	if o.Format == PayloadFormatLineProtocol {
+		if len(o.Fields) > 0 || o.TimeField != "" || o.Explode != "" {
+			return backend.DownstreamErrorf("invalid options: InfluxDB line protocol payloads cannot select fields, a time field or an array to explode")
+		}
+		if !lineTimeFormat(o.TimeFormat) {
+			return backend.DownstreamErrorf("invalid time format %q: InfluxDB line protocol timestamps are Unix times", o.TimeFormat)
+		}
+	}
+	if o.MaxDepth < 0 {
+		return backend.DownstreamErrorf("invalid max depth %d: must not be negative", o.MaxDepth)
+	}
+	if err := o.Arrays.validate(); err != nil {
+		return err
+	}
+	if err := o.TypeMismatch.validate(); err != nil {
+		return err
+	}
+	if _, err := newTimestampParser(o); err != nil {
+		return err
+	}
+	if _, err := o.explodePath(); err != nil {
+		return err
+	}
+	return validateSelectors(o.Fields)
+}
+
+// explodePath returns the path to the array exploded into rows, which is
+// empty for payloads that are arrays.
+func (o FrameOptions) explodePath() ([]pathStep, error) {
+	if o.Explode == "" || o.Explode == "$" {
+		return nil, nil
+	}
+	return parseJSONPath(o.Explode)
+}
+
+// separator returns the separator joining the keys of flattened values.
+func (o FrameOptions) separator() string {
+	if o.Separator == "" {
+		return defaultSeparator
+	}
+	return o.Separator
+}
+
+// expands reports whether an object or array at the given depth becomes
+// fields rather than a JSON field. The outer object always does.
+func (o FrameOptions) expands(depth int) bool {
+	if depth == 0 {
+		return true
+	}
+	return o.Flatten && (o.MaxDepth == 0 || depth < o.MaxDepth)
+}
+
 type framer struct {
-	path     []string
-	iterator *jsoniter.Iterator
-	fields   []*data.Field
-	fieldMap map[string]int
+	options   FrameOptions
+	pattern   topicPattern
+	selectors []fieldSelector
+	// timestamps reads the timestamps of the messages, nil uses the receive
+	// time.
+	timestamps *timestampParser
+	// message is the protobuf message type of the payloads with
+	// PayloadFormatProtobuf.
+	message protoreflect.MessageDescriptor
+	// sparkplug holds the Sparkplug B births received by the client, and
+	// sparkplugLocal the ones framed, with PayloadFormatSparkplug.
+	sparkplug      *sparkplugRegistry
+	sparkplugLocal sparkplugRegistry
+	// explode is the path to the array exploded into rows, if exploding.
+	exploding bool
+	explode   []pathStep
+	path      []string
+	iterator  *jsoniter.Iterator
+	fields    []*data.Field
+	fieldMap  map[string]int
+	// topicField is the index of the topic field, or 0 if there is none.
+	topicField int
+
+	// labels are the labels of the message being framed, labelsKey tells
+	// apart the fields of messages with different labels. They are cached
+	// by topic in topicLabels.
+	labels      data.Labels
+	labelsKey   string
+	topicLabels map[string]messageLabels
+	// seriesLabels caches the labels of line protocol fields by topic and
+	// series.
+	seriesLabels map[string]messageLabels
+
+	// mismatches counts the values of the frame left null because of their
+	// type, by field name.
+	mismatches map[string]int
+	// duplicates counts the values of the frame left out because their row
+	// already had a value for their field, by field name.
+	duplicates map[string]int
+}
+
+// messageLabels are the labels attached to the fields of a topic's messages.
+type messageLabels struct {
+	labels data.Labels
+	key    string
 }
 
 func (df *framer) next(logger log.Logger) error {
@@ -23,8 +282,9 @@ func (df *framer) next(logger log.Logger) error {
 		v := df.iterator.ReadString()
 		df.addValue(data.FieldTypeNullableString, &v)
 	case jsoniter.NumberValue:
-		v := df.iterator.ReadFloat64()
-		df.addValue(data.FieldTypeNullableFloat64, &v)
+		if err := df.readNumber(string(df.iterator.ReadNumber())); err != nil {
+			return err
+		}
 	case jsoniter.BoolValue:
 		v := df.iterator.ReadBool()
 		df.addValue(data.FieldTypeNullableBool, &v)
@@ -32,67 +292,196 @@ func (df *framer) next(logger log.Logger) error {
 		df.addNil(logger)
 		df.iterator.ReadNil()
 	case jsoniter.ArrayValue:
-		df.addValue(data.FieldTypeJSON, json.RawMessage(df.iterator.SkipAndReturnBytes()))
+		if !df.options.Flatten || df.options.Arrays != ArrayModeIndex || !df.options.expands(len(df.path)) {
+			df.addValue(data.FieldTypeJSON, json.RawMessage(df.iterator.SkipAndReturnBytes()))
+			break
+		}
+		var err error
+		i := 0
+		df.iterator.ReadArrayCB(func(*jsoniter.Iterator) bool {
+			err = df.nextIn(strconv.Itoa(i), logger)
+			i++
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
 	case jsoniter.ObjectValue:
-		size := len(df.path)
-		if size > 0 {
+		if !df.options.expands(len(df.path)) {
 			df.addValue(data.FieldTypeJSON, json.RawMessage(df.iterator.SkipAndReturnBytes()))
 			break
 		}
-		for fname := df.iterator.ReadObject(); fname != ""; fname = df.iterator.ReadObject() {
-			if size == 0 {
-				df.path = append(df.path, fname)
-				if err := df.next(logger); err != nil {
-					return err
-				}
-			}
+		var err error
+		df.iterator.ReadMapCB(func(_ *jsoniter.Iterator, key string) bool {
+			err = df.nextIn(key, logger)
+			return err == nil
+		})
+		if err != nil {
+			return err
 		}
 	case jsoniter.InvalidValue:
 		return fmt.Errorf("invalid value")
 	}
-	df.path = []string{}
 	return nil
 }
 
+// nextIn reads the next value as the member of the current object or array
+// with the given key.
+func (df *framer) nextIn(key string, logger log.Logger) error {
+	df.path = append(df.path, key)
+	err := df.next(logger)
+	df.path = df.path[:len(df.path)-1]
+	return err
+}
+
 func (df *framer) key() string {
 	if len(df.path) == 0 {
 		return "Value"
 	}
-	return strings.Join(df.path, "")
+	return strings.Join(df.path, df.options.separator())
+}
+
+// fieldKey identifies the field of the current value. Messages with
+// different labels have their own fields.
+func (df *framer) fieldKey() string {
+	return df.key() + df.labelsKey
+}
+
+// setTopic sets the labels for the messages of the given topic: the topic
+// levels matched by placeholders, the group, edge node and device of
+// Sparkplug B messages and, in TopicModeLabel, the topic itself.
+func (df *framer) setTopic(topic string) {
+	ml, ok := df.topicLabels[topic]
+	if !ok {
+		labels := df.pattern.labels(topic)
+		if t, ok := parseSparkplugTopic(topic); ok && df.options.Format == PayloadFormatSparkplug {
+			if labels == nil {
+				labels = data.Labels{}
+			}
+			for k, v := range t.labels() {
+				labels[k] = v
+			}
+		}
+		if df.options.TopicMode == TopicModeLabel {
+			if labels == nil {
+				labels = data.Labels{}
+			}
+			labels[topicLabel] = topic
+		}
+		ml = messageLabels{labels: labels}
+		if labels != nil {
+			ml.key = "\x00" + labels.String()
+		}
+		df.topicLabels[topic] = ml
+	}
+	df.labels = ml.labels
+	df.labelsKey = ml.key
 }
 
 func (df *framer) addNil(logger log.Logger) {
-	if idx, ok := df.fieldMap[df.key()]; ok {
-		df.fields[idx].Set(0, nil)
+	if idx, ok := df.fieldMap[df.fieldKey()]; ok {
+		if df.fields[idx].Nullable() && !df.filled(idx) {
+			df.fields[idx].Append(nil)
+		}
 		return
 	}
 	logger.Debug("nil value for unknown field", "key", df.key())
 }
 
 func (df *framer) addValue(fieldType data.FieldType, v interface{}) {
-	if idx, ok := df.fieldMap[df.key()]; ok {
+	if idx, ok := df.fieldMap[df.fieldKey()]; ok {
+		if df.filled(idx) {
+			df.duplicates[df.fields[idx].Name]++
+			return
+		}
+		if isNumberType(fieldType) && isNumberType(df.fields[idx].Type()) {
+			df.appendNumber(idx, v)
+			return
+		}
 		if df.fields[idx].Type() != fieldType {
-			log.DefaultLogger.Debug("field type mismatch", "key", df.key(), "existing", df.fields[idx], "new", fieldType)
+			log.DefaultLogger.Debug("field type mismatch", "key", df.key(), "existing", df.fields[idx].Type(), "new", fieldType, "policy", df.options.TypeMismatch)
+			df.addMismatch(idx, fieldType, v)
 			return
 		}
 		df.fields[idx].Append(v)
 		return
 	}
+	df.newField(df.key(), df.fieldKey(), fieldType, v)
+}
+
+// filled reports whether the field at idx has a value for the current row,
+// such as when the flattened keys "a.b" and "a": {"b"} of a payload collide.
+// The first value is kept.
+func (df *framer) filled(idx int) bool {
+	return df.fields[idx].Len() > df.fields[0].Len()
+}
+
+// duplicateNotice returns the notice reporting the values left out because
+// their row already had a value for their field.
+func (df *framer) duplicateNotice() (data.Notice, bool) {
+	if len(df.duplicates) == 0 {
+		return data.Notice{}, false
+	}
+	count := 0
+	names := make([]string, 0, len(df.duplicates))
+	for name, n := range df.duplicates {
+		count += n
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("%d values were left out because their row already has a value for their field: %s", count, strings.Join(names, ", "))
+	if count == 1 {
+		text = "1 value was left out because its row already has a value for its field: " + names[0]
+	}
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     text,
+	}, true
+}
+
+// newField adds a field with the given name and key holding the value, and
+// null values for the previous rows.
+func (df *framer) newField(name, key string, fieldType data.FieldType, v interface{}) {
 	field := data.NewFieldFromFieldType(fieldType, df.fields[0].Len())
-	field.Name = df.key()
+	field.Name = name
+	if df.labels != nil {
+		field.Labels = df.labels.Copy()
+	}
 	field.Append(v)
 	df.fields = append(df.fields, field)
-	df.fieldMap[df.key()] = len(df.fields) - 1
+	df.fieldMap[key] = len(df.fields) - 1
 }
 
-func newFramer() *framer {
+func newFramer(options FrameOptions, pattern topicPattern) *framer {
 	df := &framer{
-		fieldMap: make(map[string]int),
+		options:      options,
+		pattern:      pattern,
+		selectors:    compileSelectors(options.Fields),
+		fieldMap:     make(map[string]int),
+		topicLabels:  make(map[string]messageLabels),
+		seriesLabels: make(map[string]messageLabels),
+		mismatches:   make(map[string]int),
+		duplicates:   make(map[string]int),
 	}
+	// The options are validated with the query.
+	df.timestamps, _ = newTimestampParser(options)
+	df.explode, _ = options.explodePath()
+	df.exploding = options.Explode != ""
+
 	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, 0)
 	timeField.Name = "Time"
 	df.fields = append(df.fields, timeField)
 	df.fieldMap["Time"] = 0
+
+	switch options.TopicMode {
+	case TopicModeField, TopicModeFrame:
+		// The topic field is not in fieldMap, so a payload key with the same
+		// name gets a field of its own.
+		topicField := data.NewFieldFromFieldType(data.FieldTypeString, 0)
+		topicField.Name = topicFieldName
+		df.fields = append(df.fields, topicField)
+		df.topicField = len(df.fields) - 1
+	}
 	return df
 }
 
@@ -104,20 +493,189 @@ func (df *framer) toFrame(messages []Message, logger log.Logger) (*data.Frame, e
 		}
 	}
 
+	clear(df.mismatches)
+	clear(df.duplicates)
+	invalidTimestamps, undecodable, unknownAliases, invalidLines := 0, 0, 0, 0
 	for _, message := range messages {
-		df.iterator = jsoniter.ParseBytes(jsoniter.ConfigDefault, message.Value)
-		err := df.next(logger)
+		if df.options.Format == PayloadFormatLineProtocol {
+			invalidLines += df.addLines(message)
+			continue
+		}
+		if df.options.Format == PayloadFormatSparkplug {
+			unknown, err := df.addSparkplug(message, logger)
+			if err != nil {
+				logger.Debug("Failed to decode MQTT message", "format", df.options.Format, "topic", message.Topic, "error", err)
+				undecodable++
+			}
+			unknownAliases += unknown
+			continue
+		}
+		value, err := df.decode(message.Value)
 		if err != nil {
-			// If JSON parsing fails, treat the raw bytes as a string value
-			logger.Debug("JSON parsing failed, treating as raw string", "error", err, "value", string(message.Value))
-			rawValue := string(message.Value)
-			df.addValue(data.FieldTypeNullableString, &rawValue)
+			logger.Debug("Failed to decode MQTT message", "format", df.options.Format, "topic", message.Topic, "error", err)
+			undecodable++
+			continue
+		}
+		df.setTopic(message.Topic)
+		for _, payload := range df.rows(value) {
+			df.readValues(payload, logger)
+			df.appendRow(df.timestamp(message.Timestamp, payload, &invalidTimestamps), message.Topic)
+		}
+	}
+
+	frame := data.NewFrame("mqtt", df.fields...)
+	if notice, ok := df.mismatchNotice(); ok {
+		frame.AppendNotices(notice)
+	}
+	if notice, ok := df.duplicateNotice(); ok {
+		frame.AppendNotices(notice)
+	}
+	if undecodable > 0 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d messages were left out because they could not be decoded as %s", undecodable, df.formatName()),
+		})
+	}
+	if unknownAliases > 0 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d metrics were left out because their alias is not in a birth certificate received since the query started", unknownAliases),
+		})
+	}
+	if invalidLines > 0 {
+		logger.Debug("Invalid InfluxDB line protocol lines", "count", invalidLines)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d lines were left out because they are not valid InfluxDB line protocol", invalidLines),
+		})
+	}
+	if invalidTimestamps > 0 {
+		logger.Debug("MQTT message rows without a valid timestamp", "timeField", df.options.TimeField, "count", invalidTimestamps)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d rows have no valid timestamp at %s, they use the time their message was received", invalidTimestamps, df.options.TimeField),
+		})
+	}
+	return frame, nil
+}
+
+// decode converts a payload to JSON, or returns it as is for
+// PayloadFormatJSON.
+func (df *framer) decode(payload []byte) ([]byte, error) {
+	switch df.options.Format {
+	case PayloadFormatProtobuf:
+		if df.message == nil {
+			return nil, fmt.Errorf("unknown protobuf message type %q", df.options.MessageType)
+		}
+		return decodeProtobuf(df.message, payload)
+	case PayloadFormatCBOR:
+		return decodeCBOR(payload)
+	case PayloadFormatMessagePack:
+		return decodeMessagePack(payload)
+	case PayloadFormatAuto:
+		return detectPayload(payload), nil
+	default:
+		return payload, nil
+	}
+}
+
+// detectPayload decodes CBOR and MessagePack payloads holding a map or an
+// array, and returns other payloads as is. Their maps and arrays start with
+// a byte above 0x7f, which never starts JSON or text in ASCII. CBOR is tried
+// first, payloads that are valid in both formats need an explicit format.
+func detectPayload(payload []byte) []byte {
+	if len(payload) == 0 || payload[0] < 0x80 {
+		return payload
+	}
+	for _, decode := range []func([]byte) ([]byte, error){decodeCBOR, decodeMessagePack} {
+		if b, err := decode(payload); err == nil && (b[0] == '{' || b[0] == '[') {
+			return b
+		}
+	}
+	return payload
+}
+
+// formatName names the payload format in notices.
+func (df *framer) formatName() string {
+	switch df.options.Format {
+	case PayloadFormatProtobuf:
+		return df.options.MessageType
+	case PayloadFormatSparkplug:
+		return "Sparkplug B"
+	case PayloadFormatCBOR:
+		return "CBOR"
+	case PayloadFormatMessagePack:
+		return "MessagePack"
+	case PayloadFormatLineProtocol:
+		return "InfluxDB line protocol"
+	default:
+		return string(df.options.Format)
+	}
+}
+
+// readValues reads the values of a payload into the fields.
+func (df *framer) readValues(payload []byte, logger log.Logger) {
+	df.path = df.path[:0]
+	if len(df.selectors) > 0 {
+		if err := df.selectFields(payload, logger); err != nil {
+			logger.Debug("Failed to select the fields of an invalid JSON payload", "error", err, "value", string(payload))
 		}
-		df.fields[0].Append(message.Timestamp)
-		df.extendFields(df.fields[0].Len() - 1)
+		return
 	}
 
-	return data.NewFrame("mqtt", df.fields...), nil
+	df.iterator = jsoniter.ParseBytes(jsoniter.ConfigDefault, payload)
+	if err := df.next(logger); err != nil {
+		// If JSON parsing fails, treat the raw bytes as a string value
+		logger.Debug("JSON parsing failed, treating as raw string", "error", err, "value", string(payload))
+		rawValue := string(payload)
+		df.addValue(data.FieldTypeNullableString, &rawValue)
+	}
+}
+
+// rows returns the payloads of the rows of a message: the elements of the
+// exploded array, or the message payload. Payloads without the array are a
+// single row.
+func (df *framer) rows(payload []byte) [][]byte {
+	if !df.exploding {
+		return [][]byte{payload}
+	}
+	it := jsoniter.ParseBytes(jsoniter.ConfigDefault, payload)
+	if !findValue(it, df.explode) || it.WhatIsNext() != jsoniter.ArrayValue {
+		return [][]byte{payload}
+	}
+	var rows [][]byte
+	it.ReadArrayCB(func(it *jsoniter.Iterator) bool {
+		rows = append(rows, it.SkipAndReturnBytes())
+		return it.Error == nil
+	})
+	if it.Error != nil {
+		return [][]byte{payload}
+	}
+	return rows
+}
+
+// timestamp returns the timestamp of a row: the one in its payload if the
+// options select one, or the receive time. Rows without a valid timestamp in
+// the payload are counted in invalid.
+func (df *framer) timestamp(received time.Time, payload []byte, invalid *int) time.Time {
+	if df.timestamps == nil {
+		return received
+	}
+	if t, ok := df.timestamps.parse(payload); ok {
+		return t
+	}
+	*invalid++
+	return received
+}
+
+// appendRow completes the row of a message with its time and topic, and
+// null values for the fields it has no value for.
+func (df *framer) appendRow(t time.Time, topic string) {
+	df.fields[0].Append(t)
+	if df.topicField > 0 {
+		df.fields[df.topicField].Append(topic)
+	}
+	df.extendFields(df.fields[0].Len() - 1)
 }
 
 func (df *framer) extendFields(idx int) {
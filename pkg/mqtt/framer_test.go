@@ -79,9 +79,173 @@ func Test_framer(t *testing.T) {
 	})
 }
 
+func Test_framer_topicMode(t *testing.T) {
+	messages := []Message{
+		{Topic: "plant/a/temperature", Value: toJSON(map[string]any{"value": 1})},
+		{Topic: "plant/b/temperature", Value: toJSON(map[string]any{"value": 2})},
+		{Topic: "plant/a/temperature", Value: toJSON(map[string]any{"value": 3, "unit": "C"})},
+	}
+
+	t.Run("field", func(t *testing.T) {
+		runTopicTest(t, "topic-field", TopicModeField, messages...)
+	})
+
+	t.Run("label", func(t *testing.T) {
+		runTopicTest(t, "topic-label", TopicModeLabel, messages...)
+	})
+
+	t.Run("frame", func(t *testing.T) {
+		// Streamed frames carry the topic field, the frontend splits them.
+		runTopicTest(t, "topic-field", TopicModeFrame, messages...)
+	})
+
+	t.Run("payload field named like the topic field", func(t *testing.T) {
+		runTopicTest(t, "topic-field-conflict", TopicModeField,
+			Message{Topic: "plant/a/temperature", Value: toJSON(map[string]any{"Topic": "a"})},
+		)
+	})
+}
+
+func Test_framer_placeholders(t *testing.T) {
+	pattern, err := parseTopicPattern("site/{site}/dev/{device}/telemetry")
+	require.NoError(t, err)
+
+	messages := []Message{
+		{Topic: "site/berlin/dev/1/telemetry", Value: toJSON(map[string]any{"power": 1})},
+		{Topic: "site/berlin/dev/2/telemetry", Value: toJSON(map[string]any{"power": 2})},
+		{Topic: "site/paris/dev/1/telemetry", Value: toJSON(map[string]any{"power": 3})},
+		{Topic: "site/berlin/dev/1/telemetry", Value: toJSON(map[string]any{"power": 4})},
+	}
+	for i := range messages {
+		messages[i].Timestamp = time.Unix(0, 0).Add(time.Duration(i) * time.Minute)
+	}
+
+	t.Run("labels", func(t *testing.T) {
+		f := newFramer(FrameOptions{}, pattern)
+		frame, err := f.toFrame(messages, log.DefaultLogger)
+		require.NoError(t, err)
+		experimental.CheckGoldenJSONFrame(t, "testdata", "placeholders", frame, update)
+	})
+
+	t.Run("labels with the topic label", func(t *testing.T) {
+		f := newFramer(FrameOptions{TopicMode: TopicModeLabel}, pattern)
+		frame, err := f.toFrame(messages, log.DefaultLogger)
+		require.NoError(t, err)
+		experimental.CheckGoldenJSONFrame(t, "testdata", "placeholders-topic-label", frame, update)
+	})
+}
+
+func Test_framer_flatten(t *testing.T) {
+	telemetry := map[string]any{
+		"device": "a",
+		"sensor": map[string]any{
+			"temperature": 21.5,
+			"location":    map[string]any{"room": "kitchen", "floor": 1},
+		},
+		"readings": []any{1, map[string]any{"value": 2}},
+	}
+
+	t.Run("all levels", func(t *testing.T) {
+		runOptionsTest(t, "flatten", FrameOptions{Flatten: true}, Message{Value: toJSON(telemetry)})
+	})
+
+	t.Run("separator and max depth", func(t *testing.T) {
+		runOptionsTest(t, "flatten-depth", FrameOptions{Flatten: true, Separator: "_", MaxDepth: 2}, Message{Value: toJSON(telemetry)})
+	})
+
+	t.Run("array indexes", func(t *testing.T) {
+		runOptionsTest(t, "flatten-array-index", FrameOptions{Flatten: true, Arrays: ArrayModeIndex},
+			Message{Value: toJSON(telemetry)},
+			Message{Value: toJSON([]any{1, 2})},
+		)
+	})
+
+	t.Run("keys joined by the separator do not collide", func(t *testing.T) {
+		f := newFramer(FrameOptions{Flatten: true}, topicPattern{})
+		frame, err := f.toFrame([]Message{
+			{Value: toJSON(map[string]any{"a": map[string]any{"bc": 1}})},
+			{Value: toJSON(map[string]any{"ab": map[string]any{"c": 2}})},
+		}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 3)
+		require.Equal(t, "a.bc", frame.Fields[1].Name)
+		require.Equal(t, "ab.c", frame.Fields[2].Name)
+	})
+
+	t.Run("colliding keys keep the first value", func(t *testing.T) {
+		f := newFramer(FrameOptions{Flatten: true}, topicPattern{})
+		frame, err := f.toFrame([]Message{
+			{Value: []byte(`{"a.b":1,"a":{"b":2}}`)},
+			{Value: []byte(`{"a":{"b":3},"c":4}`)},
+		}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 3)
+		for _, field := range frame.Fields {
+			require.Equal(t, 2, field.Len(), field.Name)
+		}
+		require.Equal(t, "a.b", frame.Fields[1].Name)
+		require.Equal(t, int64(1), *frame.Fields[1].At(0).(*int64))
+		require.Equal(t, int64(3), *frame.Fields[1].At(1).(*int64))
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Equal(t, "1 value was left out because its row already has a value for its field: a.b", frame.Meta.Notices[0].Text)
+	})
+
+	t.Run("empty keys", func(t *testing.T) {
+		f := newFramer(FrameOptions{}, topicPattern{})
+		frame, err := f.toFrame([]Message{{Value: []byte(`{"":1,"b":2}`)}}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 3)
+		require.Equal(t, "b", frame.Fields[2].Name)
+	})
+}
+
+func Test_framer_explode(t *testing.T) {
+	t.Run("payload arrays", func(t *testing.T) {
+		runOptionsTest(t, "explode", FrameOptions{Explode: "$", TimeField: "ts", TimeFormat: TimeFormatUnixMs},
+			Message{Value: []byte(`[{"ts":1000,"v":1},{"ts":2000,"v":2}]`)},
+			Message{Value: []byte(`[{"ts":3000,"v":3}]`)},
+			// An empty batch has no rows.
+			Message{Value: []byte(`[]`)},
+		)
+	})
+
+	t.Run("arrays in the payload", func(t *testing.T) {
+		runOptionsTest(t, "explode-path", FrameOptions{
+			Explode:   "$.samples",
+			TimeField: "t",
+			Fields:    []FieldSelector{{Path: "v", Alias: "value"}},
+		},
+			Message{Value: []byte(`{"device":"a","samples":[{"t":"2024-03-01T12:00:00Z","v":1},{"t":"2024-03-01T12:00:01Z","v":2}]}`)},
+			// Payloads without the array are a single row.
+			Message{Value: []byte(`{"device":"a","v":3}`)},
+		)
+	})
+
+	t.Run("arrays of values", func(t *testing.T) {
+		f := newFramer(FrameOptions{Explode: "$"}, topicPattern{})
+		frame, err := f.toFrame([]Message{{Value: []byte(`[1,2,3]`)}}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 3, frame.Rows())
+		require.Equal(t, "Value", frame.Fields[1].Name)
+		require.Equal(t, int64(3), *frame.Fields[1].At(2).(*int64))
+	})
+}
+
+func TestFrameOptions_Validate(t *testing.T) {
+	require.NoError(t, FrameOptions{}.Validate())
+	require.NoError(t, FrameOptions{TopicMode: TopicModeLabel}.Validate())
+	require.NoError(t, FrameOptions{Flatten: true, MaxDepth: 2, Arrays: ArrayModeIndex}.Validate())
+	require.Error(t, FrameOptions{TopicMode: "columns"}.Validate())
+	require.Error(t, FrameOptions{MaxDepth: -1}.Validate())
+	require.Error(t, FrameOptions{Arrays: "rows"}.Validate())
+	require.NoError(t, FrameOptions{Explode: "$"}.Validate())
+	require.NoError(t, FrameOptions{Explode: "$.samples"}.Validate())
+	require.Error(t, FrameOptions{Explode: "$.samples[*]"}.Validate())
+}
+
 func runTest(t *testing.T, name string, values ...any) {
 	t.Helper()
-	f := newFramer()
+	f := newFramer(FrameOptions{}, topicPattern{})
 	timestamp := time.Unix(0, 0)
 	messages := []Message{}
 	for i, v := range values {
@@ -95,7 +259,7 @@ func runTest(t *testing.T, name string, values ...any) {
 
 func runRawTest(t *testing.T, name string, rawValues ...[]byte) {
 	t.Helper()
-	f := newFramer()
+	f := newFramer(FrameOptions{}, topicPattern{})
 	timestamp := time.Unix(0, 0)
 	messages := []Message{}
 	for i, v := range rawValues {
@@ -107,6 +271,24 @@ func runRawTest(t *testing.T, name string, rawValues ...[]byte) {
 	experimental.CheckGoldenJSONFrame(t, "testdata", name, frame, update)
 }
 
+func runTopicTest(t *testing.T, name string, mode TopicMode, messages ...Message) {
+	t.Helper()
+	runOptionsTest(t, name, FrameOptions{TopicMode: mode}, messages...)
+}
+
+func runOptionsTest(t *testing.T, name string, options FrameOptions, messages ...Message) {
+	t.Helper()
+	f := newFramer(options, topicPattern{})
+	timestamp := time.Unix(0, 0)
+	for i := range messages {
+		messages[i].Timestamp = timestamp.Add(time.Duration(i) * time.Minute)
+	}
+	frame, err := f.toFrame(messages, log.DefaultLogger)
+	require.NoError(t, err)
+	require.NotNil(t, frame)
+	experimental.CheckGoldenJSONFrame(t, "testdata", name, frame, update)
+}
+
 func toJSON(v interface{}) []byte {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// HistoryStorage decides where the history of the topics is kept.
+type HistoryStorage string
+
+const (
+	// HistoryMemory keeps the history in memory. It is lost on restarts.
+	HistoryMemory HistoryStorage = "memory"
+	// HistoryDisk keeps the history in segment files on disk, so it
+	// survives restarts.
+	HistoryDisk HistoryStorage = "disk"
+)
+
+func (s HistoryStorage) validate() error {
+	switch s {
+	case "", HistoryMemory, HistoryDisk:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid history storage %q: must be %q or %q", s, HistoryMemory, HistoryDisk)
+	}
+}
+
+// History keeps the recent messages of a topic filter, so streams can start
+// with the messages received before they subscribed.
+type History interface {
+	// Add appends a message. Messages are added in the order they were
+	// received.
+	Add(Message)
+	// Range returns the messages received between from and to, oldest
+	// first.
+	Range(from, to time.Time) ([]Message, error)
+	// Close releases the storage of the history. The messages of a history
+	// on disk are kept for the next one opened on the same directory.
+	Close() error
+}
+
+// memoryHistory is a History kept in memory. It holds the messages received
+// within the last duration, up to size messages.
+type memoryHistory struct {
+	mu       sync.Mutex
+	messages []Message // messages[start:] are the kept messages
+	start    int
+	duration time.Duration
+	size     int
+	now      func() time.Time
+}
+
+func newMemoryHistory(duration time.Duration, size int) *memoryHistory {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &memoryHistory{
+		duration: duration,
+		size:     size,
+		now:      time.Now,
+	}
+}
+
+func (h *memoryHistory) Add(m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.messages = append(h.messages, m)
+	if len(h.messages)-h.start > h.size {
+		h.messages[h.start] = Message{}
+		h.start++
+	}
+	h.expire()
+}
+
+func (h *memoryHistory) Range(from, to time.Time) ([]Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.expire()
+	kept := h.messages[h.start:]
+	i := sort.Search(len(kept), func(i int) bool { return !kept[i].Timestamp.Before(from) })
+	j := sort.Search(len(kept), func(i int) bool { return kept[i].Timestamp.After(to) })
+	if i >= j {
+		return nil, nil
+	}
+	return append([]Message(nil), kept[i:j]...), nil
+}
+
+func (h *memoryHistory) Close() error {
+	return nil
+}
+
+// expire drops the messages older than the duration and compacts the storage
+// once most of it is unused.
+func (h *memoryHistory) expire() {
+	oldest := h.now().Add(-h.duration)
+	for h.start < len(h.messages) && h.messages[h.start].Timestamp.Before(oldest) {
+		h.messages[h.start] = Message{}
+		h.start++
+	}
+	if h.start > 0 && h.start >= len(h.messages)/2 {
+		n := copy(h.messages, h.messages[h.start:])
+		clear(h.messages[n:])
+		h.messages = h.messages[:n]
+		h.start = 0
+	}
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	newHistory := func(duration time.Duration, size int) *memoryHistory {
+		h := newMemoryHistory(duration, size)
+		h.now = func() time.Time { return now }
+		return h
+	}
+	add := func(h *memoryHistory, values ...string) {
+		for _, v := range values {
+			h.Add(Message{Timestamp: now, Value: []byte(v)})
+			now = now.Add(time.Second)
+		}
+	}
+
+	t.Run("returns the messages of the range", func(t *testing.T) {
+		now = start
+		h := newHistory(time.Hour, 100)
+		add(h, "1", "2", "3", "4")
+
+		messages, err := h.Range(start.Add(time.Second), start.Add(2*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, []string{"2", "3"}, bufferedValues(messages))
+
+		messages, err = h.Range(start.Add(10*time.Second), start.Add(20*time.Second))
+		require.NoError(t, err)
+		require.Empty(t, messages)
+	})
+
+	t.Run("keeps at most size messages", func(t *testing.T) {
+		now = start
+		h := newHistory(time.Hour, 2)
+		add(h, "1", "2", "3", "4")
+
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"3", "4"}, bufferedValues(messages))
+	})
+
+	t.Run("drops messages older than the duration", func(t *testing.T) {
+		now = start
+		h := newHistory(3*time.Second, 100)
+		add(h, "1", "2", "3", "4", "5")
+
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"3", "4", "5"}, bufferedValues(messages))
+
+		now = now.Add(time.Hour)
+		messages, err = h.Range(start, now)
+		require.NoError(t, err)
+		require.Empty(t, messages)
+	})
+
+	t.Run("compacts the storage", func(t *testing.T) {
+		now = start
+		h := newHistory(time.Hour, 10)
+		for i := 0; i < 1000; i++ {
+			add(h, "v")
+		}
+		require.LessOrEqual(t, len(h.messages), 20)
+	})
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"sort"
+	"sync"
+)
+
+// latestMessages keeps the latest message of every topic matched by a topic
+// filter, so queries can return the last known values without waiting for
+// the next message.
+type latestMessages struct {
+	mu       sync.Mutex
+	messages map[string]Message // by topic
+	capacity int
+	// changed is closed when the next message is added. It is only created
+	// when someone waits for messages.
+	changed chan struct{}
+}
+
+// newLatestMessages returns a cache holding the latest message of up to
+// capacity topics. A capacity of zero or less uses DefaultBufferSize.
+func newLatestMessages(capacity int) *latestMessages {
+	if capacity <= 0 {
+		capacity = DefaultBufferSize
+	}
+	return &latestMessages{
+		messages: make(map[string]Message),
+		capacity: capacity,
+	}
+}
+
+// add stores the message as the latest one of its topic. Messages of new
+// topics are ignored once the cache holds capacity topics.
+func (l *latestMessages) add(m Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.messages[m.Topic]; !ok && len(l.messages) >= l.capacity {
+		return
+	}
+	l.messages[m.Topic] = m
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// get returns the latest message of every topic, ordered by topic.
+func (l *latestMessages) get() []Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	messages := make([]Message, 0, len(l.messages))
+	for _, m := range l.messages {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+	return messages
+}
+
+// wait returns a channel that is closed when the next message is added.
+func (l *latestMessages) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
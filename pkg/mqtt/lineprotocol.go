@@ -0,0 +1,282 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// measurementLabel is the label holding the measurement of InfluxDB line
+// protocol fields, named like the measurement column of Flux.
+const measurementLabel = "_measurement"
+
+// influxLine is a line of InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+type influxLine struct {
+	// series is the measurement and tags as written, which identify the
+	// labels of the fields.
+	series      string
+	measurement string
+	tags        data.Labels
+	fields      []influxField
+	timestamp   string // empty without a timestamp
+}
+
+type influxField struct {
+	key       string
+	fieldType data.FieldType
+	value     interface{}
+}
+
+// parseLineProtocol parses the lines of a payload. Empty lines and comments
+// are skipped, invalid lines are counted.
+func parseLineProtocol(payload []byte) (lines []influxLine, invalid int) {
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		l, err := parseLine(strings.TrimLeft(line, " \t"))
+		if err != nil {
+			invalid++
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, invalid
+}
+
+var errInvalidLine = errors.New("invalid line protocol")
+
+func parseLine(line string) (influxLine, error) {
+	var l influxLine
+	s := lineScanner{line: line}
+
+	l.measurement = s.until(", ", ", ")
+	if l.measurement == "" {
+		return l, fmt.Errorf("%w: missing measurement", errInvalidLine)
+	}
+	for s.skip(',') {
+		key := s.until("=", ",= ")
+		if key == "" || !s.skip('=') {
+			return l, fmt.Errorf("%w: invalid tag", errInvalidLine)
+		}
+		value := s.until(", ", ",= ")
+		if value == "" {
+			return l, fmt.Errorf("%w: invalid tag %q", errInvalidLine, key)
+		}
+		if l.tags == nil {
+			l.tags = data.Labels{}
+		}
+		l.tags[key] = value
+	}
+	l.series = line[:s.pos]
+	if !s.spaces() {
+		return l, fmt.Errorf("%w: missing fields", errInvalidLine)
+	}
+
+	for {
+		key := s.until("=", ",= ")
+		if key == "" || !s.skip('=') {
+			return l, fmt.Errorf("%w: invalid field", errInvalidLine)
+		}
+		fieldType, value, err := s.fieldValue()
+		if err != nil {
+			return l, fmt.Errorf("%w: field %q: %w", errInvalidLine, key, err)
+		}
+		l.addField(influxField{key: key, fieldType: fieldType, value: value})
+		if !s.skip(',') {
+			break
+		}
+	}
+
+	if s.spaces() {
+		l.timestamp = s.rest()
+		if _, err := strconv.ParseInt(l.timestamp, 10, 64); err != nil && l.timestamp != "" {
+			return l, fmt.Errorf("%w: invalid timestamp %q", errInvalidLine, l.timestamp)
+		}
+	}
+	if !s.done() {
+		return l, fmt.Errorf("%w: unexpected %q", errInvalidLine, s.rest())
+	}
+	return l, nil
+}
+
+// addField adds a field to the line. Like InfluxDB, the last value of a
+// repeated field key wins.
+func (l *influxLine) addField(f influxField) {
+	for i := range l.fields {
+		if l.fields[i].key == f.key {
+			l.fields[i] = f
+			return
+		}
+	}
+	l.fields = append(l.fields, f)
+}
+
+// lineScanner reads the elements of a line.
+type lineScanner struct {
+	line string
+	pos  int
+}
+
+// done reports whether the whole line was read.
+func (s *lineScanner) done() bool {
+	return s.pos == len(s.line)
+}
+
+// rest reads the rest of the line, without trailing spaces.
+func (s *lineScanner) rest() string {
+	r := strings.TrimRight(s.line[s.pos:], " \t")
+	s.pos = len(s.line)
+	return r
+}
+
+// skip consumes c if it is next.
+func (s *lineScanner) skip(c byte) bool {
+	if s.pos < len(s.line) && s.line[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// spaces consumes the spaces separating the elements of a line, and reports
+// whether there were any.
+func (s *lineScanner) spaces() bool {
+	start := s.pos
+	for s.pos < len(s.line) && s.line[s.pos] == ' ' {
+		s.pos++
+	}
+	return s.pos > start
+}
+
+// until reads up to the next unescaped byte of stops. A backslash escapes
+// the bytes of escapes, other backslashes are kept.
+func (s *lineScanner) until(stops, escapes string) string {
+	var b strings.Builder
+	for s.pos < len(s.line) {
+		c := s.line[s.pos]
+		if c == '\\' && s.pos+1 < len(s.line) && strings.IndexByte(escapes, s.line[s.pos+1]) >= 0 {
+			b.WriteByte(s.line[s.pos+1])
+			s.pos += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+		s.pos++
+	}
+	return b.String()
+}
+
+// fieldValue reads a field value: a float such as 1.5 or 1, an integer such
+// as 1i, an unsigned integer such as 1u, a boolean or a quoted string.
+func (s *lineScanner) fieldValue() (data.FieldType, interface{}, error) {
+	if s.skip('"') {
+		var b strings.Builder
+		for s.pos < len(s.line) {
+			c := s.line[s.pos]
+			switch {
+			case c == '\\' && s.pos+1 < len(s.line) && (s.line[s.pos+1] == '"' || s.line[s.pos+1] == '\\'):
+				b.WriteByte(s.line[s.pos+1])
+				s.pos += 2
+			case c == '"':
+				s.pos++
+				v := b.String()
+				return data.FieldTypeNullableString, &v, nil
+			default:
+				b.WriteByte(c)
+				s.pos++
+			}
+		}
+		return data.FieldTypeUnknown, nil, errors.New("unterminated string")
+	}
+
+	raw := s.until(", ", "")
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		v := true
+		return data.FieldTypeNullableBool, &v, nil
+	case "f", "F", "false", "False", "FALSE":
+		v := false
+		return data.FieldTypeNullableBool, &v, nil
+	}
+	switch {
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return data.FieldTypeNullableInt64, &v, err
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return data.FieldTypeNullableUint64, &v, err
+	default:
+		v, err := strconv.ParseFloat(raw, 64)
+		return data.FieldTypeNullableFloat64, &v, err
+	}
+}
+
+// addLines adds a row per line of an InfluxDB line protocol message, with a
+// field per field key labeled with the measurement and tags of the line.
+// Lines without a timestamp use the receive time. It returns the number of
+// invalid lines, which are left out.
+func (df *framer) addLines(message Message) int {
+	lines, invalid := parseLineProtocol(message.Value)
+	timestamps := timestampParser{format: df.options.TimeFormat}
+	for _, line := range lines {
+		at := message.Timestamp
+		if line.timestamp != "" {
+			t, ok := timestamps.parseNumber(json.Number(line.timestamp))
+			if !ok {
+				invalid++
+				continue
+			}
+			at = t
+		}
+
+		df.setTopic(message.Topic)
+		df.setSeries(message.Topic, line)
+		for _, f := range line.fields {
+			df.path = append(df.path[:0], f.key)
+			fieldType, v := f.fieldType, f.value
+			if df.options.ForceFloat && isNumberType(fieldType) {
+				fieldType, v = data.FieldTypeNullableFloat64, convertNumber(v, data.FieldTypeNullableFloat64)
+			}
+			df.addValue(fieldType, v)
+		}
+		df.appendRow(at, message.Topic)
+	}
+	return invalid
+}
+
+// setSeries adds the measurement and tags of a line to the labels of its
+// topic. Tags named like a label of the topic replace it.
+func (df *framer) setSeries(topic string, line influxLine) {
+	key := topic + "\x00" + line.series
+	ml, ok := df.seriesLabels[key]
+	if !ok {
+		labels := data.Labels{measurementLabel: line.measurement}
+		for k, v := range df.labels {
+			labels[k] = v
+		}
+		for k, v := range line.tags {
+			labels[k] = v
+		}
+		ml = messageLabels{labels: labels, key: "\x00" + labels.String()}
+		df.seriesLabels[key] = ml
+	}
+	df.labels = ml.labels
+	df.labelsKey = ml.key
+}
+
+// lineTimeFormat reports whether line protocol timestamps can have the
+// format: they are Unix times of a precision, guessed from their magnitude
+// by default.
+func lineTimeFormat(f TimeFormat) bool {
+	return f == TimeFormatAuto || f.unitNanos() != 0
+}
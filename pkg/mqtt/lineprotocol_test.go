@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	l, err := parseLine(`weather\ station,site=north\,1,room\=a=hall\ 2 temp=21.5,count=3i,total=18446744073709551615u,ok=t,note="say \"hi\" \\o/",temp=22 1700000000000000000`)
+	require.NoError(t, err)
+	require.Equal(t, "weather station", l.measurement)
+	require.Equal(t, data.Labels{"site": "north,1", "room=a": "hall 2"}, l.tags)
+	require.Equal(t, `weather\ station,site=north\,1,room\=a=hall\ 2`, l.series)
+	require.Equal(t, "1700000000000000000", l.timestamp)
+	require.Equal(t, []influxField{
+		{key: "temp", fieldType: data.FieldTypeNullableFloat64, value: ptr(22.0)},
+		{key: "count", fieldType: data.FieldTypeNullableInt64, value: ptr(int64(3))},
+		{key: "total", fieldType: data.FieldTypeNullableUint64, value: ptr(uint64(18446744073709551615))},
+		{key: "ok", fieldType: data.FieldTypeNullableBool, value: ptr(true)},
+		{key: "note", fieldType: data.FieldTypeNullableString, value: ptr(`say "hi" \o/`)},
+	}, l.fields)
+
+	l, err = parseLine("cpu usage=1")
+	require.NoError(t, err)
+	require.Empty(t, l.timestamp)
+	require.Nil(t, l.tags)
+
+	for _, line := range []string{
+		"cpu",
+		"cpu,host usage=1",
+		"cpu,host= usage=1",
+		"cpu usage=",
+		"cpu usage=abc",
+		"cpu usage=1x",
+		`cpu note="open`,
+		"cpu usage=1 now",
+		"cpu usage=1 1 2",
+		",host=a usage=1",
+	} {
+		_, err := parseLine(line)
+		require.ErrorIs(t, err, errInvalidLine, line)
+	}
+}
+
+func Test_framer_lineProtocol(t *testing.T) {
+	f := newFramer(FrameOptions{Format: PayloadFormatLineProtocol, TopicMode: TopicModeField}, topicPattern{})
+	frame, err := f.toFrame([]Message{
+		{Timestamp: time.Unix(0, 0), Topic: "telegraf/host1", Value: []byte(
+			"cpu,host=server01,region=us-west usage_idle=98.5,usage_user=1.2 1700000000000000000\n" +
+				"cpu,host=server02,region=us-west usage_idle=97,usage_user=2.5 1700000000000000000\r\n" +
+				"# memory\n" +
+				"\n" +
+				`mem,host=server01 used=1024i,free=2048u,swap=false,status="ok" 1700000000000000000`,
+		)},
+		{Timestamp: time.Unix(60, 0), Topic: "telegraf/host1", Value: []byte(
+			"cpu,host=server01,region=us-west usage_idle=97.5 1700000060\n" +
+				"cpu usage_idle=\n" +
+				"cpu,host=server01,region=us-west usage_idle=96.5",
+		)},
+	}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Equal(t, "1 lines were left out because they are not valid InfluxDB line protocol", frame.Meta.Notices[0].Text)
+	experimental.CheckGoldenJSONFrame(t, "testdata", "line-protocol", frame, update)
+}
+
+func Test_framer_lineProtocolPrecision(t *testing.T) {
+	f := newFramer(FrameOptions{Format: PayloadFormatLineProtocol, TimeFormat: TimeFormatUnixMs, ForceFloat: true}, topicPattern{})
+	frame, err := f.toFrame([]Message{{Value: []byte("cpu count=5i 1700000000000")}}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, time.UnixMilli(1700000000000), frame.Fields[0].At(0))
+	require.Equal(t, 5.0, *frame.Fields[1].At(0).(*float64))
+	require.Equal(t, data.Labels{measurementLabel: "cpu"}, frame.Fields[1].Labels)
+}
+
+func TestFrameOptions_ValidateLineProtocol(t *testing.T) {
+	require.NoError(t, FrameOptions{Format: PayloadFormatLineProtocol, TimeFormat: TimeFormatUnixNs}.Validate())
+	require.ErrorContains(t, FrameOptions{Format: PayloadFormatLineProtocol, TimeFormat: TimeFormatRFC3339}.Validate(), "are Unix times")
+	require.ErrorContains(t, FrameOptions{Format: PayloadFormatLineProtocol, TimeField: "$.time"}.Validate(), "InfluxDB line protocol payloads cannot")
+}
@@ -0,0 +1,247 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// TypeMismatchPolicy decides what happens to a value whose type differs from
+// the type of its field, such as a "NaN" string sent by a sensor in between
+// numbers.
+type TypeMismatchPolicy string
+
+const (
+	// TypeMismatchNull leaves the value null and reports the number of such
+	// values in a frame notice. It is the default.
+	TypeMismatchNull TypeMismatchPolicy = "null"
+	// TypeMismatchCoerce converts the value to the type of the field, such
+	// as "12.5" to 12.5. Values that cannot be converted are null.
+	TypeMismatchCoerce TypeMismatchPolicy = "coerce"
+	// TypeMismatchString turns the field into a string field holding all
+	// its values.
+	TypeMismatchString TypeMismatchPolicy = "string"
+	// TypeMismatchSplit moves the value into a field of its own, named after
+	// the field and the type of the value, such as "temperature_string".
+	TypeMismatchSplit TypeMismatchPolicy = "split"
+)
+
+func (p TypeMismatchPolicy) validate() error {
+	switch p {
+	case "", TypeMismatchNull, TypeMismatchCoerce, TypeMismatchString, TypeMismatchSplit:
+		return nil
+	default:
+		return backend.DownstreamErrorf("invalid type mismatch policy %q: must be %q, %q, %q or %q", p, TypeMismatchNull, TypeMismatchCoerce, TypeMismatchString, TypeMismatchSplit)
+	}
+}
+
+// addMismatch adds a value whose type differs from the type of the field at
+// idx according to the type mismatch policy.
+func (df *framer) addMismatch(idx int, fieldType data.FieldType, v interface{}) {
+	field := df.fields[idx]
+	switch df.options.TypeMismatch {
+	case TypeMismatchCoerce:
+		if c, ok := coerce(v, field.Type()); ok {
+			if isNumberType(field.Type()) {
+				df.appendNumber(idx, c)
+				return
+			}
+			field.Append(c)
+			return
+		}
+	case TypeMismatchString:
+		if field.Type() != data.FieldTypeNullableString {
+			field = widenToString(field)
+			df.fields[idx] = field
+		}
+		s, _ := coerce(v, data.FieldTypeNullableString)
+		field.Append(s)
+		return
+	case TypeMismatchSplit:
+		suffix := typeSuffix(fieldType)
+		key := df.fieldKey() + "\x00" + suffix
+		if idx, ok := df.fieldMap[key]; ok {
+			if df.filled(idx) {
+				df.duplicates[df.fields[idx].Name]++
+				return
+			}
+			// Numbers of all types share the split field, which widens.
+			if isNumberType(fieldType) {
+				df.appendNumber(idx, v)
+				return
+			}
+			df.fields[idx].Append(v)
+			return
+		}
+		df.newField(df.key()+"_"+suffix, key, fieldType, v)
+		return
+	}
+
+	df.mismatches[field.Name]++
+}
+
+// mismatchNotice returns the notice reporting the values left null because
+// their type did not match the type of their field.
+func (df *framer) mismatchNotice() (data.Notice, bool) {
+	if len(df.mismatches) == 0 {
+		return data.Notice{}, false
+	}
+	count := 0
+	names := make([]string, 0, len(df.mismatches))
+	for name, n := range df.mismatches {
+		count += n
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("%d values are null because their type did not match the type of their field: %s", count, strings.Join(names, ", "))
+	if count == 1 {
+		text = "1 value is null because its type did not match the type of its field: " + names[0]
+	}
+	return data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     text,
+	}, true
+}
+
+// typeSuffix names the type of the values of split fields.
+func typeSuffix(fieldType data.FieldType) string {
+	switch fieldType {
+	case data.FieldTypeNullableInt64, data.FieldTypeNullableUint64, data.FieldTypeNullableFloat64:
+		return "number"
+	case data.FieldTypeNullableBool:
+		return "bool"
+	case data.FieldTypeJSON:
+		return "json"
+	default:
+		return "string"
+	}
+}
+
+// widenToString returns a string field with the values of the field.
+func widenToString(field *data.Field) *data.Field {
+	widened := data.NewFieldFromFieldType(data.FieldTypeNullableString, field.Len())
+	widened.Name = field.Name
+	widened.Labels = field.Labels
+	widened.Config = field.Config
+	for i := 0; i < field.Len(); i++ {
+		if s, ok := coerce(field.At(i), data.FieldTypeNullableString); ok {
+			widened.Set(i, s)
+		}
+	}
+	return widened
+}
+
+// coerce converts a value read from a payload to the type of a field. Values
+// converted to numbers keep the type they are written in, so integer strings
+// are integers: they are appended with appendNumber. It reports false for
+// null values and values that cannot be converted.
+func coerce(v interface{}, to data.FieldType) (interface{}, bool) {
+	if isNumberType(to) {
+		switch v := v.(type) {
+		case *string:
+			if v == nil {
+				return nil, false
+			}
+			n, err := parseNumber(strings.TrimSpace(*v))
+			return n, err == nil
+		case *bool:
+			if v == nil {
+				return nil, false
+			}
+			var n int64
+			if *v {
+				n = 1
+			}
+			return &n, true
+		default:
+			return nil, false
+		}
+	}
+
+	switch to {
+	case data.FieldTypeNullableBool:
+		var b bool
+		switch v := v.(type) {
+		case *string:
+			if v == nil {
+				return nil, false
+			}
+			parsed, err := strconv.ParseBool(strings.TrimSpace(*v))
+			if err != nil {
+				return nil, false
+			}
+			b = parsed
+		case *int64, *uint64, *float64:
+			f, ok := convertNumber(v, data.FieldTypeNullableFloat64).(*float64)
+			if !ok {
+				return nil, false
+			}
+			b = *f != 0
+		default:
+			return nil, false
+		}
+		return &b, true
+	case data.FieldTypeNullableString:
+		var s string
+		switch v := v.(type) {
+		case *string:
+			if v == nil {
+				return nil, false
+			}
+			s = *v
+		case *int64, *uint64, *float64:
+			formatted, ok := formatNumber(v)
+			if !ok {
+				return nil, false
+			}
+			s = formatted
+		case *bool:
+			if v == nil {
+				return nil, false
+			}
+			s = strconv.FormatBool(*v)
+		case json.RawMessage:
+			if v == nil {
+				return nil, false
+			}
+			s = string(v)
+		default:
+			return nil, false
+		}
+		return &s, true
+	case data.FieldTypeJSON:
+		var value interface{}
+		switch v := v.(type) {
+		case *string:
+			if v == nil {
+				return nil, false
+			}
+			value = *v
+		case *int64, *uint64, *float64:
+			formatted, ok := formatNumber(v)
+			if !ok {
+				return nil, false
+			}
+			value = json.Number(formatted)
+		case *bool:
+			if v == nil {
+				return nil, false
+			}
+			value = *v
+		default:
+			return nil, false
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, false
+		}
+		return json.RawMessage(b), true
+	default:
+		return nil, false
+	}
+}
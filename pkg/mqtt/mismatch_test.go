@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_framer_typeMismatch(t *testing.T) {
+	messages := func() []Message {
+		return []Message{
+			{Value: []byte(`{"temperature":21.5,"online":true}`)},
+			{Value: []byte(`{"temperature":"NaN","online":"yes"}`)},
+			{Value: []byte(`{"temperature":"22.5","online":1}`)},
+		}
+	}
+
+	for _, policy := range []TypeMismatchPolicy{TypeMismatchNull, TypeMismatchCoerce, TypeMismatchString, TypeMismatchSplit} {
+		t.Run(string(policy), func(t *testing.T) {
+			runOptionsTest(t, "type-mismatch-"+string(policy), FrameOptions{TypeMismatch: policy}, messages()...)
+		})
+	}
+}
+
+func Test_framer_typeMismatchSplitNumbers(t *testing.T) {
+	for name, values := range map[string][]string{
+		"int then float": {`{"a":"x"}`, `{"a":5}`, `{"a":5.5}`},
+		"float then int": {`{"a":"x"}`, `{"a":5.5}`, `{"a":5}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newFramer(FrameOptions{TypeMismatch: TypeMismatchSplit}, topicPattern{})
+			var messages []Message
+			for _, v := range values {
+				messages = append(messages, Message{Value: []byte(v)})
+			}
+			frame, err := f.toFrame(messages, log.DefaultLogger)
+			require.NoError(t, err)
+			require.Len(t, frame.Fields, 3)
+			split := frame.Fields[2]
+			require.Equal(t, "a_number", split.Name)
+			require.Equal(t, data.FieldTypeNullableFloat64, split.Type())
+			require.Equal(t, 3, split.Len())
+		})
+	}
+}
+
+func TestCoerce(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(f float64) *float64 { return &f }
+	integer := func(i int64) *int64 { return &i }
+	boolean := func(b bool) *bool { return &b }
+
+	tests := []struct {
+		name string
+		v    interface{}
+		to   data.FieldType
+		want interface{}
+		ok   bool
+	}{
+		{"numeric string to number", str(" 12.5 "), data.FieldTypeNullableFloat64, num(12.5), true},
+		{"integer string to number", str("12"), data.FieldTypeNullableFloat64, integer(12), true},
+		{"bool to number", boolean(true), data.FieldTypeNullableInt64, integer(1), true},
+		{"text to number", str("NaN?"), data.FieldTypeNullableFloat64, nil, false},
+		{"string to bool", str("false"), data.FieldTypeNullableBool, boolean(false), true},
+		{"number to bool", num(2), data.FieldTypeNullableBool, boolean(true), true},
+		{"text to bool", str("yes"), data.FieldTypeNullableBool, nil, false},
+		{"number to string", num(0.1), data.FieldTypeNullableString, str("0.1"), true},
+		{"integer to string", integer(-7), data.FieldTypeNullableString, str("-7"), true},
+		{"bool to string", boolean(true), data.FieldTypeNullableString, str("true"), true},
+		{"json to string", json.RawMessage(`{"a":1}`), data.FieldTypeNullableString, str(`{"a":1}`), true},
+		{"null to string", (*float64)(nil), data.FieldTypeNullableString, nil, false},
+		{"number to json", num(3.5), data.FieldTypeJSON, json.RawMessage(`3.5`), true},
+		{"integer to json", integer(3), data.FieldTypeJSON, json.RawMessage(`3`), true},
+		{"json to number", json.RawMessage(`3`), data.FieldTypeNullableFloat64, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := coerce(tt.v, tt.to)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFrameOptions_ValidateTypeMismatch(t *testing.T) {
+	require.NoError(t, FrameOptions{TypeMismatch: TypeMismatchSplit}.Validate())
+	require.ErrorContains(t, FrameOptions{TypeMismatch: "drop"}.Validate(), "invalid type mismatch policy")
+}
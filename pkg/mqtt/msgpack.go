@@ -0,0 +1,275 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// msgpackTimestamp is the extension type of MessagePack timestamps.
+const msgpackTimestamp = -1
+
+// decodeMessagePack decodes a MessagePack payload into JSON, so it is framed
+// like JSON payloads. Map keys that are integers become strings, binary
+// values are base64 strings and timestamps are RFC 3339 strings. Other
+// extension types are base64 strings of their data.
+func decodeMessagePack(payload []byte) ([]byte, error) {
+	stream := jsoniter.ConfigDefault.BorrowStream(nil)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+	d := msgpackDecoder{b: payload, stream: stream}
+	if err := d.value(0); err != nil {
+		return nil, err
+	}
+	if len(d.b) > 0 {
+		return nil, errTrailingBytes
+	}
+	return append([]byte(nil), stream.Buffer()...), nil
+}
+
+type msgpackDecoder struct {
+	b      []byte
+	stream *jsoniter.Stream
+}
+
+// take consumes the next n bytes.
+func (d *msgpackDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+// uint consumes a big-endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n uint64) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	return readUint(b), nil
+}
+
+func (d *msgpackDecoder) value(depth int) error {
+	if depth > maxNesting {
+		return errTooDeep
+	}
+	if len(d.b) == 0 {
+		return errTruncated
+	}
+	c := d.b[0]
+	switch {
+	case c <= 0x7f, c >= 0xe0, c >= 0xcc && c <= 0xd3:
+		i, u, unsigned, err := d.integer()
+		if err != nil {
+			return err
+		}
+		if unsigned {
+			d.stream.WriteUint64(u)
+		} else {
+			d.stream.WriteInt64(i)
+		}
+	case c&0xe0 == 0xa0, c >= 0xd9 && c <= 0xdb, c >= 0xc4 && c <= 0xc6:
+		s, binary, err := d.str()
+		if err != nil {
+			return err
+		}
+		if binary {
+			d.stream.WriteString(base64.StdEncoding.EncodeToString(s))
+		} else {
+			d.stream.WriteString(string(s))
+		}
+	case c&0xf0 == 0x80, c&0xf0 == 0x90, c >= 0xdc && c <= 0xdf:
+		return d.collection(depth)
+	case c >= 0xd4 && c <= 0xd8, c >= 0xc7 && c <= 0xc9:
+		return d.ext()
+	default:
+		d.b = d.b[1:]
+		switch c {
+		case 0xc0:
+			d.stream.WriteNil()
+		case 0xc2:
+			d.stream.WriteFalse()
+		case 0xc3:
+			d.stream.WriteTrue()
+		case 0xca:
+			bits, err := d.uint(4)
+			if err != nil {
+				return err
+			}
+			writeFloat(d.stream, float64(math.Float32frombits(uint32(bits))), 32)
+		case 0xcb:
+			bits, err := d.uint(8)
+			if err != nil {
+				return err
+			}
+			writeFloat(d.stream, math.Float64frombits(bits), 64)
+		default:
+			return fmt.Errorf("invalid MessagePack format 0x%02x", c)
+		}
+	}
+	return nil
+}
+
+// integer consumes an integer. Unsigned integers are returned in u.
+func (d *msgpackDecoder) integer() (i int64, u uint64, unsigned bool, err error) {
+	c := d.b[0]
+	d.b = d.b[1:]
+	switch {
+	case c <= 0x7f:
+		return 0, uint64(c), true, nil
+	case c >= 0xe0:
+		return int64(int8(c)), 0, false, nil
+	case c <= 0xcf:
+		u, err = d.uint(1 << (c - 0xcc))
+		return 0, u, true, err
+	default:
+		n := uint64(1) << (c - 0xd0)
+		u, err = d.uint(n)
+		// Sign-extend the integer of n bytes.
+		shift := 64 - 8*n
+		return int64(u<<shift) >> shift, 0, false, err
+	}
+}
+
+// str consumes a string or a binary value.
+func (d *msgpackDecoder) str() (s []byte, binary bool, err error) {
+	c := d.b[0]
+	d.b = d.b[1:]
+	var n uint64
+	switch {
+	case c&0xe0 == 0xa0:
+		n = uint64(c & 0x1f)
+	case c >= 0xd9:
+		n, err = d.uint(1 << (c - 0xd9))
+	default:
+		n, err = d.uint(1 << (c - 0xc4))
+		binary = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s, err = d.take(n)
+	return s, binary, err
+}
+
+// collection consumes an array or a map. Every item takes a byte at least,
+// so the items of a crafted length run out with the payload.
+func (d *msgpackDecoder) collection(depth int) error {
+	c := d.b[0]
+	d.b = d.b[1:]
+	var (
+		n   uint64
+		err error
+	)
+	isMap := c&0xf0 == 0x80 || c >= 0xde
+	switch {
+	case c <= 0x9f:
+		n = uint64(c & 0x0f)
+	case c == 0xdc || c == 0xde:
+		n, err = d.uint(2)
+	default:
+		n, err = d.uint(4)
+	}
+	if err != nil {
+		return err
+	}
+
+	if isMap {
+		d.stream.WriteObjectStart()
+	} else {
+		d.stream.WriteArrayStart()
+	}
+	for i := uint64(0); i < n; i++ {
+		if i > 0 {
+			d.stream.WriteMore()
+		}
+		if isMap {
+			key, err := d.key()
+			if err != nil {
+				return err
+			}
+			d.stream.WriteObjectField(key)
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	if isMap {
+		d.stream.WriteObjectEnd()
+	} else {
+		d.stream.WriteArrayEnd()
+	}
+	return nil
+}
+
+// key consumes a map key: a string, or an integer formatted as a string.
+func (d *msgpackDecoder) key() (string, error) {
+	if len(d.b) == 0 {
+		return "", errTruncated
+	}
+	c := d.b[0]
+	switch {
+	case c <= 0x7f, c >= 0xe0, c >= 0xcc && c <= 0xd3:
+		i, u, unsigned, err := d.integer()
+		if unsigned {
+			return strconv.FormatUint(u, 10), err
+		}
+		return strconv.FormatInt(i, 10), err
+	case c&0xe0 == 0xa0, c >= 0xd9 && c <= 0xdb, c >= 0xc4 && c <= 0xc6:
+		s, binary, err := d.str()
+		if binary {
+			return base64.StdEncoding.EncodeToString(s), err
+		}
+		return string(s), err
+	default:
+		return "", fmt.Errorf("unsupported MessagePack map key format 0x%02x", c)
+	}
+}
+
+// ext consumes an extension value.
+func (d *msgpackDecoder) ext() error {
+	c := d.b[0]
+	d.b = d.b[1:]
+	var (
+		n   uint64
+		err error
+	)
+	if c >= 0xd4 {
+		n = 1 << (c - 0xd4)
+	} else {
+		n, err = d.uint(1 << (c - 0xc7))
+	}
+	if err != nil {
+		return err
+	}
+	typ, err := d.take(1)
+	if err != nil {
+		return err
+	}
+	b, err := d.take(n)
+	if err != nil {
+		return err
+	}
+
+	if int8(typ[0]) != msgpackTimestamp {
+		d.stream.WriteString(base64.StdEncoding.EncodeToString(b))
+		return nil
+	}
+	switch n {
+	case 4:
+		writeTimestamp(d.stream, time.Unix(int64(readUint(b)), 0))
+	case 8:
+		v := readUint(b)
+		writeTimestamp(d.stream, time.Unix(int64(v&(1<<34-1)), int64(v>>34)))
+	case 12:
+		writeTimestamp(d.stream, time.Unix(int64(readUint(b[4:])), int64(readUint(b[:4]))))
+	default:
+		return fmt.Errorf("invalid MessagePack timestamp of %d bytes", n)
+	}
+	return nil
+}
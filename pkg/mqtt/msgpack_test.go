@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMessagePack(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"sample", sampleMessagePack, `{"device":"dev-1","temperature":21.5,"count":3,"ok":true,"tags":["a","b"],"nested":{"level":-2}}`},
+		{"uint64", payloadOf(0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff), `18446744073709551615`},
+		{"int64", payloadOf(0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0), `-9223372036854775808`},
+		{"int8", payloadOf(0xd0, 0x80), `-128`},
+		{"int16", payloadOf(0xd1, 0xff, 0x38), `-200`},
+		{"float32", payloadOf(0xca, 0x3f, 0xc0, 0, 0), `1.5`},
+		{"whole float64", payloadOf(0xcb, 0x40, 0, 0, 0, 0, 0, 0, 0), `2.0`},
+		{"nil", payloadOf(0xc0), `null`},
+		{"str8", payloadOf(0xd9, 0x02, "on"), `"on"`},
+		{"bin8", payloadOf(0xc4, 0x03, 1, 2, 3), `"AQID"`},
+		{"array16", payloadOf(0xdc, 0x00, 0x02, 0x01, 0xc2), `[1,false]`},
+		{"integer key", payloadOf(0x81, 0x01, 0xc0), `{"1":null}`},
+		{"timestamp32", payloadOf(0xd6, 0xff, 0x5f, 0x5e, 0x10, 0x00), `"2020-09-13T12:26:40Z"`},
+		{"timestamp64", payloadOf(0xd7, 0xff, 0, 0, 0x07, 0xd0, 0x5f, 0x5e, 0x10, 0x00), `"2020-09-13T12:26:40.0000005Z"`},
+		{"timestamp96", payloadOf(0xc7, 12, 0xff, 0, 0, 0x01, 0xf4, 0, 0, 0, 0, 0x5f, 0x5e, 0x10, 0x00), `"2020-09-13T12:26:40.0000005Z"`},
+		{"extension", payloadOf(0xd4, 0x01, 0x05), `"BQ=="`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := decodeMessagePack(tc.payload)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, string(b))
+		})
+	}
+
+	for name, payload := range map[string][]byte{
+		"truncated":     payloadOf(0xa5, "o"),
+		"truncated map": payloadOf(0xdf, 0xff, 0xff, 0xff, 0xff),
+		"trailing":      payloadOf(0x01, 0x02),
+		"never used":    payloadOf(0xc1),
+		"nested":        append(bytes.Repeat([]byte{0x91}, maxNesting+1), 0x00),
+		"map key":       payloadOf(0x81, 0x90, 0x00),
+		"timestamp":     payloadOf(0xd5, 0xff, 0, 0),
+	} {
+		_, err := decodeMessagePack(payload)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// readNumber reads a JSON number as an integer if it is written as one and
+// fits 64 bits, so counters and IDs above 2^53 keep their precision, or as a
+// float.
+func (df *framer) readNumber(n string) error {
+	var v interface{}
+	if df.options.ForceFloat {
+		f, err := parseFloat(n)
+		if err != nil {
+			return err
+		}
+		v = &f
+	} else {
+		var err error
+		if v, err = parseNumber(n); err != nil {
+			return err
+		}
+	}
+	df.addValue(numberType(v), v)
+	return nil
+}
+
+// parseNumber parses an integer as an int64, or a uint64 if it exceeds the
+// int64 range, and other numbers as a float64.
+func parseNumber(s string) (interface{}, error) {
+	if !strings.ContainsAny(s, ".eEnN") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return &i, nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return &u, nil
+		}
+	}
+	f, err := parseFloat(s)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// parseFloat parses a float64. Numbers beyond its range are infinite.
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, err
+	}
+	return f, nil
+}
+
+// numberType returns the field type of a value returned by parseNumber.
+func numberType(v interface{}) data.FieldType {
+	switch v.(type) {
+	case *int64:
+		return data.FieldTypeNullableInt64
+	case *uint64:
+		return data.FieldTypeNullableUint64
+	default:
+		return data.FieldTypeNullableFloat64
+	}
+}
+
+func isNumberType(t data.FieldType) bool {
+	switch t {
+	case data.FieldTypeNullableInt64, data.FieldTypeNullableUint64, data.FieldTypeNullableFloat64:
+		return true
+	default:
+		return false
+	}
+}
+
+// appendNumber appends a number to the number field at idx. Numbers of
+// another type widen the field rather than being mismatches: a field of
+// integers receiving 5.5 becomes a float field, and stays one. Fields only
+// widen, so a field alternating between 5 and 5.5 keeps its type.
+func (df *framer) appendNumber(idx int, v interface{}) {
+	field := df.fields[idx]
+	if to := numberFieldType(field, v); to != field.Type() {
+		field = widenNumbers(field, to)
+		df.fields[idx] = field
+	}
+	field.Append(convertNumber(v, field.Type()))
+}
+
+// numberFieldType returns the type of a field holding the numbers of the
+// field and v: integers of both signs that fit an int64 or a uint64 stay
+// integers, other numbers are floats.
+func numberFieldType(field *data.Field, v interface{}) data.FieldType {
+	switch field.Type() {
+	case data.FieldTypeNullableInt64:
+		switch v.(type) {
+		case *int64:
+			return data.FieldTypeNullableInt64
+		case *uint64:
+			if fitsNumbers(field, data.FieldTypeNullableUint64) {
+				return data.FieldTypeNullableUint64
+			}
+		}
+	case data.FieldTypeNullableUint64:
+		switch v := v.(type) {
+		case *uint64:
+			return data.FieldTypeNullableUint64
+		case *int64:
+			if *v >= 0 {
+				return data.FieldTypeNullableUint64
+			}
+			if fitsNumbers(field, data.FieldTypeNullableInt64) {
+				return data.FieldTypeNullableInt64
+			}
+		}
+	}
+	return data.FieldTypeNullableFloat64
+}
+
+// fitsNumbers reports whether the integers of the field fit the other
+// integer type.
+func fitsNumbers(field *data.Field, to data.FieldType) bool {
+	for i := 0; i < field.Len(); i++ {
+		switch v := field.At(i).(type) {
+		case *int64:
+			if v != nil && *v < 0 && to == data.FieldTypeNullableUint64 {
+				return false
+			}
+		case *uint64:
+			if v != nil && *v > math.MaxInt64 && to == data.FieldTypeNullableInt64 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// widenNumbers returns a field of the given number type with the values of
+// the number field.
+func widenNumbers(field *data.Field, to data.FieldType) *data.Field {
+	widened := data.NewFieldFromFieldType(to, field.Len())
+	widened.Name = field.Name
+	widened.Labels = field.Labels
+	widened.Config = field.Config
+	for i := 0; i < field.Len(); i++ {
+		widened.Set(i, convertNumber(field.At(i), to))
+	}
+	return widened
+}
+
+// convertNumber converts a number to the given number type. Null values are
+// nil.
+func convertNumber(v interface{}, to data.FieldType) interface{} {
+	var (
+		i int64
+		u uint64
+		f float64
+	)
+	switch v := v.(type) {
+	case *int64:
+		if v == nil {
+			return nil
+		}
+		i, u, f = *v, uint64(*v), float64(*v)
+	case *uint64:
+		if v == nil {
+			return nil
+		}
+		i, u, f = int64(*v), *v, float64(*v)
+	case *float64:
+		if v == nil {
+			return nil
+		}
+		i, u, f = int64(*v), uint64(*v), *v
+	default:
+		return nil
+	}
+	switch to {
+	case data.FieldTypeNullableInt64:
+		return &i
+	case data.FieldTypeNullableUint64:
+		return &u
+	default:
+		return &f
+	}
+}
+
+// writeFloat writes a float of the given bit size to a JSON stream of a
+// decoded payload. It keeps a fraction or an exponent, so whole floats are
+// read as floats rather than integers. JSON has no NaN and infinities, so
+// they are strings.
+func writeFloat(stream *jsoniter.Stream, f float64, bitSize int) {
+	switch {
+	case math.IsNaN(f):
+		stream.WriteString("NaN")
+	case math.IsInf(f, 1):
+		stream.WriteString("Infinity")
+	case math.IsInf(f, -1):
+		stream.WriteString("-Infinity")
+	default:
+		format := byte('f')
+		if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+			format = 'e'
+		}
+		b := strconv.AppendFloat(nil, f, format, -1, bitSize)
+		if format == 'f' && !strings.Contains(string(b), ".") {
+			b = append(b, ".0"...)
+		}
+		stream.WriteRaw(string(b))
+	}
+}
+
+// formatNumber formats a number, or reports false for null values.
+func formatNumber(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case *int64:
+		if v != nil {
+			return strconv.FormatInt(*v, 10), true
+		}
+	case *uint64:
+		if v != nil {
+			return strconv.FormatUint(*v, 10), true
+		}
+	case *float64:
+		if v != nil {
+			return strconv.FormatFloat(*v, 'f', -1, 64), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"5", int64(5)},
+		{"-5", int64(-5)},
+		{"9007199254740993", int64(9007199254740993)},
+		{"18446744073709551615", uint64(math.MaxUint64)},
+		{"18446744073709551616", 1.8446744073709552e19},
+		{"-9223372036854775809", -9.223372036854776e18},
+		{"5.5", 5.5},
+		{"5.0", 5.0},
+		{"1e3", 1000.0},
+		{"1e400", math.Inf(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			v, err := parseNumber(tt.in)
+			require.NoError(t, err)
+			switch v := v.(type) {
+			case *int64:
+				require.Equal(t, tt.want, *v)
+			case *uint64:
+				require.Equal(t, tt.want, *v)
+			case *float64:
+				require.Equal(t, tt.want, *v)
+			}
+		})
+	}
+
+	_, err := parseNumber("five")
+	require.Error(t, err)
+}
+
+func Test_framer_numbers(t *testing.T) {
+	t.Run("integers", func(t *testing.T) {
+		runOptionsTest(t, "numbers", FrameOptions{},
+			Message{Value: []byte(`{"counter":9007199254740993,"id":18446744073709551615,"value":5}`)},
+			Message{Value: []byte(`{"counter":9007199254740995,"id":18446744073709551614,"value":5.5}`)},
+			Message{Value: []byte(`{"counter":-1,"id":1,"value":6}`)},
+		)
+	})
+
+	t.Run("force float", func(t *testing.T) {
+		runOptionsTest(t, "numbers-float", FrameOptions{ForceFloat: true},
+			Message{Value: []byte(`{"value":5}`)},
+			Message{Value: []byte(`{"value":5.5}`)},
+		)
+	})
+
+	t.Run("fields keep their widened type", func(t *testing.T) {
+		f := newFramer(FrameOptions{}, topicPattern{})
+		frame, err := f.toFrame([]Message{{Value: []byte(`{"value":5}`)}, {Value: []byte(`{"value":5.5}`)}}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, data.FieldTypeNullableFloat64, frame.Fields[1].Type())
+		require.Equal(t, 5.0, *frame.Fields[1].At(0).(*float64))
+		require.Nil(t, frame.Meta)
+
+		frame, err = f.toFrame([]Message{{Value: []byte(`{"value":6}`)}}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, data.FieldTypeNullableFloat64, frame.Fields[1].Type())
+		require.Equal(t, 6.0, *frame.Fields[1].At(0).(*float64))
+	})
+}
+
+func TestNumberFieldType(t *testing.T) {
+	ints := data.NewField("", nil, []*int64{ptr(int64(-1)), nil})
+	uints := data.NewField("", nil, []*uint64{ptr(uint64(math.MaxUint64))})
+	positive := data.NewField("", nil, []*int64{ptr(int64(1))})
+
+	require.Equal(t, data.FieldTypeNullableInt64, numberFieldType(ints, ptr(int64(2))))
+	require.Equal(t, data.FieldTypeNullableFloat64, numberFieldType(ints, ptr(uint64(math.MaxUint64))))
+	require.Equal(t, data.FieldTypeNullableUint64, numberFieldType(positive, ptr(uint64(math.MaxUint64))))
+	require.Equal(t, data.FieldTypeNullableUint64, numberFieldType(uints, ptr(int64(2))))
+	require.Equal(t, data.FieldTypeNullableFloat64, numberFieldType(uints, ptr(int64(-2))))
+	require.Equal(t, data.FieldTypeNullableFloat64, numberFieldType(positive, ptr(2.5)))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
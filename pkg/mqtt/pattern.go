@@ -0,0 +1,89 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// topicPattern is a topic filter that may name its levels with placeholders,
+// such as "site/{site}/dev/{device}/telemetry". A placeholder matches a single
+// topic level like the + wildcard, and the level it matched is attached to the
+// fields of the message as a label named after the placeholder.
+type topicPattern struct {
+	// filter is the MQTT topic filter to subscribe to, with + in place of
+	// the placeholders.
+	filter string
+	// names holds the placeholder names by topic level.
+	names map[int]string
+}
+
+// parseTopicPattern compiles a topic with placeholders into a topic filter. A
+// topic level is a placeholder only if it is a name in braces, so other levels
+// with braces are matched literally. A topic without placeholders is its own
+// filter.
+func parseTopicPattern(topic string) (topicPattern, error) {
+	if !strings.Contains(topic, "{") {
+		return topicPattern{filter: topic}, nil
+	}
+
+	levels := strings.Split(topic, "/")
+	names := make(map[int]string)
+	seen := make(map[string]bool)
+	for i, level := range levels {
+		name, ok := placeholderName(level)
+		if !ok {
+			continue
+		}
+		if seen[name] {
+			return topicPattern{}, backend.DownstreamErrorf("duplicate placeholder {%s} in topic %s", name, topic)
+		}
+		seen[name] = true
+		names[i] = name
+		levels[i] = "+"
+	}
+	if len(names) == 0 {
+		return topicPattern{filter: topic}, nil
+	}
+
+	return topicPattern{
+		filter: strings.Join(levels, "/"),
+		names:  names,
+	}, nil
+}
+
+// placeholderName returns the name of a topic level of the form {name}, where
+// the name is made of letters, digits and underscores and does not start with
+// a digit.
+func placeholderName(level string) (string, bool) {
+	if len(level) < 3 || level[0] != '{' || level[len(level)-1] != '}' {
+		return "", false
+	}
+	name := level[1 : len(level)-1]
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// labels returns the topic levels matched by the placeholders, or nil if the
+// pattern has none.
+func (p topicPattern) labels(topic string) data.Labels {
+	if len(p.names) == 0 {
+		return nil
+	}
+	levels := strings.Split(topic, "/")
+	labels := make(data.Labels, len(p.names))
+	for i, name := range p.names {
+		if i < len(levels) {
+			labels[name] = levels[i]
+		}
+	}
+	return labels
+}
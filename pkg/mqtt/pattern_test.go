@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTopicPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		filter  string
+		names   map[int]string
+		wantErr string
+	}{
+		{
+			name:   "topic without placeholders",
+			topic:  "plant/+/temperature",
+			filter: "plant/+/temperature",
+		},
+		{
+			name:   "placeholders",
+			topic:  "site/{site}/dev/{device}/telemetry",
+			filter: "site/+/dev/+/telemetry",
+			names:  map[int]string{1: "site", 3: "device"},
+		},
+		{
+			name:   "placeholder followed by a multi-level wildcard",
+			topic:  "site/{site}/#",
+			filter: "site/+/#",
+			names:  map[int]string{1: "site"},
+		},
+		{
+			name:   "braces within a level",
+			topic:  "site/dev-{device}",
+			filter: "site/dev-{device}",
+		},
+		{
+			name:   "empty braces",
+			topic:  "site/{}",
+			filter: "site/{}",
+		},
+		{
+			name:   "literal braces next to a placeholder",
+			topic:  "site/{site}/{\"unit\":\"C\"}/{1st}",
+			filter: "site/+/{\"unit\":\"C\"}/{1st}",
+			names:  map[int]string{1: "site"},
+		},
+		{
+			name:    "duplicate placeholder",
+			topic:   "{site}/{site}",
+			wantErr: "duplicate placeholder {site}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseTopicPattern(tt.topic)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.filter, p.filter)
+			require.Equal(t, tt.names, p.names)
+		})
+	}
+}
+
+func TestTopicPattern_Labels(t *testing.T) {
+	p, err := parseTopicPattern("site/{site}/dev/{device}/#")
+	require.NoError(t, err)
+
+	require.Equal(t, data.Labels{"site": "berlin", "device": "42"}, p.labels("site/berlin/dev/42/telemetry/power"))
+
+	p, err = parseTopicPattern("site/+/dev")
+	require.NoError(t, err)
+	require.Nil(t, p.labels("site/berlin/dev"))
+}
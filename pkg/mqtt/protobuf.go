@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	// The well-known types are resolved when a descriptor set leaves them
+	// out.
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// parseDescriptorSet parses a base64 encoded FileDescriptorSet, as written
+// by protoc --descriptor_set_out. Several sets may be concatenated before
+// encoding them. Imports of the well-known types may be left out of the set.
+func parseDescriptorSet(encoded string) (*protoregistry.Files, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, backend.DownstreamErrorf("invalid protobuf descriptor set: not base64: %w", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return nil, backend.DownstreamErrorf("invalid protobuf descriptor set: %w", err)
+	}
+	set.File = dedupeFiles(set.File)
+	if err := addWellKnownImports(set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, backend.DownstreamErrorf("invalid protobuf descriptor set: %w", err)
+	}
+	return files, nil
+}
+
+// dedupeFiles drops the files repeated by concatenated sets sharing imports.
+func dedupeFiles(files []*descriptorpb.FileDescriptorProto) []*descriptorpb.FileDescriptorProto {
+	seen := make(map[string]bool, len(files))
+	deduped := files[:0]
+	for _, f := range files {
+		if seen[f.GetName()] {
+			continue
+		}
+		seen[f.GetName()] = true
+		deduped = append(deduped, f)
+	}
+	return deduped
+}
+
+// addWellKnownImports adds the imported files missing from the set that are
+// well-known types.
+func addWellKnownImports(set *descriptorpb.FileDescriptorSet) error {
+	names := make(map[string]bool, len(set.File))
+	for _, f := range set.File {
+		names[f.GetName()] = true
+	}
+	for i := 0; i < len(set.File); i++ {
+		for _, dep := range set.File[i].GetDependency() {
+			if names[dep] {
+				continue
+			}
+			fd, err := protoregistry.GlobalFiles.FindFileByPath(dep)
+			if err != nil {
+				return backend.DownstreamErrorf("invalid protobuf descriptor set: missing import %q, compile it with --include_imports", dep)
+			}
+			names[dep] = true
+			set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+		}
+	}
+	return nil
+}
+
+// findMessageType returns the descriptor of the message type with the given
+// full name, such as "acme.telemetry.Reading".
+func findMessageType(files *protoregistry.Files, name string) (protoreflect.MessageDescriptor, error) {
+	if files == nil {
+		return nil, backend.DownstreamErrorf("no protobuf descriptor set configured in the data source")
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, backend.DownstreamErrorf("unknown protobuf message type %q", name)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, backend.DownstreamErrorf("invalid protobuf message type %q: it is not a message", name)
+	}
+	return md, nil
+}
+
+// decodeProtobuf decodes a binary protobuf payload into JSON, so it is framed
+// like JSON payloads. Fields are named as in the .proto file and keep their
+// type: 64-bit integers are numbers rather than strings, enums are the
+// names of their values, bytes are base64 strings and timestamps are RFC
+// 3339 strings. Fields with implicit presence are always present.
+func decodeProtobuf(md protoreflect.MessageDescriptor, payload []byte) ([]byte, error) {
+	m := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	stream := jsoniter.ConfigDefault.BorrowStream(nil)
+	defer jsoniter.ConfigDefault.ReturnStream(stream)
+	writeProtoMessage(stream, m)
+	if stream.Error != nil {
+		return nil, stream.Error
+	}
+	return append([]byte(nil), stream.Buffer()...), nil
+}
+
+func writeProtoMessage(stream *jsoniter.Stream, m protoreflect.Message) {
+	md := m.Descriptor()
+	switch md.FullName() {
+	case "google.protobuf.Timestamp":
+		seconds := m.Get(md.Fields().ByName("seconds")).Int()
+		nanos := m.Get(md.Fields().ByName("nanos")).Int()
+		writeTimestamp(stream, time.Unix(seconds, nanos))
+		return
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue",
+		"google.protobuf.Int64Value", "google.protobuf.UInt64Value",
+		"google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		fd := md.Fields().ByName("value")
+		writeProtoValue(stream, fd, m.Get(fd))
+		return
+	}
+
+	stream.WriteObjectStart()
+	first := true
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !m.Has(fd) {
+			continue
+		}
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(string(fd.Name()))
+		v := m.Get(fd)
+		switch {
+		case fd.IsMap():
+			writeProtoMap(stream, fd, v.Map())
+		case fd.IsList():
+			list := v.List()
+			stream.WriteArrayStart()
+			for j := 0; j < list.Len(); j++ {
+				if j > 0 {
+					stream.WriteMore()
+				}
+				writeProtoValue(stream, fd, list.Get(j))
+			}
+			stream.WriteArrayEnd()
+		default:
+			writeProtoValue(stream, fd, v)
+		}
+	}
+	stream.WriteObjectEnd()
+}
+
+// writeTimestamp writes a time as an RFC 3339 string in UTC.
+func writeTimestamp(stream *jsoniter.Stream, t time.Time) {
+	stream.WriteString(t.UTC().Format(time.RFC3339Nano))
+}
+
+func writeProtoMap(stream *jsoniter.Stream, fd protoreflect.FieldDescriptor, m protoreflect.Map) {
+	stream.WriteObjectStart()
+	first := true
+	m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(k.String())
+		writeProtoValue(stream, fd.MapValue(), v)
+		return true
+	})
+	stream.WriteObjectEnd()
+}
+
+func writeProtoValue(stream *jsoniter.Stream, fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		stream.WriteBool(v.Bool())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		stream.WriteInt64(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		stream.WriteUint64(v.Uint())
+	case protoreflect.FloatKind:
+		writeFloat(stream, v.Float(), 32)
+	case protoreflect.DoubleKind:
+		writeFloat(stream, v.Float(), 64)
+	case protoreflect.StringKind:
+		stream.WriteString(v.String())
+	case protoreflect.BytesKind:
+		stream.WriteString(base64.StdEncoding.EncodeToString(v.Bytes()))
+	case protoreflect.EnumKind:
+		if value := fd.Enum().Values().ByNumber(v.Enum()); value != nil {
+			stream.WriteString(string(value.Name()))
+		} else {
+			stream.WriteInt32(int32(v.Enum()))
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		writeProtoMessage(stream, v.Message())
+	default:
+		stream.Error = fmt.Errorf("unsupported protobuf field kind %s", fd.Kind())
+	}
+}
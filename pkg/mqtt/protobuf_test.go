@@ -0,0 +1,191 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// telemetryProto describes:
+//
+//	syntax = "proto3";
+//	package acme.telemetry;
+//	import "google/protobuf/timestamp.proto";
+//
+//	enum Status { UNKNOWN = 0; OK = 1; FAULT = 2; }
+//	message Location { double lat = 1; double lon = 2; }
+//	message Reading {
+//	  string device = 1;
+//	  uint64 counter = 2;
+//	  float temperature = 3;
+//	  Status status = 4;
+//	  google.protobuf.Timestamp time = 5;
+//	  Location location = 6;
+//	  repeated sint32 samples = 7;
+//	}
+func telemetryProto() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	samples := field("samples", 7, descriptorpb.FieldDescriptorProto_TYPE_SINT32, "")
+	samples.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("acme/telemetry.proto"),
+		Package:    proto.String("acme.telemetry"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("OK"), Number: proto.Int32(1)},
+				{Name: proto.String("FAULT"), Number: proto.Int32(2)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Location"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("lat", 1, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+					field("lon", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+				},
+			},
+			{
+				Name: proto.String("Reading"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("device", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+					field("counter", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64, ""),
+					field("temperature", 3, descriptorpb.FieldDescriptorProto_TYPE_FLOAT, ""),
+					field("status", 4, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".acme.telemetry.Status"),
+					field("time", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+					field("location", 6, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".acme.telemetry.Location"),
+					samples,
+				},
+			},
+		},
+	}
+}
+
+// encodeDescriptorSet encodes the files like the data source settings.
+func encodeDescriptorSet(t *testing.T, files ...*descriptorpb.FileDescriptorProto) string {
+	t.Helper()
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: files})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func telemetryTypes(t *testing.T) *protoregistry.Files {
+	t.Helper()
+	files, err := parseDescriptorSet(encodeDescriptorSet(t, telemetryProto()))
+	require.NoError(t, err)
+	return files
+}
+
+// reading encodes a Reading message with the given fields set.
+func reading(t *testing.T, md protoreflect.MessageDescriptor, set func(m *dynamicpb.Message)) []byte {
+	t.Helper()
+	m := dynamicpb.NewMessage(md)
+	set(m)
+	b, err := proto.Marshal(m)
+	require.NoError(t, err)
+	return b
+}
+
+func TestParseDescriptorSet(t *testing.T) {
+	files := telemetryTypes(t)
+	md, err := findMessageType(files, "acme.telemetry.Reading")
+	require.NoError(t, err)
+	require.Equal(t, protoreflect.FullName("acme.telemetry.Reading"), md.FullName())
+
+	_, err = findMessageType(files, "acme.telemetry.Missing")
+	require.ErrorContains(t, err, "unknown protobuf message type")
+	_, err = findMessageType(files, "acme.telemetry.Status")
+	require.ErrorContains(t, err, "it is not a message")
+	_, err = findMessageType(nil, "acme.telemetry.Reading")
+	require.ErrorContains(t, err, "no protobuf descriptor set")
+
+	// Concatenated sets may repeat their imports.
+	set := encodeDescriptorSet(t, telemetryProto())
+	b, err := base64.StdEncoding.DecodeString(set)
+	require.NoError(t, err)
+	_, err = parseDescriptorSet(base64.StdEncoding.EncodeToString(append(b, b...)))
+	require.NoError(t, err)
+
+	_, err = parseDescriptorSet("not base64!")
+	require.ErrorContains(t, err, "not base64")
+
+	missing := telemetryProto()
+	missing.Dependency = append(missing.Dependency, "acme/common.proto")
+	_, err = parseDescriptorSet(encodeDescriptorSet(t, missing))
+	require.ErrorContains(t, err, `missing import "acme/common.proto"`)
+}
+
+func Test_framer_protobuf(t *testing.T) {
+	md, err := findMessageType(telemetryTypes(t), "acme.telemetry.Reading")
+	require.NoError(t, err)
+	fields := md.Fields()
+	location := fields.ByName("location").Message()
+
+	payload := func(device string, counter uint64, temperature float32, status protoreflect.EnumNumber, at time.Time) []byte {
+		return reading(t, md, func(m *dynamicpb.Message) {
+			m.Set(fields.ByName("device"), protoreflect.ValueOfString(device))
+			m.Set(fields.ByName("counter"), protoreflect.ValueOfUint64(counter))
+			m.Set(fields.ByName("temperature"), protoreflect.ValueOfFloat32(temperature))
+			m.Set(fields.ByName("status"), protoreflect.ValueOfEnum(status))
+			m.Set(fields.ByName("time"), protoreflect.ValueOfMessage(timestamppb.New(at).ProtoReflect()))
+			loc := dynamicpb.NewMessage(location)
+			loc.Set(location.Fields().ByName("lat"), protoreflect.ValueOfFloat64(52.5))
+			loc.Set(location.Fields().ByName("lon"), protoreflect.ValueOfFloat64(13.4))
+			m.Set(fields.ByName("location"), protoreflect.ValueOfMessage(loc))
+			samples := m.Mutable(fields.ByName("samples")).List()
+			samples.Append(protoreflect.ValueOfInt32(-1))
+			samples.Append(protoreflect.ValueOfInt32(2))
+		})
+	}
+
+	f := newFramer(FrameOptions{
+		Format:      PayloadFormatProtobuf,
+		MessageType: "acme.telemetry.Reading",
+		Flatten:     true,
+		TimeField:   "time",
+	}, topicPattern{})
+	f.message = md
+	frame, err := f.toFrame([]Message{
+		{Timestamp: time.Unix(0, 0), Value: payload("dev-1", 18446744073709551615, 21.5, 1, time.Unix(1700000000, 500))},
+		// Zero values of fields without presence are not left out.
+		{Timestamp: time.Unix(60, 0), Value: payload("dev-1", 0, 0, 0, time.Unix(1700000060, 0))},
+		{Timestamp: time.Unix(120, 0), Value: []byte("not protobuf")},
+	}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, 2, frame.Rows())
+	require.Len(t, frame.Meta.Notices, 1)
+	require.Equal(t, "1 messages were left out because they could not be decoded as acme.telemetry.Reading", frame.Meta.Notices[0].Text)
+	experimental.CheckGoldenJSONFrame(t, "testdata", "protobuf", frame, update)
+}
+
+func TestFrameOptions_ValidateProtobuf(t *testing.T) {
+	require.NoError(t, FrameOptions{Format: PayloadFormatProtobuf, MessageType: "acme.telemetry.Reading"}.Validate())
+	require.ErrorContains(t, FrameOptions{Format: PayloadFormatProtobuf}.Validate(), "invalid protobuf message type")
+	require.ErrorContains(t, FrameOptions{Format: "xml"}.Validate(), "invalid payload format")
+}
@@ -0,0 +1,366 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// DefaultHistoryDiskSize is the maximum size, in megabytes, of the history of
+// a topic stored on disk when no size is configured.
+const DefaultHistoryDiskSize = 100
+
+const (
+	// segmentsPerLog is the number of segments a log is split into, so old
+	// messages are removed in steps of about 1/segmentsPerLog of the
+	// retention.
+	segmentsPerLog = 8
+	segmentExt     = ".log"
+	// recordHeaderSize is the size of the length and checksum of a record.
+	recordHeaderSize = 8
+)
+
+var errHistoryClosed = errors.New("history is closed")
+
+// diskHistory is a History stored in an append-only log of segment files, so
+// the messages survive restarts. Messages are appended to the newest segment,
+// and a new segment is started once it holds 1/segmentsPerLog of maxBytes or
+// spans 1/segmentsPerLog of the duration. Whole segments are removed once
+// all their messages are older than the duration, and the oldest ones once
+// the log exceeds maxBytes.
+//
+// Segments are named after the receive time of their first message and hold
+// records of the form
+//
+//	length uint32 | crc32 uint32 | timestamp int64 | topic length uvarint | topic | value
+//
+// where the length and the checksum cover the bytes after them. A record cut
+// short by a crash ends its segment.
+type diskHistory struct {
+	mu       sync.Mutex
+	dir      string
+	segments []segment // oldest first, the last one is appended to
+	file     *os.File  // the last segment, nil until it is opened
+	size     int64     // bytes in all segments
+	duration time.Duration
+	maxBytes int64
+	now      func() time.Time
+	closed   bool
+}
+
+type segment struct {
+	start time.Time // receive time of the first message
+	size  int64
+}
+
+func (s segment) name() string {
+	return fmt.Sprintf("%020d%s", s.start.UnixNano(), segmentExt)
+}
+
+// openDiskHistory opens the log in dir, creating it if needed, and drops the
+// incomplete record a crash may have left at its end. A maxBytes of zero or
+// less uses DefaultHistoryDiskSize.
+func openDiskHistory(dir string, duration time.Duration, maxBytes int64) (*diskHistory, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultHistoryDiskSize << 20
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	segments, err := readSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &diskHistory{
+		dir:      dir,
+		segments: segments,
+		duration: duration,
+		maxBytes: maxBytes,
+		now:      time.Now,
+	}
+	for _, s := range segments {
+		h.size += s.size
+	}
+	if len(segments) > 0 {
+		if err := h.repair(); err != nil {
+			return nil, err
+		}
+	}
+	h.expire()
+	return h, nil
+}
+
+// readSegments lists the segments in dir, oldest first.
+func readSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, e := range entries {
+		nanos, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{start: time.Unix(0, n), size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start.Before(segments[j].start)
+	})
+	return segments, nil
+}
+
+// repair truncates the last segment after its last complete record.
+func (h *diskHistory) repair() error {
+	last := &h.segments[len(h.segments)-1]
+	b, err := os.ReadFile(filepath.Join(h.dir, last.name()))
+	if err != nil {
+		return err
+	}
+	valid := int64(0)
+	for len(b) > 0 {
+		_, n, ok := decodeRecord(b)
+		if !ok {
+			break
+		}
+		valid += int64(n)
+		b = b[n:]
+	}
+	if valid == last.size {
+		return nil
+	}
+	if err := os.Truncate(filepath.Join(h.dir, last.name()), valid); err != nil {
+		return err
+	}
+	h.size -= last.size - valid
+	last.size = valid
+	return nil
+}
+
+func (h *diskHistory) Add(m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	if err := h.add(m); err != nil {
+		log.DefaultLogger.Error("Failed to write MQTT message history", "dir", h.dir, "error", err)
+	}
+	h.expire()
+}
+
+func (h *diskHistory) add(m Message) error {
+	if h.file == nil || h.full(m.Timestamp) {
+		if err := h.roll(m.Timestamp); err != nil {
+			return err
+		}
+	}
+	n, err := h.file.Write(encodeRecord(m))
+	h.segments[len(h.segments)-1].size += int64(n)
+	h.size += int64(n)
+	return err
+}
+
+// full reports whether a message received at t starts a new segment.
+func (h *diskHistory) full(t time.Time) bool {
+	last := h.segments[len(h.segments)-1]
+	return last.size >= h.maxBytes/segmentsPerLog || t.Sub(last.start) >= h.duration/segmentsPerLog
+}
+
+// roll opens the segment to append to, starting a new one unless the last
+// segment has room for a message received at t.
+func (h *diskHistory) roll(t time.Time) error {
+	if h.file != nil {
+		if err := h.file.Close(); err != nil {
+			return err
+		}
+		h.file = nil
+	}
+	if len(h.segments) == 0 || h.full(t) {
+		// Timestamps are not guaranteed to be unique, segment names are.
+		start := t
+		if len(h.segments) > 0 && !start.After(h.segments[len(h.segments)-1].start) {
+			start = h.segments[len(h.segments)-1].start.Add(time.Nanosecond)
+		}
+		h.segments = append(h.segments, segment{start: start})
+	}
+	f, err := os.OpenFile(filepath.Join(h.dir, h.segments[len(h.segments)-1].name()), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	h.file = f
+	return nil
+}
+
+func (h *diskHistory) Range(from, to time.Time) ([]Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, errHistoryClosed
+	}
+	h.expire()
+	if oldest := h.now().Add(-h.duration); from.Before(oldest) {
+		from = oldest
+	}
+
+	var messages []Message
+	for i, s := range h.segments {
+		if s.start.After(to) {
+			break
+		}
+		// The messages of a segment were received before the next one started.
+		if i+1 < len(h.segments) && h.segments[i+1].start.Before(from) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(h.dir, s.name()))
+		if err != nil {
+			return nil, err
+		}
+		for len(b) > 0 {
+			m, n, ok := decodeRecord(b)
+			if !ok {
+				break
+			}
+			b = b[n:]
+			if !m.Timestamp.Before(from) && !m.Timestamp.After(to) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	return messages, nil
+}
+
+func (h *diskHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// expire removes the segments whose messages are all older than the duration
+// and the oldest segments while the log exceeds maxBytes. The last segment is
+// never removed.
+func (h *diskHistory) expire() {
+	oldest := h.now().Add(-h.duration)
+	for len(h.segments) > 1 && (h.segments[1].start.Before(oldest) || h.size > h.maxBytes) {
+		if err := os.Remove(filepath.Join(h.dir, h.segments[0].name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.DefaultLogger.Error("Failed to remove MQTT message history segment", "dir", h.dir, "error", err)
+			return
+		}
+		h.size -= h.segments[0].size
+		h.segments[0] = segment{}
+		h.segments = h.segments[1:]
+	}
+}
+
+func encodeRecord(m Message) []byte {
+	b := make([]byte, recordHeaderSize, recordHeaderSize+8+binary.MaxVarintLen64+len(m.Topic)+len(m.Value))
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Timestamp.UnixNano()))
+	b = binary.AppendUvarint(b, uint64(len(m.Topic)))
+	b = append(b, m.Topic...)
+	b = append(b, m.Value...)
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-recordHeaderSize))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[recordHeaderSize:]))
+	return b
+}
+
+// decodeRecord decodes the record at the start of b and returns its size. It
+// reports false when b does not start with a complete, intact record.
+func decodeRecord(b []byte) (Message, int, bool) {
+	if len(b) < recordHeaderSize {
+		return Message{}, 0, false
+	}
+	length := int(binary.BigEndian.Uint32(b[0:4]))
+	if length < 8 || len(b)-recordHeaderSize < length {
+		return Message{}, 0, false
+	}
+	body := b[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[4:8]) {
+		return Message{}, 0, false
+	}
+
+	timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+	topicLen, n := binary.Uvarint(body[8:])
+	if n <= 0 || uint64(len(body)-8-n) < topicLen {
+		return Message{}, 0, false
+	}
+	topic := body[8+n : 8+n+int(topicLen)]
+	value := body[8+n+int(topicLen):]
+	return Message{
+		Timestamp: timestamp,
+		Topic:     string(topic),
+		Value:     append([]byte(nil), value...),
+	}, recordHeaderSize + length, true
+}
+
+// pruneDiskHistory removes the segments under dir that were last written
+// before the history duration, and the directories left empty. It cleans up
+// the logs of topics that are not subscribed to anymore.
+func pruneDiskHistory(dir string, duration time.Duration) error {
+	oldest := time.Now().Add(-duration)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		topicDir := filepath.Join(dir, e.Name())
+		segments, err := os.ReadDir(topicDir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		kept := 0
+		for _, s := range segments {
+			info, err := s.Info()
+			if err != nil || !strings.HasSuffix(s.Name(), segmentExt) || !info.ModTime().Before(oldest) {
+				kept++
+				continue
+			}
+			if err := os.Remove(filepath.Join(topicDir, s.Name())); err != nil {
+				errs = append(errs, err)
+				kept++
+			}
+		}
+		if kept == 0 {
+			if err := os.Remove(topicDir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
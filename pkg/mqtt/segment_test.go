@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskHistory(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	open := func(t *testing.T, dir string, duration time.Duration, maxBytes int64) *diskHistory {
+		h, err := openDiskHistory(dir, duration, maxBytes)
+		require.NoError(t, err)
+		h.now = func() time.Time { return now }
+		t.Cleanup(func() { _ = h.Close() })
+		return h
+	}
+	add := func(h *diskHistory, values ...string) {
+		for _, v := range values {
+			h.Add(Message{Timestamp: now, Topic: "test/topic", Value: []byte(v)})
+			now = now.Add(time.Second)
+		}
+	}
+	segmentFiles := func(t *testing.T, dir string) int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	t.Run("returns the messages of the range", func(t *testing.T) {
+		now = start
+		h := open(t, t.TempDir(), time.Hour, 0)
+		add(h, "1", "2", "3", "4")
+
+		messages, err := h.Range(start.Add(time.Second), start.Add(2*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, []string{"2", "3"}, bufferedValues(messages))
+		require.Equal(t, "test/topic", messages[0].Topic)
+		require.True(t, start.Add(time.Second).Equal(messages[0].Timestamp))
+
+		messages, err = h.Range(start.Add(10*time.Second), start.Add(20*time.Second))
+		require.NoError(t, err)
+		require.Empty(t, messages)
+	})
+
+	t.Run("keeps the messages when reopened", func(t *testing.T) {
+		now = start
+		dir := t.TempDir()
+		h := open(t, dir, time.Hour, 0)
+		add(h, "1", "2")
+		require.NoError(t, h.Close())
+
+		_, err := h.Range(start, now)
+		require.ErrorIs(t, err, errHistoryClosed)
+
+		h = open(t, dir, time.Hour, 0)
+		add(h, "3")
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2", "3"}, bufferedValues(messages))
+		require.Equal(t, 1, segmentFiles(t, dir))
+	})
+
+	t.Run("drops segments older than the duration", func(t *testing.T) {
+		now = start
+		dir := t.TempDir()
+		// A new segment every second.
+		h := open(t, dir, 8*time.Second, 0)
+		add(h, "1", "2", "3", "4", "5", "6", "7", "8", "9", "10")
+
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"3", "4", "5", "6", "7", "8", "9", "10"}, bufferedValues(messages))
+		require.Equal(t, 9, segmentFiles(t, dir))
+
+		now = now.Add(time.Hour)
+		messages, err = h.Range(start, now)
+		require.NoError(t, err)
+		require.Empty(t, messages)
+		require.Equal(t, 1, segmentFiles(t, dir))
+	})
+
+	t.Run("drops the oldest segments beyond the maximum size", func(t *testing.T) {
+		now = start
+		dir := t.TempDir()
+		record := int64(len(encodeRecord(Message{Timestamp: now, Topic: "test/topic", Value: []byte("1")})))
+		// Every segment holds a single message.
+		h := open(t, dir, time.Hour, 4*record)
+		add(h, "1", "2", "3", "4", "5", "6")
+
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"3", "4", "5", "6"}, bufferedValues(messages))
+	})
+
+	t.Run("drops an incomplete record", func(t *testing.T) {
+		now = start
+		dir := t.TempDir()
+		h := open(t, dir, time.Hour, 0)
+		add(h, "1", "2")
+		require.NoError(t, h.Close())
+
+		name := filepath.Join(dir, h.segments[0].name())
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(name, info.Size()-1))
+
+		h = open(t, dir, time.Hour, 0)
+		add(h, "3")
+		messages, err := h.Range(start, now)
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "3"}, bufferedValues(messages))
+	})
+}
+
+func TestPruneDiskHistory(t *testing.T) {
+	dir := t.TempDir()
+	oldDir := filepath.Join(dir, "old")
+	newDir := filepath.Join(dir, "new")
+	require.NoError(t, os.MkdirAll(oldDir, 0o750))
+	require.NoError(t, os.MkdirAll(newDir, 0o750))
+
+	old := filepath.Join(oldDir, "00000000000000000001.log")
+	require.NoError(t, os.WriteFile(old, nil, 0o640))
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+	require.NoError(t, os.WriteFile(filepath.Join(newDir, "00000000000000000002.log"), nil, 0o640))
+
+	require.NoError(t, pruneDiskHistory(dir, time.Hour))
+	require.NoDirExists(t, oldDir)
+	require.FileExists(t, filepath.Join(newDir, "00000000000000000002.log"))
+
+	require.NoError(t, pruneDiskHistory(filepath.Join(dir, "missing"), time.Hour))
+}
@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// FieldSelector selects a value of JSON payloads as a field.
+type FieldSelector struct {
+	// Path is a JSONPath to the value, such as "$.sensor.temperature",
+	// "$.readings[0]" or "$['device id']". The leading "$." may be left out.
+	Path string `json:"path"`
+	// Alias is the name of the field. Empty uses the path without "$.".
+	Alias string `json:"alias,omitempty"`
+}
+
+// name returns the name of the selected field.
+func (s FieldSelector) name() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	name := strings.TrimPrefix(s.Path, "$")
+	return strings.TrimPrefix(name, ".")
+}
+
+// pathStep is an object key or, if key is empty and index is not negative,
+// an array index.
+type pathStep struct {
+	key   string
+	index int
+}
+
+// fieldSelector is a compiled FieldSelector.
+type fieldSelector struct {
+	name  string
+	steps []pathStep
+}
+
+func validateSelectors(selectors []FieldSelector) error {
+	names := make(map[string]bool, len(selectors))
+	for _, s := range selectors {
+		if _, err := parseJSONPath(s.Path); err != nil {
+			return err
+		}
+		name := s.name()
+		if names[name] {
+			return backend.DownstreamErrorf("duplicate field name %q: every selected field needs its own alias", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+func compileSelectors(selectors []FieldSelector) []fieldSelector {
+	compiled := make([]fieldSelector, 0, len(selectors))
+	for _, s := range selectors {
+		steps, err := parseJSONPath(s.Path)
+		if err != nil {
+			// The options are validated with the query.
+			continue
+		}
+		compiled = append(compiled, fieldSelector{name: s.name(), steps: steps})
+	}
+	return compiled
+}
+
+// parseJSONPath parses a JSONPath selecting a single value: object keys in dot
+// or bracket notation and array indexes. Wildcards, recursive descent and
+// filters select any number of values, so they are not supported.
+func parseJSONPath(path string) ([]pathStep, error) {
+	invalid := func(reason string) error {
+		return backend.DownstreamErrorf("invalid JSONPath %q: %s", path, reason)
+	}
+
+	p := strings.TrimPrefix(path, "$")
+	if p != path && p != "" && p[0] != '.' && p[0] != '[' {
+		return nil, invalid("expected . or [ after $")
+	}
+	if p == path && p != "" && p[0] != '[' {
+		p = "." + p
+	}
+
+	var steps []pathStep
+	for p != "" {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			key := p[:end]
+			switch {
+			case key == "":
+				return nil, invalid("empty key, recursive descent is not supported")
+			case key == "*":
+				return nil, invalid("wildcards are not supported")
+			}
+			steps = append(steps, pathStep{key: key, index: -1})
+			p = p[end:]
+		case '[':
+			if len(p) > 1 && (p[1] == '\'' || p[1] == '"') {
+				// The key may contain ] and dots.
+				end := strings.Index(p[2:], string(p[1])+"]")
+				if end < 0 {
+					return nil, invalid("missing closing quote and ]")
+				}
+				steps = append(steps, pathStep{key: p[2 : 2+end], index: -1})
+				p = p[2+end+2:]
+				break
+			}
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, invalid("missing ]")
+			}
+			index, err := strconv.Atoi(p[1:end])
+			if err != nil || index < 0 {
+				return nil, invalid("expected a quoted key or an array index in brackets")
+			}
+			steps = append(steps, pathStep{index: index})
+			p = p[end+1:]
+		default:
+			return nil, invalid("expected . or [")
+		}
+	}
+	if len(steps) == 0 {
+		return nil, invalid("the path selects the whole payload")
+	}
+	return steps, nil
+}
+
+// findValue moves the iterator to the value at the given steps. It reports
+// whether the value was found.
+func findValue(it *jsoniter.Iterator, steps []pathStep) bool {
+	for _, step := range steps {
+		found := false
+		switch {
+		case step.index < 0 && it.WhatIsNext() == jsoniter.ObjectValue:
+			it.ReadMapCB(func(it *jsoniter.Iterator, key string) bool {
+				if key == step.key {
+					found = true
+					return false
+				}
+				it.Skip()
+				return true
+			})
+		case step.index >= 0 && it.WhatIsNext() == jsoniter.ArrayValue:
+			i := 0
+			it.ReadArrayCB(func(it *jsoniter.Iterator) bool {
+				if i == step.index {
+					found = true
+					return false
+				}
+				i++
+				it.Skip()
+				return true
+			})
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// selectFields reads the selected values of the payload into their fields.
+func (df *framer) selectFields(payload []byte, logger log.Logger) error {
+	for _, s := range df.selectors {
+		df.iterator = jsoniter.ParseBytes(jsoniter.ConfigDefault, payload)
+		if !findValue(df.iterator, s.steps) {
+			continue
+		}
+		df.path = append(df.path[:0], s.name)
+		if err := df.next(logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
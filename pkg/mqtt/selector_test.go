@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []pathStep
+		wantErr string
+	}{
+		{path: "$.sensor.temperature", want: []pathStep{{key: "sensor", index: -1}, {key: "temperature", index: -1}}},
+		{path: "sensor.temperature", want: []pathStep{{key: "sensor", index: -1}, {key: "temperature", index: -1}}},
+		{path: "$.readings[1].value", want: []pathStep{{key: "readings", index: -1}, {index: 1}, {key: "value", index: -1}}},
+		{path: "$['device id']", want: []pathStep{{key: "device id", index: -1}}},
+		{path: `$["a.b]"].c`, want: []pathStep{{key: "a.b]", index: -1}, {key: "c", index: -1}}},
+		{path: "[0]", want: []pathStep{{index: 0}}},
+		{path: "$", wantErr: "selects the whole payload"},
+		{path: "", wantErr: "selects the whole payload"},
+		{path: "$..value", wantErr: "recursive descent is not supported"},
+		{path: "$.readings.*", wantErr: "wildcards are not supported"},
+		{path: "$.readings[-1]", wantErr: "expected a quoted key or an array index"},
+		{path: "$.readings[0", wantErr: "missing ]"},
+		{path: "$sensor", wantErr: "expected . or [ after $"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseJSONPath(tt.path)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, steps)
+		})
+	}
+}
+
+func TestValidateSelectors(t *testing.T) {
+	require.NoError(t, validateSelectors([]FieldSelector{{Path: "$.a"}, {Path: "$.b.a", Alias: "b"}}))
+	require.ErrorContains(t, validateSelectors([]FieldSelector{{Path: "$.a"}, {Path: "a"}}), "duplicate field name")
+	require.ErrorContains(t, validateSelectors([]FieldSelector{{Path: "$..a"}}), "invalid JSONPath")
+}
+
+func Test_framer_selectFields(t *testing.T) {
+	envelope := func(temperature any) Message {
+		return Message{Value: toJSON(map[string]any{
+			"meta":    map[string]any{"id": "dev-1", "firmware": "1.2.3"},
+			"payload": map[string]any{"sensor": map[string]any{"temperature": temperature}, "readings": []any{1, 2}},
+			"ignored": "value",
+		})}
+	}
+
+	t.Run("selected fields with aliases", func(t *testing.T) {
+		runOptionsTest(t, "select-fields", FrameOptions{Fields: []FieldSelector{
+			{Path: "$.meta.id", Alias: "device"},
+			{Path: "$.payload.sensor.temperature", Alias: "temperature"},
+			{Path: "$.payload.readings[1]"},
+		}},
+			envelope(21.5),
+			// Missing values are null.
+			Message{Value: toJSON(map[string]any{"meta": map[string]any{"id": "dev-2"}})},
+			envelope(22),
+		)
+	})
+
+	t.Run("selected objects are flattened", func(t *testing.T) {
+		f := newFramer(FrameOptions{Flatten: true, Fields: []FieldSelector{{Path: "$.meta", Alias: "m"}}}, topicPattern{})
+		frame, err := f.toFrame([]Message{envelope(1)}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 3)
+		require.Equal(t, "m.firmware", frame.Fields[1].Name)
+		require.Equal(t, "m.id", frame.Fields[2].Name)
+	})
+
+	t.Run("payloads that are no JSON objects", func(t *testing.T) {
+		f := newFramer(FrameOptions{Fields: []FieldSelector{{Path: "$.a"}}}, topicPattern{})
+		frame, err := f.toFrame([]Message{{Value: []byte("on")}, {Value: []byte("[1]")}}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Len(t, frame.Fields, 1)
+		require.Equal(t, 2, frame.Rows())
+	})
+}
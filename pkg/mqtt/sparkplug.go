@@ -0,0 +1,617 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// sparkplugNamespace is the first level of Sparkplug B topics:
+// spBv1.0/<group_id>/<message_type>/<edge_node_id>[/<device_id>].
+const sparkplugNamespace = "spBv1.0"
+
+// Sparkplug B message types.
+const (
+	sparkplugNBIRTH = "NBIRTH"
+	sparkplugNDEATH = "NDEATH"
+	sparkplugNDATA  = "NDATA"
+	sparkplugDBIRTH = "DBIRTH"
+	sparkplugDDEATH = "DDEATH"
+	sparkplugDDATA  = "DDATA"
+)
+
+// Labels attached to the fields of Sparkplug B messages.
+const (
+	sparkplugGroupLabel  = "group_id"
+	sparkplugNodeLabel   = "edge_node_id"
+	sparkplugDeviceLabel = "device_id"
+)
+
+// onlineFieldName is the name of the field telling whether the edge node or
+// device of a Sparkplug B message is online.
+const onlineFieldName = "Online"
+
+// Sparkplug B metric data types.
+const (
+	sparkplugInt8     = 1
+	sparkplugInt16    = 2
+	sparkplugInt32    = 3
+	sparkplugInt64    = 4
+	sparkplugUInt8    = 5
+	sparkplugUInt16   = 6
+	sparkplugUInt32   = 7
+	sparkplugUInt64   = 8
+	sparkplugFloat    = 9
+	sparkplugDouble   = 10
+	sparkplugBoolean  = 11
+	sparkplugString   = 12
+	sparkplugDateTime = 13
+	sparkplugText     = 14
+	sparkplugUUID     = 15
+	sparkplugBytes    = 17
+	sparkplugFile     = 18
+)
+
+// Field numbers of the value of a Sparkplug B metric, in its oneof.
+const (
+	sparkplugIntValue     protowire.Number = 10
+	sparkplugLongValue    protowire.Number = 11
+	sparkplugFloatValue   protowire.Number = 12
+	sparkplugDoubleValue  protowire.Number = 13
+	sparkplugBooleanValue protowire.Number = 14
+	sparkplugStringValue  protowire.Number = 15
+	sparkplugBytesValue   protowire.Number = 16
+)
+
+// sparkplugTopic is a parsed Sparkplug B topic.
+type sparkplugTopic struct {
+	group       string
+	messageType string
+	node        string
+	device      string // empty for node messages
+}
+
+// parseSparkplugTopic parses the topic of a Sparkplug B message. It reports
+// false for other topics, including host application STATE topics.
+func parseSparkplugTopic(topic string) (sparkplugTopic, bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != sparkplugNamespace {
+		return sparkplugTopic{}, false
+	}
+	t := sparkplugTopic{group: levels[1], messageType: levels[2], node: levels[3]}
+	if len(levels) == 5 {
+		t.device = levels[4]
+	}
+	switch t.messageType {
+	case sparkplugNBIRTH, sparkplugNDEATH, sparkplugNDATA, "NCMD":
+		return t, t.device == ""
+	case sparkplugDBIRTH, sparkplugDDEATH, sparkplugDDATA, "DCMD":
+		return t, t.device != ""
+	default:
+		return sparkplugTopic{}, false
+	}
+}
+
+// deviceTopic returns the topic of a message of the given type and device
+// of the edge node.
+func (t sparkplugTopic) deviceTopic(messageType, device string) string {
+	return strings.Join([]string{sparkplugNamespace, t.group, messageType, t.node, device}, "/")
+}
+
+func (t sparkplugTopic) labels() data.Labels {
+	labels := data.Labels{sparkplugGroupLabel: t.group, sparkplugNodeLabel: t.node}
+	if t.device != "" {
+		labels[sparkplugDeviceLabel] = t.device
+	}
+	return labels
+}
+
+// sparkplugPayload is a decoded Sparkplug B payload. Timestamps are in
+// milliseconds since the Unix epoch.
+type sparkplugPayload struct {
+	timestamp    uint64
+	hasTimestamp bool
+	metrics      []sparkplugMetric
+}
+
+type sparkplugMetric struct {
+	name         string
+	alias        uint64
+	hasAlias     bool
+	timestamp    uint64
+	hasTimestamp bool
+	datatype     uint32
+	isNull       bool
+
+	// kind is the field number of the value, or 0 without a supported
+	// value. Integers and the bits of floats are in bits.
+	kind  protowire.Number
+	bits  uint64
+	bytes []byte
+}
+
+// decodeSparkplugPayload decodes the org.eclipse.tahu.protobuf.Payload of a
+// Sparkplug B message. Data sets, templates and metadata are skipped.
+func decodeSparkplugPayload(b []byte) (sparkplugPayload, error) {
+	var p sparkplugPayload
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.timestamp, p.hasTimestamp = v, true
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := decodeSparkplugMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			p.metrics = append(p.metrics, m)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return p, err
+}
+
+func decodeSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case 2:
+				m.alias, m.hasAlias = v, true
+			case 3:
+				m.timestamp, m.hasTimestamp = v, true
+			case 4:
+				m.datatype = uint32(v)
+			case 7:
+				m.isNull = v != 0
+			case sparkplugIntValue, sparkplugLongValue, sparkplugBooleanValue:
+				m.kind, m.bits = num, v
+			}
+			return n, nil
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if num == sparkplugFloatValue {
+				m.kind, m.bits = num, uint64(v)
+			}
+			return n, nil
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if num == sparkplugDoubleValue {
+				m.kind, m.bits = num, v
+			}
+			return n, nil
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 1:
+				m.name = string(v)
+			case sparkplugStringValue, sparkplugBytesValue:
+				m.kind, m.bytes = num, v
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return m, err
+}
+
+// consumeFields calls consume for every field of a protobuf message. It
+// returns the length of the field value, or a negative protowire error code.
+func consumeFields(b []byte, consume func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := consume(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// time returns the time of the metric, or of the payload, or the receive
+// time.
+func (m sparkplugMetric) time(p sparkplugPayload, received time.Time) time.Time {
+	switch {
+	case m.hasTimestamp:
+		return time.UnixMilli(int64(m.timestamp))
+	case p.hasTimestamp:
+		return time.UnixMilli(int64(p.timestamp))
+	default:
+		return received
+	}
+}
+
+// value returns the field type and value of the metric for the given data
+// type. Metrics without a data type get the type of their value. It reports
+// false for null metrics and unsupported data types.
+func (m sparkplugMetric) value(datatype uint32) (data.FieldType, interface{}, bool) {
+	if m.isNull || m.kind == 0 {
+		return data.FieldTypeUnknown, nil, false
+	}
+	if datatype == 0 {
+		switch m.kind {
+		case sparkplugIntValue:
+			datatype = sparkplugUInt32
+		case sparkplugLongValue:
+			datatype = sparkplugUInt64
+		case sparkplugFloatValue:
+			datatype = sparkplugFloat
+		case sparkplugDoubleValue:
+			datatype = sparkplugDouble
+		case sparkplugBooleanValue:
+			datatype = sparkplugBoolean
+		case sparkplugStringValue:
+			datatype = sparkplugString
+		case sparkplugBytesValue:
+			datatype = sparkplugBytes
+		}
+	}
+
+	// Signed integers are sent as their two's complement.
+	var i int64
+	switch datatype {
+	case sparkplugInt8:
+		i = int64(int8(m.bits))
+	case sparkplugInt16:
+		i = int64(int16(m.bits))
+	case sparkplugInt32:
+		i = int64(int32(m.bits))
+	case sparkplugInt64:
+		i = int64(m.bits)
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		i = int64(m.bits)
+	case sparkplugUInt64:
+		if m.bits > math.MaxInt64 {
+			u := m.bits
+			return data.FieldTypeNullableUint64, &u, true
+		}
+		i = int64(m.bits)
+	case sparkplugFloat:
+		f := float64(math.Float32frombits(uint32(m.bits)))
+		return data.FieldTypeNullableFloat64, &f, true
+	case sparkplugDouble:
+		f := math.Float64frombits(m.bits)
+		return data.FieldTypeNullableFloat64, &f, true
+	case sparkplugBoolean:
+		b := m.bits != 0
+		return data.FieldTypeNullableBool, &b, true
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		s := string(m.bytes)
+		return data.FieldTypeNullableString, &s, true
+	case sparkplugDateTime:
+		t := time.UnixMilli(int64(m.bits))
+		return data.FieldTypeNullableTime, &t, true
+	case sparkplugBytes, sparkplugFile:
+		s := base64.StdEncoding.EncodeToString(m.bytes)
+		return data.FieldTypeNullableString, &s, true
+	default:
+		return data.FieldTypeUnknown, nil, false
+	}
+	return data.FieldTypeNullableInt64, &i, true
+}
+
+// sparkplugMetricInfo is the name and data type of a metric, declared in a
+// birth certificate.
+type sparkplugMetricInfo struct {
+	name     string
+	datatype uint32
+}
+
+// sparkplugNode is the state of an edge node since its last NBIRTH.
+type sparkplugNode struct {
+	bdSeq    uint64
+	hasBdSeq bool
+	// metrics holds the metrics of the node and its devices by alias,
+	// which are unique within the node.
+	metrics map[uint64]sparkplugMetricInfo
+	// devices holds the devices born since the NBIRTH.
+	devices map[string]bool
+}
+
+// sparkplugRegistry tracks the metrics declared by the birth certificates of
+// Sparkplug B edge nodes and devices, so the metrics of data messages that
+// only have an alias can be resolved. The zero value is an empty registry.
+type sparkplugRegistry struct {
+	mu    sync.RWMutex
+	nodes map[string]*sparkplugNode // by group and edge node
+	// deaths holds the last NDEATH of each edge node, whose devices are
+	// forgotten by the time the NDEATH is framed.
+	deaths map[string]sparkplugDeath
+}
+
+// sparkplugDeath is the NDEATH of a session of an edge node.
+type sparkplugDeath struct {
+	bdSeq   string // empty without a bdSeq metric
+	devices []string
+}
+
+// observe records the birth and death certificates of Sparkplug B messages.
+func (r *sparkplugRegistry) observe(topic string, payload []byte) {
+	t, ok := parseSparkplugTopic(topic)
+	if !ok {
+		return
+	}
+	switch t.messageType {
+	case sparkplugNBIRTH, sparkplugDBIRTH, sparkplugNDEATH, sparkplugDDEATH:
+	default:
+		return
+	}
+	p, err := decodeSparkplugPayload(payload)
+	if err != nil {
+		return
+	}
+	if t.messageType == sparkplugNBIRTH || t.messageType == sparkplugDBIRTH {
+		r.birth(t, p)
+	} else {
+		r.death(t, p)
+	}
+}
+
+// birth records the metrics of an NBIRTH or DBIRTH message. An NBIRTH starts
+// a new session of the edge node, which forgets its previous aliases.
+func (r *sparkplugRegistry) birth(t sparkplugTopic, p sparkplugPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes == nil {
+		r.nodes = make(map[string]*sparkplugNode)
+	}
+	key := t.group + "/" + t.node
+	node, ok := r.nodes[key]
+	if !ok || t.messageType == sparkplugNBIRTH {
+		node = &sparkplugNode{metrics: make(map[uint64]sparkplugMetricInfo), devices: make(map[string]bool)}
+		r.nodes[key] = node
+	}
+	if t.device != "" {
+		node.devices[t.device] = true
+	}
+	for _, m := range p.metrics {
+		if t.messageType == sparkplugNBIRTH && m.name == "bdSeq" {
+			node.bdSeq, node.hasBdSeq = m.bits, true
+		}
+		if m.hasAlias && m.name != "" {
+			node.metrics[m.alias] = sparkplugMetricInfo{name: m.name, datatype: m.datatype}
+		}
+	}
+}
+
+// death records an NDEATH or DDEATH message and returns the devices that go
+// offline with it. It reports false for the NDEATH of a previous session of
+// the edge node, whose bdSeq differs from the one of the last NBIRTH.
+func (r *sparkplugRegistry) death(t sparkplugTopic, p sparkplugPayload) ([]string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node, ok := r.nodes[t.group+"/"+t.node]
+	if !ok {
+		return nil, true
+	}
+	if t.device != "" {
+		delete(node.devices, t.device)
+		return nil, true
+	}
+	for _, m := range p.metrics {
+		if m.name == "bdSeq" && node.hasBdSeq && m.bits != node.bdSeq {
+			return nil, false
+		}
+	}
+	devices := make([]string, 0, len(node.devices))
+	for device := range node.devices {
+		devices = append(devices, device)
+	}
+	slices.Sort(devices)
+	clear(node.devices)
+	if r.deaths == nil {
+		r.deaths = make(map[string]sparkplugDeath)
+	}
+	r.deaths[t.group+"/"+t.node] = sparkplugDeath{bdSeq: deathSeq(p), devices: devices}
+	return devices, true
+}
+
+// deathDevices returns the devices that went offline with an NDEATH the
+// registry recorded when it was received.
+func (r *sparkplugRegistry) deathDevices(t sparkplugTopic, p sparkplugPayload) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	death, ok := r.deaths[t.group+"/"+t.node]
+	if !ok || death.bdSeq != deathSeq(p) {
+		return nil
+	}
+	return death.devices
+}
+
+// deathSeq returns the bdSeq of an NDEATH, which identifies the session of
+// the edge node that ended.
+func deathSeq(p sparkplugPayload) string {
+	for _, m := range p.metrics {
+		if m.name == "bdSeq" {
+			return strconv.FormatUint(m.bits, 10)
+		}
+	}
+	return ""
+}
+
+// known reports whether the registry saw the birth of the edge node.
+func (r *sparkplugRegistry) known(t sparkplugTopic) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.nodes[t.group+"/"+t.node]
+	return ok
+}
+
+// resolve returns the metric of the edge node with the given alias.
+func (r *sparkplugRegistry) resolve(t sparkplugTopic, alias uint64) (sparkplugMetricInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	node, ok := r.nodes[t.group+"/"+t.node]
+	if !ok {
+		return sparkplugMetricInfo{}, false
+	}
+	info, ok := node.metrics[alias]
+	return info, ok
+}
+
+// sparkplugRow is a row of the metrics of a Sparkplug B message sharing a
+// timestamp.
+type sparkplugRow struct {
+	time    time.Time
+	names   map[string]bool
+	metrics []sparkplugMetric
+	infos   []sparkplugMetricInfo
+}
+
+// addSparkplug adds the rows of a Sparkplug B message: one per metric
+// timestamp, with a field per metric name. Births add an Online field that
+// is true, deaths a row where it is false, for the edge node and, for an
+// NDEATH, all its devices. Aliases are resolved from the births framed
+// before and, for edge nodes born before, from the births received by the
+// client. It returns the number of metrics whose alias is unknown.
+func (df *framer) addSparkplug(message Message, logger log.Logger) (int, error) {
+	t, ok := parseSparkplugTopic(message.Topic)
+	if !ok {
+		return 0, nil
+	}
+	p, err := decodeSparkplugPayload(message.Value)
+	if err != nil {
+		return 0, err
+	}
+
+	switch t.messageType {
+	case sparkplugNDEATH, sparkplugDDEATH:
+		var devices []string
+		if df.sparkplugLocal.known(t) {
+			if devices, ok = df.sparkplugLocal.death(t, p); !ok {
+				// The death of a previous session.
+				return 0, nil
+			}
+		} else if df.sparkplug != nil && t.device == "" {
+			devices = df.sparkplug.deathDevices(t, p)
+		}
+		at := received(p, message.Timestamp)
+		df.setTopic(message.Topic)
+		df.addOnline(false)
+		df.appendRow(at, message.Topic)
+		for _, device := range devices {
+			// The rows of the devices are like the DDEATH of the device.
+			topic := t.deviceTopic(sparkplugDDEATH, device)
+			df.setTopic(topic)
+			df.addOnline(false)
+			df.appendRow(at, topic)
+		}
+		return 0, nil
+	case sparkplugNBIRTH, sparkplugDBIRTH:
+		df.sparkplugLocal.birth(t, p)
+	case sparkplugNDATA, sparkplugDDATA:
+	default:
+		// Commands are not sent by the edge nodes.
+		return 0, nil
+	}
+
+	unknown := 0
+	var rows []*sparkplugRow
+	latest := make(map[time.Time]*sparkplugRow)
+	for _, m := range p.metrics {
+		info, ok := df.resolveSparkplug(t, m)
+		if !ok {
+			unknown++
+			continue
+		}
+		at := m.time(p, message.Timestamp)
+		row, ok := latest[at]
+		if !ok || row.names[info.name] {
+			// Metrics repeated with the same timestamp get a row of their own.
+			row = &sparkplugRow{time: at, names: make(map[string]bool)}
+			latest[at] = row
+			rows = append(rows, row)
+		}
+		row.names[info.name] = true
+		row.metrics = append(row.metrics, m)
+		row.infos = append(row.infos, info)
+	}
+
+	birth := t.messageType == sparkplugNBIRTH || t.messageType == sparkplugDBIRTH
+	if birth && len(rows) == 0 {
+		rows = append(rows, &sparkplugRow{time: received(p, message.Timestamp)})
+	}
+	df.setTopic(message.Topic)
+	for i, row := range rows {
+		for j, m := range row.metrics {
+			df.path = append(df.path[:0], row.infos[j].name)
+			fieldType, v, ok := m.value(row.infos[j].datatype)
+			if !ok {
+				df.addNil(logger)
+				continue
+			}
+			if df.options.ForceFloat && isNumberType(fieldType) {
+				fieldType, v = data.FieldTypeNullableFloat64, convertNumber(v, data.FieldTypeNullableFloat64)
+			}
+			df.addValue(fieldType, v)
+		}
+		if birth && i == 0 {
+			df.addOnline(true)
+		}
+		df.appendRow(row.time, message.Topic)
+	}
+	return unknown, nil
+}
+
+// resolveSparkplug returns the name and data type of a metric, looking up
+// its alias if it has no name. It reports false for unknown aliases.
+func (df *framer) resolveSparkplug(t sparkplugTopic, m sparkplugMetric) (sparkplugMetricInfo, bool) {
+	if m.name != "" || !m.hasAlias {
+		return sparkplugMetricInfo{name: m.name, datatype: m.datatype}, m.name != ""
+	}
+	info, ok := df.sparkplugLocal.resolve(t, m.alias)
+	if !ok && df.sparkplug != nil && !df.sparkplugLocal.known(t) {
+		info, ok = df.sparkplug.resolve(t, m.alias)
+	}
+	if ok && m.datatype != 0 {
+		info.datatype = m.datatype
+	}
+	return info, ok
+}
+
+// addOnline adds the Online field value of the current row. The field has a
+// key of its own, so it does not clash with a metric named Online.
+func (df *framer) addOnline(online bool) {
+	key := "\x00" + onlineFieldName + df.labelsKey
+	if idx, ok := df.fieldMap[key]; ok {
+		df.fields[idx].Append(&online)
+		return
+	}
+	df.newField(onlineFieldName, key, data.FieldTypeNullableBool, &online)
+}
+
+// received returns the time of a payload, or the receive time.
+func received(p sparkplugPayload, at time.Time) time.Time {
+	if p.hasTimestamp {
+		return time.UnixMilli(int64(p.timestamp))
+	}
+	return at
+}
@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/experimental"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// spMetric is a Sparkplug B metric to encode. Zero names, aliases and
+// timestamps are left out.
+type spMetric struct {
+	name      string
+	alias     uint64
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	// value is a uint64 for int_value, long_value and boolean_value, or a
+	// float32, float64, string or []byte.
+	kind  protowire.Number
+	value interface{}
+}
+
+// encodeSparkplug encodes a Sparkplug B payload, with no timestamp if it is
+// zero.
+func encodeSparkplug(timestamp uint64, metrics ...spMetric) []byte {
+	var b []byte
+	if timestamp != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, timestamp)
+	}
+	for _, m := range metrics {
+		var mb []byte
+		if m.name != "" {
+			mb = protowire.AppendTag(mb, 1, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.name)
+		}
+		if m.alias != 0 {
+			mb = protowire.AppendTag(mb, 2, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.alias)
+		}
+		if m.timestamp != 0 {
+			mb = protowire.AppendTag(mb, 3, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.timestamp)
+		}
+		if m.datatype != 0 {
+			mb = protowire.AppendTag(mb, 4, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(m.datatype))
+		}
+		if m.isNull {
+			mb = protowire.AppendTag(mb, 7, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, 1)
+		}
+		switch v := m.value.(type) {
+		case uint64:
+			mb = protowire.AppendTag(mb, m.kind, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, v)
+		case float32:
+			mb = protowire.AppendTag(mb, m.kind, protowire.Fixed32Type)
+			mb = protowire.AppendFixed32(mb, math.Float32bits(v))
+		case float64:
+			mb = protowire.AppendTag(mb, m.kind, protowire.Fixed64Type)
+			mb = protowire.AppendFixed64(mb, math.Float64bits(v))
+		case string:
+			mb = protowire.AppendTag(mb, m.kind, protowire.BytesType)
+			mb = protowire.AppendString(mb, v)
+		case []byte:
+			mb = protowire.AppendTag(mb, m.kind, protowire.BytesType)
+			mb = protowire.AppendBytes(mb, v)
+		}
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	return b
+}
+
+func bdSeq(seq uint64) spMetric {
+	return spMetric{name: "bdSeq", datatype: sparkplugUInt64, kind: sparkplugLongValue, value: seq}
+}
+
+// plantBirth is the NBIRTH of the edge node g1/n1, declaring aliases 1 to 3,
+// and pumpBirth the DBIRTH of its device pump, declaring alias 4.
+var (
+	plantBirth = encodeSparkplug(1700000000000,
+		bdSeq(7),
+		spMetric{name: "Temperature", alias: 1, datatype: sparkplugDouble, kind: sparkplugDoubleValue, value: 20.5},
+		spMetric{name: "Count", alias: 2, datatype: sparkplugInt32, kind: sparkplugIntValue, value: uint64(uint32(0xfffffffb))},
+		spMetric{name: "Running", alias: 3, datatype: sparkplugBoolean, kind: sparkplugBooleanValue, value: uint64(1)},
+	)
+	pumpBirth = encodeSparkplug(1700000000000,
+		spMetric{name: "Pressure", alias: 4, datatype: sparkplugFloat, kind: sparkplugFloatValue, value: float32(1.5)},
+		spMetric{name: "Serial", datatype: sparkplugString, kind: sparkplugStringValue, value: "P-100"},
+	)
+)
+
+func Test_framer_sparkplug(t *testing.T) {
+	f := newFramer(FrameOptions{Format: PayloadFormatSparkplug}, topicPattern{})
+	at := time.Unix(0, 0)
+	frame, err := f.toFrame([]Message{
+		{Timestamp: at, Topic: "spBv1.0/g1/NBIRTH/n1", Value: plantBirth},
+		{Timestamp: at, Topic: "spBv1.0/g1/DBIRTH/n1/pump", Value: pumpBirth},
+		// Metrics with aliases only, two of them at the same time.
+		{Timestamp: at, Topic: "spBv1.0/g1/NDATA/n1", Value: encodeSparkplug(1700000060000,
+			spMetric{alias: 1, timestamp: 1700000050000, kind: sparkplugDoubleValue, value: 21.0},
+			spMetric{alias: 1, timestamp: 1700000055000, kind: sparkplugDoubleValue, value: 21.5},
+			spMetric{alias: 3, timestamp: 1700000055000, kind: sparkplugBooleanValue, value: uint64(0)},
+			spMetric{alias: 2, isNull: true},
+		)},
+		{Timestamp: at, Topic: "spBv1.0/g1/DDATA/n1/pump", Value: encodeSparkplug(1700000070000,
+			spMetric{alias: 4, kind: sparkplugFloatValue, value: float32(2.25)},
+		)},
+		// Commands and host application states are not framed.
+		{Timestamp: at, Topic: "spBv1.0/g1/NCMD/n1", Value: encodeSparkplug(0,
+			spMetric{name: "Node Control/Rebirth", datatype: sparkplugBoolean, kind: sparkplugBooleanValue, value: uint64(1)},
+		)},
+		{Timestamp: at, Topic: "spBv1.0/STATE/host", Value: []byte(`{"online":true}`)},
+		// The death of a previous session is ignored.
+		{Timestamp: at, Topic: "spBv1.0/g1/NDEATH/n1", Value: encodeSparkplug(0, bdSeq(6))},
+		{Timestamp: at.Add(time.Minute), Topic: "spBv1.0/g1/NDEATH/n1", Value: encodeSparkplug(0, bdSeq(7))},
+	}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Nil(t, frame.Meta)
+	experimental.CheckGoldenJSONFrame(t, "testdata", "sparkplug", frame, update)
+}
+
+func Test_framer_sparkplug_aliases(t *testing.T) {
+	data := Message{Topic: "spBv1.0/g1/NDATA/n1", Value: encodeSparkplug(1700000060000,
+		spMetric{alias: 1, kind: sparkplugDoubleValue, value: 21.0},
+		spMetric{alias: 9, kind: sparkplugDoubleValue, value: 1.0},
+	)}
+
+	t.Run("unknown aliases are left out", func(t *testing.T) {
+		f := newFramer(FrameOptions{Format: PayloadFormatSparkplug}, topicPattern{})
+		frame, err := f.toFrame([]Message{data}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 0, frame.Rows())
+		require.Len(t, frame.Fields, 1)
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Equal(t, "2 metrics were left out because their alias is not in a birth certificate received since the query started", frame.Meta.Notices[0].Text)
+	})
+
+	t.Run("births received by the client", func(t *testing.T) {
+		registry := &sparkplugRegistry{}
+		registry.observe("spBv1.0/g1/NBIRTH/n1", plantBirth)
+		f := newFramer(FrameOptions{Format: PayloadFormatSparkplug}, topicPattern{})
+		f.sparkplug = registry
+		frame, err := f.toFrame([]Message{data}, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, "Temperature", frame.Fields[1].Name)
+		require.Equal(t, 21.0, *frame.Fields[1].At(0).(*float64))
+		require.Len(t, frame.Meta.Notices, 1)
+	})
+
+	t.Run("a rebirth forgets the previous aliases", func(t *testing.T) {
+		registry := &sparkplugRegistry{}
+		registry.observe("spBv1.0/g1/NBIRTH/n1", plantBirth)
+		registry.observe("spBv1.0/g1/NBIRTH/n1", encodeSparkplug(0, bdSeq(8)))
+		_, ok := registry.resolve(sparkplugTopic{group: "g1", node: "n1"}, 1)
+		require.False(t, ok)
+	})
+}
+
+func Test_framer_sparkplug_forceFloat(t *testing.T) {
+	f := newFramer(FrameOptions{Format: PayloadFormatSparkplug, ForceFloat: true}, topicPattern{})
+	frame, err := f.toFrame([]Message{{Topic: "spBv1.0/g1/NDATA/n1", Value: encodeSparkplug(1700000060000,
+		spMetric{name: "Count", datatype: sparkplugInt32, kind: sparkplugIntValue, value: uint64(uint32(0xfffffffb))},
+	)}}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, -5.0, *frame.Fields[1].At(0).(*float64))
+}
+
+func TestSparkplugMetric_value(t *testing.T) {
+	at := time.UnixMilli(1700000000000)
+	for _, tc := range []struct {
+		name     string
+		metric   sparkplugMetric
+		datatype uint32
+		want     interface{}
+	}{
+		{"int8", sparkplugMetric{kind: sparkplugIntValue, bits: 0xff}, sparkplugInt8, ptr(int64(-1))},
+		{"int16", sparkplugMetric{kind: sparkplugIntValue, bits: 0xfffe}, sparkplugInt16, ptr(int64(-2))},
+		{"int64", sparkplugMetric{kind: sparkplugLongValue, bits: math.MaxUint64}, sparkplugInt64, ptr(int64(-1))},
+		{"uint32", sparkplugMetric{kind: sparkplugIntValue, bits: math.MaxUint32}, sparkplugUInt32, ptr(int64(math.MaxUint32))},
+		{"uint64", sparkplugMetric{kind: sparkplugLongValue, bits: math.MaxUint64}, sparkplugUInt64, ptr(uint64(math.MaxUint64))},
+		{"datetime", sparkplugMetric{kind: sparkplugLongValue, bits: 1700000000000}, sparkplugDateTime, &at},
+		{"bytes", sparkplugMetric{kind: sparkplugBytesValue, bytes: []byte("hi")}, sparkplugBytes, ptr("aGk=")},
+		{"uuid", sparkplugMetric{kind: sparkplugStringValue, bytes: []byte("a-b")}, sparkplugUUID, ptr("a-b")},
+		{"inferred long", sparkplugMetric{kind: sparkplugLongValue, bits: 5}, 0, ptr(int64(5))},
+		{"inferred string", sparkplugMetric{kind: sparkplugStringValue, bytes: []byte("on")}, 0, ptr("on")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, v, ok := tc.metric.value(tc.datatype)
+			require.True(t, ok)
+			require.Equal(t, tc.want, v)
+		})
+	}
+
+	_, _, ok := sparkplugMetric{kind: sparkplugIntValue, isNull: true}.value(sparkplugInt32)
+	require.False(t, ok)
+	// Data sets and templates are not supported.
+	_, _, ok = sparkplugMetric{}.value(16)
+	require.False(t, ok)
+}
+
+func TestParseSparkplugTopic(t *testing.T) {
+	topic, ok := parseSparkplugTopic("spBv1.0/g1/DDATA/n1/pump")
+	require.True(t, ok)
+	require.Equal(t, sparkplugTopic{group: "g1", messageType: "DDATA", node: "n1", device: "pump"}, topic)
+
+	for _, name := range []string{
+		"spBv1.0/STATE/host",
+		"spBv1.0/g1/NDATA/n1/pump",
+		"spBv1.0/g1/DDATA/n1",
+		"spAv1.0/g1/NDATA/n1",
+		"spBv1.0/g1/NDATA/n1/pump/extra",
+	} {
+		_, ok := parseSparkplugTopic(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestFrameOptions_ValidateSparkplug(t *testing.T) {
+	require.NoError(t, FrameOptions{Format: PayloadFormatSparkplug, TopicMode: TopicModeLabel}.Validate())
+	require.ErrorContains(t, FrameOptions{Format: PayloadFormatSparkplug, TimeField: "$.time"}.Validate(), "Sparkplug B payloads cannot")
+	require.ErrorContains(t, FrameOptions{Format: PayloadFormatSparkplug, Explode: "$"}.Validate(), "Sparkplug B payloads cannot")
+}
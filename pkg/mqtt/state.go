@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// ConnectionState describes the connection to the broker.
+type ConnectionState int
+
+const (
+	// StateConnecting means no connection has been established yet, or the
+	// connection was lost and the client is reconnecting.
+	StateConnecting ConnectionState = iota
+	// StateConnected means the client is connected to the broker.
+	StateConnected
+	// StateFailed means the last connection attempt failed. The client keeps
+	// retrying in the background.
+	StateFailed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionStatus is a snapshot of the connection to the broker.
+type ConnectionStatus struct {
+	State ConnectionState
+	// Broker is the URI of the broker the client is connected to, with any
+	// password redacted. It is only set while connected.
+	Broker string
+	// LastError is the error of the last failed connection attempt or of the
+	// last lost connection. It is kept after reconnecting.
+	LastError error
+	// FailedSubscriptions maps the MQTT topics that could not be subscribed
+	// to again after reconnecting to the error returned by the broker.
+	FailedSubscriptions map[string]error
+}
+
+// connectionState tracks the connection status reported by a connection
+// and lets callers wait for the connection to come up.
+type connectionState struct {
+	mu      sync.Mutex
+	status  ConnectionStatus
+	changed chan struct{} // closed and replaced on every change
+
+	// onConnect is called in its own goroutine every time the connection
+	// comes up, as connection callbacks must not block.
+	onConnect func()
+}
+
+func newConnectionState() *connectionState {
+	return &connectionState{
+		changed: make(chan struct{}),
+	}
+}
+
+// set records a new state. A nil err keeps the previous error.
+func (s *connectionState) set(state ConnectionState, err error) {
+	s.update(state, "", err)
+}
+
+// connected records that the client connected to the given broker.
+func (s *connectionState) connected(broker *url.URL) {
+	redacted := ""
+	if broker != nil {
+		redacted = broker.Redacted()
+	}
+	s.update(StateConnected, redacted, nil)
+}
+
+func (s *connectionState) update(state ConnectionState, broker string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state == StateConnected && s.onConnect != nil {
+		go s.onConnect()
+	}
+
+	s.status.State = state
+	s.status.Broker = broker
+	if err != nil {
+		s.status.LastError = err
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *connectionState) get() ConnectionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// wait blocks until the state is StateConnected or ctx is done.
+func (s *connectionState) wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		connected := s.status.State == StateConnected
+		changed := s.changed
+		s.mu.Unlock()
+
+		if connected {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	// Time zones are loaded by name on any operating system.
+	_ "time/tzdata"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// TimeFormat is the format of the timestamps in the payload. Values other
+// than the constants below are Go time layouts, such as
+// "2006-01-02 15:04:05".
+type TimeFormat string
+
+const (
+	// TimeFormatAuto parses strings as RFC 3339 and numbers as Unix time in
+	// seconds, milliseconds, microseconds or nanoseconds, depending on their
+	// magnitude.
+	TimeFormatAuto TimeFormat = ""
+	// TimeFormatRFC3339 parses RFC 3339 strings, with or without fractional
+	// seconds.
+	TimeFormatRFC3339 TimeFormat = "rfc3339"
+	// TimeFormatUnix parses Unix time in seconds.
+	TimeFormatUnix TimeFormat = "unix"
+	// TimeFormatUnixMs parses Unix time in milliseconds.
+	TimeFormatUnixMs TimeFormat = "unix_ms"
+	// TimeFormatUnixUs parses Unix time in microseconds.
+	TimeFormatUnixUs TimeFormat = "unix_us"
+	// TimeFormatUnixNs parses Unix time in nanoseconds.
+	TimeFormatUnixNs TimeFormat = "unix_ns"
+)
+
+// unitNanos returns the number of nanoseconds per unit of the Unix time
+// formats, or 0 for other formats.
+func (f TimeFormat) unitNanos() float64 {
+	switch f {
+	case TimeFormatUnix:
+		return 1e9
+	case TimeFormatUnixMs:
+		return 1e6
+	case TimeFormatUnixUs:
+		return 1e3
+	case TimeFormatUnixNs:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// timestampParser reads the timestamp of a message from its payload.
+type timestampParser struct {
+	steps    []pathStep
+	format   TimeFormat
+	location *time.Location
+}
+
+// newTimestampParser returns the parser of the timestamps selected by the
+// options, or nil if the receive time is used.
+func newTimestampParser(o FrameOptions) (*timestampParser, error) {
+	if o.TimeField == "" {
+		return nil, nil
+	}
+	steps, err := parseJSONPath(o.TimeField)
+	if err != nil {
+		return nil, err
+	}
+	location := time.UTC
+	if o.TimeZone != "" {
+		location, err = time.LoadLocation(o.TimeZone)
+		if err != nil {
+			return nil, backend.DownstreamErrorf("invalid time zone %q: %w", o.TimeZone, err)
+		}
+	}
+	return &timestampParser{steps: steps, format: o.TimeFormat, location: location}, nil
+}
+
+// parse returns the timestamp in the payload. It reports false if the payload
+// has no timestamp or it cannot be parsed.
+func (p *timestampParser) parse(payload []byte) (time.Time, bool) {
+	it := jsoniter.ParseBytes(jsoniter.ConfigDefault, payload)
+	if !findValue(it, p.steps) {
+		return time.Time{}, false
+	}
+	switch it.WhatIsNext() {
+	case jsoniter.StringValue:
+		return p.parseString(it.ReadString())
+	case jsoniter.NumberValue:
+		return p.parseNumber(it.ReadNumber())
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (p *timestampParser) parseString(s string) (time.Time, bool) {
+	switch p.format {
+	case TimeFormatAuto:
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+		return p.parseNumber(json.Number(strings.TrimSpace(s)))
+	case TimeFormatRFC3339:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, err == nil
+	case TimeFormatUnix, TimeFormatUnixMs, TimeFormatUnixUs, TimeFormatUnixNs:
+		return p.parseNumber(json.Number(strings.TrimSpace(s)))
+	default:
+		t, err := time.ParseInLocation(string(p.format), s, p.location)
+		return t, err == nil
+	}
+}
+
+func (p *timestampParser) parseNumber(n json.Number) (time.Time, bool) {
+	unit := p.format.unitNanos()
+	if unit == 0 && p.format != TimeFormatAuto {
+		return time.Time{}, false
+	}
+
+	// Decimals are converted exactly, nanoseconds do not fit a float64.
+	whole, fraction, _ := strings.Cut(string(n), ".")
+	if i, err := strconv.ParseInt(whole, 10, 64); err == nil && !strings.ContainsAny(fraction, "eE+-") {
+		if unit == 0 {
+			unit = guessUnitNanos(math.Abs(float64(i)))
+		}
+		if i > math.MaxInt64/int64(unit)-1 || i < math.MinInt64/int64(unit)+1 {
+			return time.Time{}, false
+		}
+		nanos := i * int64(unit)
+		if fraction != "" {
+			f, err := strconv.ParseFloat("0."+fraction, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			if strings.HasPrefix(whole, "-") {
+				f = -f
+			}
+			nanos += int64(math.Round(f * unit))
+		}
+		return time.Unix(0, nanos), true
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	if unit == 0 {
+		unit = guessUnitNanos(math.Abs(f))
+	}
+	nanos := f * unit
+	if nanos > math.MaxInt64 || nanos < math.MinInt64 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(nanos)), true
+}
+
+// guessUnitNanos returns the unit of a Unix time: timestamps of the years
+// 1973 to 5138 in seconds are below 1e11, in milliseconds below 1e14 and in
+// microseconds below 1e17.
+func guessUnitNanos(v float64) float64 {
+	switch {
+	case v < 1e11:
+		return 1e9
+	case v < 1e14:
+		return 1e6
+	case v < 1e17:
+		return 1e3
+	default:
+		return 1
+	}
+}
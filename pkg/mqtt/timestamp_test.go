@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampParser(t *testing.T) {
+	want := time.Date(2024, 3, 1, 12, 30, 15, 250_000_000, time.UTC)
+	tests := []struct {
+		name    string
+		options FrameOptions
+		payload string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "RFC 3339", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":"2024-03-01T13:30:15.25+01:00"}`, want: want},
+		{name: "RFC 3339 format", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatRFC3339}, payload: `{"ts":"2024-03-01T12:30:15.25Z"}`, want: want},
+		{name: "seconds", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":1709296215.25}`, want: want},
+		{name: "milliseconds", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":1709296215250}`, want: want},
+		{name: "microseconds", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":1709296215250000}`, want: want},
+		{name: "nanoseconds", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":1709296215250000000}`, want: want},
+		{name: "numeric string", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":"1709296215250"}`, want: want},
+		{name: "unix format", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatUnix}, payload: `{"ts":"1709296215.25"}`, want: want},
+		{name: "unix ms format", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatUnixMs}, payload: `{"ts":1709296215250}`, want: want},
+		{name: "unix µs format", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatUnixUs}, payload: `{"ts":1709296215250000}`, want: want},
+		{name: "unix ns format", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatUnixNs}, payload: `{"ts":1709296215250000000}`, want: want},
+		{name: "nested path", options: FrameOptions{TimeField: "$.meta.times[1]"}, payload: `{"meta":{"times":[0,1709296215250]}}`, want: want},
+		{
+			name:    "layout in a time zone",
+			options: FrameOptions{TimeField: "ts", TimeFormat: "2006-01-02 15:04:05.000", TimeZone: "Europe/Berlin"},
+			payload: `{"ts":"2024-03-01 13:30:15.250"}`,
+			want:    want,
+		},
+		{name: "layout in UTC", options: FrameOptions{TimeField: "ts", TimeFormat: "02/01/2006 15:04:05.00"}, payload: `{"ts":"01/03/2024 12:30:15.25"}`, want: want},
+		{name: "missing", options: FrameOptions{TimeField: "ts"}, payload: `{"time":1709296215}`, wantErr: true},
+		{name: "not JSON", options: FrameOptions{TimeField: "ts"}, payload: `on`, wantErr: true},
+		{name: "invalid string", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":"yesterday"}`, wantErr: true},
+		{name: "number for a layout", options: FrameOptions{TimeField: "ts", TimeFormat: "2006-01-02"}, payload: `{"ts":1709296215}`, wantErr: true},
+		{name: "boolean", options: FrameOptions{TimeField: "ts"}, payload: `{"ts":true}`, wantErr: true},
+		{name: "overflow", options: FrameOptions{TimeField: "ts", TimeFormat: TimeFormatUnix}, payload: `{"ts":1e300}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTimestampParser(tt.options)
+			require.NoError(t, err)
+			got, ok := p.parse([]byte(tt.payload))
+			if tt.wantErr {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.True(t, tt.want.Equal(got), "want %s, got %s", tt.want, got)
+		})
+	}
+}
+
+func TestFrameOptions_ValidateTimestamp(t *testing.T) {
+	require.NoError(t, FrameOptions{TimeField: "$.ts", TimeZone: "America/New_York"}.Validate())
+	require.ErrorContains(t, FrameOptions{TimeField: "$..ts"}.Validate(), "invalid JSONPath")
+	require.ErrorContains(t, FrameOptions{TimeField: "ts", TimeZone: "Mars/Olympus"}.Validate(), "invalid time zone")
+}
+
+func Test_framer_timestamps(t *testing.T) {
+	received := time.Unix(2000, 0)
+	f := newFramer(FrameOptions{TimeField: "ts"}, topicPattern{})
+	frame, err := f.toFrame([]Message{
+		{Timestamp: received, Value: []byte(`{"ts":1000,"value":1}`)},
+		{Timestamp: received, Value: []byte(`{"ts":"soon","value":2}`)},
+		{Timestamp: received, Value: []byte(`3`)},
+	}, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, 3, frame.Rows())
+	require.True(t, time.Unix(1000, 0).Equal(frame.Fields[0].At(0).(time.Time)))
+	require.True(t, received.Equal(frame.Fields[0].At(1).(time.Time)))
+	require.True(t, received.Equal(frame.Fields[0].At(2).(time.Time)))
+	require.Len(t, frame.Meta.Notices, 2)
+	require.Contains(t, frame.Meta.Notices[0].Text, "1 value is null because its type did not match the type of its field: ts")
+	require.Contains(t, frame.Meta.Notices[1].Text, "2 rows have no valid timestamp at ts")
+}
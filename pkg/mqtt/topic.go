@@ -2,104 +2,363 @@ package mqtt
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 type Message struct {
 	Timestamp time.Time
-	Value     []byte
+	// Topic is the topic the message was published to. It differs from the
+	// subscribed topic when subscribing with wildcards.
+	Topic string
+	Value []byte
 }
 
 // Topic represents a MQTT topic.
 type Topic struct {
 	Path         string `json:"topic"`
 	StreamingKey string `json:"streamingKey,omitempty"`
+	QoS          byte   `json:"qos"`
 	Interval     time.Duration
-	Messages     []Message
-	framer       *framer
+	FrameOptions
+
+	pattern  topicPattern
+	messages *BufferReader
+	history  History
+	framer   *framer
+	// message is the protobuf message type of the payloads, resolved when
+	// the topic is subscribed.
+	message protoreflect.MessageDescriptor
+	// sparkplug holds the Sparkplug B births received by the client.
+	sparkplug *sparkplugRegistry
+	// historyEnd is the receive time of the last message sent from the
+	// history. Drained messages up to it were sent already.
+	historyEnd time.Time
 }
 
 // Key returns the key for the topic.
-// The key is a combination of the interval string, the path, and the streaming key.
-// For example, if the path is "my/topic" and the interval is 1s, the key will be "1s/my/topic/streamingkey".
+// The key is a combination of the interval string, the QoS, the path, and the streaming key.
+// For example, if the path is "my/topic", the interval is 1s and the QoS is 1, the key will be "1s/1/my/topic/streamingkey".
 func (t *Topic) Key() string {
-	return path.Join(t.Interval.String(), t.Path, t.StreamingKey)
+	return path.Join(t.Interval.String(), strconv.Itoa(int(t.QoS)), t.Path, t.StreamingKey)
 }
 
-// ToDataFrame converts the topic to a data frame.
+// Drain returns the messages received since the previous drain and the
+// number of messages dropped in between because the buffer was full. A topic
+// that is not stored in a TopicMap has no messages.
+func (t *Topic) Drain() ([]Message, uint64) {
+	if t.messages == nil {
+		return nil, 0
+	}
+	return t.messages.Drain()
+}
+
+// ToDataFrame drains the buffered messages and converts them to a data frame.
+// Messages dropped because the buffer was full are reported as a notice.
 func (t *Topic) ToDataFrame(logger log.Logger) (*data.Frame, error) {
+	messages, dropped := t.Drain()
+	if !t.historyEnd.IsZero() {
+		messages = t.skipHistory(messages)
+	}
+	frame, err := t.toFrame(messages, logger)
+	if err != nil {
+		return nil, err
+	}
+	if dropped > 0 {
+		logger.Warn("Dropped MQTT messages, the topic buffer is full", "topic", t.Path, "dropped", dropped)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d messages were dropped because the buffer for this topic is full", dropped),
+		})
+	}
+	return frame, nil
+}
+
+// HistoryFrame returns a data frame with the messages received between from
+// and to, also before the topic was subscribed. Later frames continue with
+// the messages received after the last one of the history frame. Topics
+// without history return an empty frame.
+func (t *Topic) HistoryFrame(from, to time.Time, logger log.Logger) (*data.Frame, error) {
+	var messages []Message
+	if t.history != nil {
+		var err error
+		messages, err = t.history.Range(from, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(messages) > 0 {
+		t.historyEnd = messages[len(messages)-1].Timestamp
+	}
+	return t.toFrame(messages, logger)
+}
+
+// skipHistory drops the messages that were sent with the history frame
+// already. Messages are buffered in the order they were received, so only
+// the first drains after the history frame contain such messages.
+func (t *Topic) skipHistory(messages []Message) []Message {
+	for i, m := range messages {
+		if m.Timestamp.After(t.historyEnd) {
+			t.historyEnd = time.Time{}
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
+// toFrame converts the messages to a data frame using the topic's options.
+func (t *Topic) toFrame(messages []Message, logger log.Logger) (*data.Frame, error) {
 	if t.framer == nil {
-		t.framer = newFramer()
+		t.framer = t.newFramer(t.FrameOptions)
+	}
+	return t.framer.toFrame(messages, logger)
+}
+
+// newFramer returns a framer for the messages of the topic.
+func (t *Topic) newFramer(options FrameOptions) *framer {
+	df := newFramer(options, t.pattern)
+	df.message = t.message
+	df.sparkplug = t.sparkplug
+	return df
+}
+
+// toFrames converts the messages to data frames. In TopicModeFrame every
+// topic gets its own frame, named after the topic.
+func (t *Topic) toFrames(messages []Message, logger log.Logger) (data.Frames, error) {
+	if t.TopicMode != TopicModeFrame || len(messages) == 0 {
+		frame, err := t.toFrame(messages, logger)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{frame}, nil
+	}
+
+	var topics []string
+	byTopic := make(map[string][]Message)
+	for _, m := range messages {
+		if _, ok := byTopic[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		byTopic[m.Topic] = append(byTopic[m.Topic], m)
+	}
+
+	options := t.FrameOptions
+	options.TopicMode = TopicModeNone
+	frames := make(data.Frames, 0, len(topics))
+	for _, topic := range topics {
+		frame, err := t.newFramer(options).toFrame(byTopic[topic], logger)
+		if err != nil {
+			return nil, err
+		}
+		frame.Name = topic
+		frames = append(frames, frame)
 	}
-	return t.framer.toFrame(t.Messages, logger)
+	return frames, nil
 }
 
-// TopicMap is a thread-safe map of topics
+// TopicMap is a thread-safe registry of the subscribed topics. Topics are
+// indexed by their MQTT topic path, and all topics with the same path share
+// one message buffer, so an incoming message is stored once no matter how
+// many panels subscribed to it.
+//
+// When HistoryDuration is set, every path also keeps the messages received
+// within that duration, up to HistorySize messages. When HistoryDir is set,
+// the history is stored on disk in a directory per path instead, up to
+// HistoryMaxBytes bytes per path, so it survives restarts. Paths with history
+// are kept after their last topic is deleted, until they are released.
+//
+// The zero value is an empty registry using DefaultBufferSize and DropOldest,
+// without history.
 type TopicMap struct {
-	sync.Map
+	BufferSize      int
+	BufferOverflow  OverflowPolicy
+	HistoryDuration time.Duration
+	HistorySize     int
+	HistoryDir      string
+	HistoryMaxBytes int64
+
+	mu     sync.RWMutex
+	topics map[string]*Topic       // by topic key
+	paths  map[string]*topicBuffer // by MQTT topic path
+}
+
+// topicBuffer is the buffer shared by all topics with the same path.
+type topicBuffer struct {
+	buffer  *MessageBuffer
+	latest  *latestMessages
+	history History // nil without history
+	topics  int
 }
 
 // Load returns the topic for the given topic key.
 func (tm *TopicMap) Load(key string) (*Topic, bool) {
-	t, ok := tm.Map.Load(key)
-	if !ok {
-		return nil, false
-	}
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	t, ok := tm.topics[key]
+	return t, ok
+}
 
-	topic, ok := t.(*Topic)
-	return topic, ok
+// Len returns the number of stored topics.
+func (tm *TopicMap) Len() int {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return len(tm.topics)
 }
 
-// AddMessage adds a message to the topic for the given path.
+// AddMessage adds a message to the buffer of the given path.
 func (tm *TopicMap) AddMessage(path string, message Message) {
-	tm.Range(func(key, t any) bool {
-		topic, ok := t.(*Topic)
-		if !ok {
-			return false
-		}
-		if topic.Path == path {
-			topic.Messages = append(topic.Messages, message)
-			tm.Store(topic)
+	tm.mu.RLock()
+	tb, ok := tm.paths[path]
+	tm.mu.RUnlock()
+
+	if ok {
+		tb.buffer.Add(message)
+		tb.latest.add(message)
+		if tb.history != nil {
+			tb.history.Add(message)
 		}
-		return true
-	})
+	}
+}
+
+// latest returns the latest messages cache of the given path.
+func (tm *TopicMap) latest(path string) (*latestMessages, bool) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	tb, ok := tm.paths[path]
+	if !ok {
+		return nil, false
+	}
+	return tb.latest, true
 }
 
 // HasSubscription returns true if the topic map has a subscription for the given path.
 func (tm *TopicMap) HasSubscription(path string) bool {
-	found := false
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	tb, ok := tm.paths[path]
+	return ok && tb.topics > 0
+}
+
+// Release drops the buffers and history of the given path unless a topic
+// uses them, and reports whether the path is gone.
+func (tm *TopicMap) Release(path string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tb, ok := tm.paths[path]
+	if !ok {
+		return true
+	}
+	if tb.topics > 0 {
+		return false
+	}
+	delete(tm.paths, path)
+	if tb.history != nil {
+		if err := tb.history.Close(); err != nil {
+			log.DefaultLogger.Error("Failed to close MQTT message history", "path", path, "error", err)
+		}
+	}
+	return true
+}
+
+// Close closes the histories of all paths.
+func (tm *TopicMap) Close() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-	tm.Range(func(key, t any) bool {
-		topic, ok := t.(*Topic)
-		if !ok {
-			return true // this shouldn't happen, but continue iterating
+	var errs []error
+	for _, tb := range tm.paths {
+		if tb.history != nil {
+			errs = append(errs, tb.history.Close())
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		if topic.Path == path {
-			found = true
-			return false // topic found, stop iterating
+// newHistory returns the history of the given path, stored on disk when
+// HistoryDir is set. A history that cannot be opened on disk is kept in
+// memory.
+func (tm *TopicMap) newHistory(path string) History {
+	if tm.HistoryDir != "" {
+		if !filepath.IsLocal(path) {
+			log.DefaultLogger.Error("Invalid MQTT topic path for a history on disk, keeping it in memory", "path", path)
+		} else if h, err := openDiskHistory(filepath.Join(tm.HistoryDir, path), tm.HistoryDuration, tm.HistoryMaxBytes); err != nil {
+			log.DefaultLogger.Error("Failed to open MQTT message history on disk, keeping it in memory", "path", path, "error", err)
+		} else {
+			return h
 		}
+	}
+	return newMemoryHistory(tm.HistoryDuration, tm.HistorySize)
+}
+
+// Store stores the topic under the given key and attaches it to the buffer
+// of its path. A topic already stored under the key is replaced.
+func (tm *TopicMap) Store(key string, t *Topic) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-		return true // continue iterating
-	})
+	if tm.topics == nil {
+		tm.topics = make(map[string]*Topic)
+		tm.paths = make(map[string]*topicBuffer)
+	}
+	if existing, ok := tm.topics[key]; ok {
+		tm.detach(existing)
+	}
 
-	return found
+	tb, ok := tm.paths[t.Path]
+	if !ok {
+		tb = &topicBuffer{
+			buffer: NewMessageBuffer(tm.BufferSize, tm.BufferOverflow),
+			latest: newLatestMessages(tm.BufferSize),
+		}
+		if tm.HistoryDuration > 0 {
+			tb.history = tm.newHistory(t.Path)
+		}
+		tm.paths[t.Path] = tb
+	}
+	tb.topics++
+	t.messages = tb.buffer.NewReader()
+	t.history = tb.history
+	tm.topics[key] = t
 }
 
-// Store stores the topic in the map.
-func (tm *TopicMap) Store(t *Topic) {
-	tm.Map.Store(t.Key(), t)
+// Delete deletes the topic for the given key and returns it.
+func (tm *TopicMap) Delete(key string) (*Topic, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	t, ok := tm.topics[key]
+	if !ok {
+		return nil, false
+	}
+	delete(tm.topics, key)
+	tm.detach(t)
+	return t, true
 }
 
-// Delete deletes the topic for the given key.
-func (tm *TopicMap) Delete(key string) {
-	tm.Map.Delete(key)
+// detach detaches the topic from the buffer of its path and drops the
+// buffer once no topic uses it anymore. Paths with history are kept until
+// they are released.
+func (tm *TopicMap) detach(t *Topic) {
+	t.messages.Close()
+
+	tb := tm.paths[t.Path]
+	if tb.topics--; tb.topics == 0 && tb.history == nil {
+		delete(tm.paths, t.Path)
+	}
 }
 
 // decodeTopic decodes an MQTT topic name from base64 URL encoding.
@@ -1,8 +1,12 @@
 package mqtt
 
 import (
+	"fmt"
 	"testing"
 	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTopic_Key(t *testing.T) {
@@ -17,7 +21,7 @@ func TestTopic_Key(t *testing.T) {
 				Path:     "sensor/temperature",
 				Interval: 1 * time.Second,
 			},
-			expectedKey: "1s/sensor/temperature",
+			expectedKey: "1s/0/sensor/temperature",
 		},
 		{
 			name: "topic with streaming key",
@@ -26,7 +30,7 @@ func TestTopic_Key(t *testing.T) {
 				Interval:     1 * time.Second,
 				StreamingKey: "ds123/abc456def/789",
 			},
-			expectedKey: "1s/sensor/temperature/ds123/abc456def/789",
+			expectedKey: "1s/0/sensor/temperature/ds123/abc456def/789",
 		},
 		{
 			name: "topic with complex path and streaming key",
@@ -35,7 +39,7 @@ func TestTopic_Key(t *testing.T) {
 				Interval:     5 * time.Second,
 				StreamingKey: "datasource-uid/hash123/456",
 			},
-			expectedKey: "5s/building/floor1/room2/sensor/temp/datasource-uid/hash123/456",
+			expectedKey: "5s/0/building/floor1/room2/sensor/temp/datasource-uid/hash123/456",
 		},
 		{
 			name: "topic with empty streaming key",
@@ -44,7 +48,16 @@ func TestTopic_Key(t *testing.T) {
 				Interval:     10 * time.Second,
 				StreamingKey: "",
 			},
-			expectedKey: "10s/simple/topic",
+			expectedKey: "10s/0/simple/topic",
+		},
+		{
+			name: "topic with QoS",
+			topic: Topic{
+				Path:     "sensor/temperature",
+				Interval: 1 * time.Second,
+				QoS:      2,
+			},
+			expectedKey: "1s/2/sensor/temperature",
 		},
 	}
 
@@ -90,7 +103,7 @@ func TestTopic_KeyUniqueness(t *testing.T) {
 	}
 
 	// Verify the actual key format
-	expectedKey1 := "1s/sensor/temp/user1/hash123/org456"
+	expectedKey1 := "1s/0/sensor/temp/user1/hash123/org456"
 	if key1 != expectedKey1 {
 		t.Errorf("Topic1.Key() = %v, want %v", key1, expectedKey1)
 	}
@@ -112,8 +125,8 @@ func TestTopicMap_Store_And_Load_WithStreamingKey(t *testing.T) {
 	}
 
 	// Store both topics
-	tm.Store(topic1)
-	tm.Store(topic2)
+	tm.Store(topic1.Key(), topic1)
+	tm.Store(topic2.Key(), topic2)
 
 	// Load topic1
 	loadedTopic1, found1 := tm.Load(topic1.Key())
@@ -146,18 +159,16 @@ func TestTopicMap_AddMessage_WithStreamingKey(t *testing.T) {
 		Path:         "sensor/temp",
 		Interval:     1 * time.Second,
 		StreamingKey: "user1/hash123/org456",
-		Messages:     []Message{},
 	}
 
 	topic2 := &Topic{
 		Path:         "sensor/temp", // Same MQTT path
 		Interval:     1 * time.Second,
 		StreamingKey: "user2/hash456/org456", // Different streaming key
-		Messages:     []Message{},
 	}
 
-	tm.Store(topic1)
-	tm.Store(topic2)
+	tm.Store(topic1.Key(), topic1)
+	tm.Store(topic2.Key(), topic2)
 
 	// Add message - should go to both topics since they have the same MQTT path
 	message := Message{
@@ -171,10 +182,238 @@ func TestTopicMap_AddMessage_WithStreamingKey(t *testing.T) {
 	updatedTopic1, _ := tm.Load(topic1.Key())
 	updatedTopic2, _ := tm.Load(topic2.Key())
 
-	if len(updatedTopic1.Messages) != 1 {
-		t.Errorf("Expected 1 message in topic1, got %d", len(updatedTopic1.Messages))
+	messages1, _ := updatedTopic1.Drain()
+	messages2, _ := updatedTopic2.Drain()
+	if len(messages1) != 1 {
+		t.Errorf("Expected 1 message in topic1, got %d", len(messages1))
+	}
+	if len(messages2) != 1 {
+		t.Errorf("Expected 1 message in topic2, got %d", len(messages2))
+	}
+}
+
+func TestTopic_ToDataFrame_DroppedMessages(t *testing.T) {
+	tm := &TopicMap{BufferSize: 2, BufferOverflow: DropOldest}
+	topic := &Topic{
+		Path:     "sensor/temp",
+		Interval: 1 * time.Second,
+	}
+	tm.Store(topic.Key(), topic)
+	for _, v := range []string{"1", "2", "3"} {
+		tm.AddMessage("sensor/temp", Message{Timestamp: time.Now(), Value: []byte(v)})
+	}
+
+	frame, err := topic.ToDataFrame(log.DefaultLogger)
+	if err != nil {
+		t.Fatalf("ToDataFrame failed: %v", err)
+	}
+	if frame.Rows() != 2 {
+		t.Errorf("Expected 2 rows, got %d", frame.Rows())
+	}
+	if frame.Meta == nil || len(frame.Meta.Notices) != 1 {
+		t.Fatalf("Expected a notice about dropped messages, got %+v", frame.Meta)
+	}
+	if frame.Meta.Notices[0].Text != "1 messages were dropped because the buffer for this topic is full" {
+		t.Errorf("Unexpected notice %q", frame.Meta.Notices[0].Text)
+	}
+
+	// the buffer is drained and nothing was dropped since
+	frame, err = topic.ToDataFrame(log.DefaultLogger)
+	if err != nil {
+		t.Fatalf("ToDataFrame failed: %v", err)
+	}
+	if frame.Rows() != 0 {
+		t.Errorf("Expected 0 rows, got %d", frame.Rows())
+	}
+	if frame.Meta != nil && len(frame.Meta.Notices) != 0 {
+		t.Errorf("Expected no notices, got %+v", frame.Meta.Notices)
+	}
+}
+
+func TestTopicMap_Delete(t *testing.T) {
+	tm := &TopicMap{}
+
+	topic1 := &Topic{Path: "sensor/temp", Interval: time.Second, StreamingKey: "user1/hash123/org456"}
+	topic2 := &Topic{Path: "sensor/temp", Interval: time.Minute, StreamingKey: "user2/hash456/org456"}
+	tm.Store("1s/0/sensor/temp/user1/hash123/org456", topic1)
+	tm.Store("1m/0/sensor/temp/user2/hash456/org456", topic2)
+
+	// topics are deleted by the key they were stored with, even if it differs from Key()
+	deleted, ok := tm.Delete("1m/0/sensor/temp/user2/hash456/org456")
+	if !ok || deleted != topic2 {
+		t.Fatalf("Expected topic2 to be deleted, got %v", deleted)
+	}
+	if !tm.HasSubscription("sensor/temp") {
+		t.Error("Expected the path to be subscribed while topic1 is stored")
+	}
+
+	if _, ok := tm.Delete("1m/0/sensor/temp/user2/hash456/org456"); ok {
+		t.Error("Expected deleting a topic twice to fail")
+	}
+
+	tm.Delete("1s/0/sensor/temp/user1/hash123/org456")
+	if tm.HasSubscription("sensor/temp") {
+		t.Error("Expected the path not to be subscribed after deleting all topics")
+	}
+	if tm.Len() != 0 {
+		t.Errorf("Expected no topics, got %d", tm.Len())
+	}
+}
+
+// benchmarkTopicMap stores the given number of topics spread evenly over
+// the given number of MQTT topic paths and adds messages to all paths.
+func benchmarkTopicMap(b *testing.B, subscriptions, paths int) {
+	tm := &TopicMap{}
+	pathNames := make([]string, paths)
+	for i := range pathNames {
+		pathNames[i] = fmt.Sprintf("sensor/%d", i)
+	}
+	topics := make([]*Topic, 0, subscriptions)
+	for i := 0; i < subscriptions; i++ {
+		t := &Topic{
+			Path:         pathNames[i%paths],
+			Interval:     time.Second,
+			StreamingKey: fmt.Sprintf("ds/%d/1", i),
+		}
+		tm.Store(t.Key(), t)
+		topics = append(topics, t)
+	}
+	message := Message{Timestamp: time.Now(), Value: []byte(`{"temperature":21.5}`)}
+
+	// Drain in the background like the streams do on every tick, so the
+	// buffers do not just overflow.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, t := range topics {
+					t.Drain()
+				}
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			tm.AddMessage(pathNames[i%paths], message)
+			i++
+		}
+	})
+}
+
+func BenchmarkTopicMap_AddMessage_10kSubscriptions_10kPaths(b *testing.B) {
+	benchmarkTopicMap(b, 10000, 10000)
+}
+
+func BenchmarkTopicMap_AddMessage_10kSubscriptions_100Paths(b *testing.B) {
+	benchmarkTopicMap(b, 10000, 100)
+}
+
+func BenchmarkTopicMap_AddMessage_10kSubscriptions_1Path(b *testing.B) {
+	benchmarkTopicMap(b, 10000, 1)
+}
+
+func BenchmarkTopicMap_HasSubscription_10kSubscriptions(b *testing.B) {
+	tm := &TopicMap{}
+	for i := 0; i < 10000; i++ {
+		t := &Topic{Path: fmt.Sprintf("sensor/%d", i), Interval: time.Second}
+		tm.Store(t.Key(), t)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tm.HasSubscription("sensor/9999")
 	}
-	if len(updatedTopic2.Messages) != 1 {
-		t.Errorf("Expected 1 message in topic2, got %d", len(updatedTopic2.Messages))
+}
+
+func TestTopicMap_History(t *testing.T) {
+	tm := TopicMap{HistoryDuration: time.Hour}
+	now := time.Now()
+	message := func(offset time.Duration, value string) Message {
+		return Message{Timestamp: now.Add(offset), Value: []byte(value)}
 	}
+
+	first := &Topic{Path: "sensor/temp"}
+	tm.Store("first", first)
+	tm.AddMessage("sensor/temp", message(-2*time.Minute, "1"))
+	tm.AddMessage("sensor/temp", message(-time.Minute, "2"))
+
+	t.Run("new topics start with the history", func(t *testing.T) {
+		second := &Topic{Path: "sensor/temp"}
+		tm.Store("second", second)
+		// Received after subscribing, but before the history was read.
+		tm.AddMessage("sensor/temp", message(-time.Second, "3"))
+
+		frame, err := second.HistoryFrame(now.Add(-time.Hour), now, log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 3, frame.Rows())
+
+		tm.AddMessage("sensor/temp", message(0, "4"))
+		frame, err = second.ToDataFrame(log.DefaultLogger)
+		require.NoError(t, err)
+		require.Equal(t, 1, frame.Rows())
+		require.Equal(t, int64(4), *frame.Fields[1].At(0).(*int64))
+
+		tm.Delete("second")
+	})
+
+	t.Run("paths with history are kept until released", func(t *testing.T) {
+		tm.Delete("first")
+		require.False(t, tm.HasSubscription("sensor/temp"))
+
+		tm.AddMessage("sensor/temp", message(time.Second, "5"))
+		third := &Topic{Path: "sensor/temp"}
+		tm.Store("third", third)
+		require.False(t, tm.Release("sensor/temp"))
+
+		messages, err := third.history.Range(now.Add(-time.Hour), now.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", "2", "3", "4", "5"}, bufferedValues(messages))
+
+		tm.Delete("third")
+		require.True(t, tm.Release("sensor/temp"))
+		tm.AddMessage("sensor/temp", message(2*time.Second, "6"))
+		require.True(t, tm.Release("sensor/temp"))
+	})
+}
+
+func TestTopicMap_DiskHistory(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	path := "c2Vuc29yL3RlbXA"
+
+	tm := &TopicMap{HistoryDuration: time.Hour, HistoryDir: dir}
+	tm.Store("first", &Topic{Path: path})
+	tm.AddMessage(path, Message{Timestamp: now.Add(-time.Minute), Value: []byte("1")})
+	tm.AddMessage(path, Message{Timestamp: now, Value: []byte("2")})
+	require.NoError(t, tm.Close())
+
+	// A new registry, as after a restart, finds the messages on disk.
+	tm = &TopicMap{HistoryDuration: time.Hour, HistoryDir: dir}
+	topic := &Topic{Path: path}
+	tm.Store("first", topic)
+	_, ok := topic.history.(*diskHistory)
+	require.True(t, ok)
+
+	frame, err := topic.HistoryFrame(now.Add(-time.Hour), now, log.DefaultLogger)
+	require.NoError(t, err)
+	require.Equal(t, 2, frame.Rows())
+	require.NoError(t, tm.Close())
+
+	t.Run("paths that are no directory names are kept in memory", func(t *testing.T) {
+		topic := &Topic{Path: "../sensor"}
+		tm.Store("second", topic)
+		_, ok := topic.history.(*memoryHistory)
+		require.True(t, ok)
+	})
 }
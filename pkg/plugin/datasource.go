@@ -3,10 +3,18 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 )
 
@@ -38,6 +46,27 @@ func NewMQTTInstance(ctx context.Context, s backend.DataSourceInstanceSettings)
 type MQTTDatasource struct {
 	Client        mqtt.Client
 	channelPrefix string
+
+	// streams holds the options of the queries by topic key. Grafana Live
+	// only passes the channel path to RunStream, so they are recorded when
+	// the query returns the channel, until the stream stops. The streaming
+	// key hashes the frame options, so queries with different options use
+	// different keys.
+	streamsMu sync.RWMutex
+	streams   map[string]streamOptions
+	// generation numbers the options recorded, so a stream stopping does
+	// not forget the options a query recorded again in the meantime.
+	generation uint64
+}
+
+// streamOptions are the options of the query a stream was started for.
+type streamOptions struct {
+	frame mqtt.FrameOptions
+	// timeRange is the duration of the dashboard time range, sent from the
+	// history when the stream starts.
+	timeRange time.Duration
+
+	generation uint64
 }
 
 // NewMQTTDatasource creates a new datasource instance.
@@ -48,6 +77,37 @@ func NewMQTTDatasource(client mqtt.Client, uid string) *MQTTDatasource {
 	}
 }
 
+func (ds *MQTTDatasource) setStreamOptions(topicKey string, options streamOptions) {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if ds.streams == nil {
+		ds.streams = make(map[string]streamOptions)
+	}
+	ds.generation++
+	options.generation = ds.generation
+	ds.streams[topicKey] = options
+}
+
+// deleteStreamOptions forgets the options of the topic key once its stream
+// stopped, unless a query recorded them again since the stream read them.
+func (ds *MQTTDatasource) deleteStreamOptions(topicKey string, options streamOptions) {
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if current, ok := ds.streams[topicKey]; ok && current.generation == options.generation {
+		delete(ds.streams, topicKey)
+	}
+}
+
+// getStreamOptions returns the options recorded for the topic key. After a
+// plugin restart Grafana resumes streams before the queries run again, so
+// it reports false for them until then.
+func (ds *MQTTDatasource) getStreamOptions(topicKey string) (streamOptions, bool) {
+	ds.streamsMu.RLock()
+	defer ds.streamsMu.RUnlock()
+	options, ok := ds.streams[topicKey]
+	return options, ok
+}
+
 // Dispose here tells plugin SDK that plugin wants to clean up resources
 // when a new instance created. As soon as datasource settings change detected
 // by SDK old datasource instance will be disposed and a new one will be created
@@ -79,5 +139,38 @@ func getDatasourceSettings(s backend.DataSourceInstanceSettings) (*mqtt.Options,
 		settings.TLSCACert = tlsCACert
 	}
 
+	if protoDescriptorSet, exists := s.DecryptedSecureJSONData["protoDescriptorSet"]; exists {
+		settings.ProtoDescriptorSet = protoDescriptorSet
+	}
+
+	if settings.HistoryStorage == mqtt.HistoryDisk {
+		dir, err := historyDir(s)
+		if err != nil {
+			log.DefaultLogger.Error("Keeping the MQTT message history in memory", "error", err)
+			settings.HistoryStorage = mqtt.HistoryMemory
+		}
+		settings.HistoryDir = dir
+	}
+
 	return settings, nil
 }
+
+// historyDir returns the absolute path of the directory the history of the
+// data source is stored in: a directory named after the data source in the
+// Grafana data directory. Grafana sets GF_PATHS_DATA for its plugins, without
+// it the data directory is unknown.
+func historyDir(s backend.DataSourceInstanceSettings) (string, error) {
+	dataDir := os.Getenv("GF_PATHS_DATA")
+	if dataDir == "" {
+		return "", errors.New("unknown Grafana data directory: GF_PATHS_DATA is not set")
+	}
+	dataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid Grafana data directory: %w", err)
+	}
+	name := s.UID
+	if name == "" || !filepath.IsLocal(name) || name != filepath.Base(name) {
+		name = strconv.FormatInt(s.ID, 10)
+	}
+	return filepath.Join(dataDir, "mqtt-datasource", name), nil
+}
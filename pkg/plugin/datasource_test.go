@@ -2,10 +2,14 @@ package plugin_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 	"github.com/grafana/mqtt-datasource/pkg/plugin"
 	"github.com/stretchr/testify/require"
@@ -14,7 +18,7 @@ import (
 func TestCheckHealthHandler(t *testing.T) {
 	t.Run("HealthStatusOK when can connect", func(t *testing.T) {
 		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
-			connected: true,
+			status: mqtt.ConnectionStatus{State: mqtt.StateConnected},
 		}, "xyz")
 
 		res, _ := ds.CheckHealth(
@@ -26,9 +30,46 @@ func TestCheckHealthHandler(t *testing.T) {
 		require.Equal(t, res.Message, "MQTT Connected")
 	})
 
+	t.Run("HealthStatusOK reports the broker node", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			status: mqtt.ConnectionStatus{
+				State:  mqtt.StateConnected,
+				Broker: "tcp://broker-2:1883",
+			},
+		}, "xyz")
+
+		res, _ := ds.CheckHealth(
+			context.Background(),
+			&backend.CheckHealthRequest{},
+		)
+
+		require.Equal(t, res.Status, backend.HealthStatusOk)
+		require.Equal(t, res.Message, "MQTT Connected to tcp://broker-2:1883")
+	})
+
+	t.Run("HealthStatusError when subscriptions could not be restored", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			status: mqtt.ConnectionStatus{
+				State: mqtt.StateConnected,
+				FailedSubscriptions: map[string]error{
+					"sensor/#":    errors.New("not authorized"),
+					"alarms/high": errors.New("quota exceeded"),
+				},
+			},
+		}, "xyz")
+
+		res, _ := ds.CheckHealth(
+			context.Background(),
+			&backend.CheckHealthRequest{},
+		)
+
+		require.Equal(t, res.Status, backend.HealthStatusError)
+		require.Equal(t, res.Message, "MQTT Connected, but restoring subscriptions failed: alarms/high (quota exceeded), sensor/# (not authorized)")
+	})
+
 	t.Run("HealthStatusError when disconnected", func(t *testing.T) {
 		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
-			connected: false,
+			status: mqtt.ConnectionStatus{State: mqtt.StateFailed},
 		}, "xyz")
 
 		res, _ := ds.CheckHealth(
@@ -39,10 +80,167 @@ func TestCheckHealthHandler(t *testing.T) {
 		require.Equal(t, res.Status, backend.HealthStatusError)
 		require.Equal(t, res.Message, "MQTT Disconnected")
 	})
+
+	t.Run("HealthStatusError with the last error when connecting failed", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			status: mqtt.ConnectionStatus{
+				State:     mqtt.StateFailed,
+				LastError: errors.New("connection refused"),
+			},
+		}, "xyz")
+
+		res, _ := ds.CheckHealth(
+			context.Background(),
+			&backend.CheckHealthRequest{},
+		)
+
+		require.Equal(t, res.Status, backend.HealthStatusError)
+		require.Equal(t, res.Message, "MQTT connection failed, retrying: connection refused")
+	})
+
+	t.Run("HealthStatusUnknown while connecting", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			status: mqtt.ConnectionStatus{State: mqtt.StateConnecting},
+		}, "xyz")
+
+		res, _ := ds.CheckHealth(
+			context.Background(),
+			&backend.CheckHealthRequest{},
+		)
+
+		require.Equal(t, res.Status, backend.HealthStatusUnknown)
+		require.Equal(t, res.Message, "MQTT Connecting")
+	})
+
+	t.Run("HealthStatusUnknown with the last error while reconnecting", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{
+			status: mqtt.ConnectionStatus{
+				State:     mqtt.StateConnecting,
+				LastError: errors.New("connection lost: EOF"),
+			},
+		}, "xyz")
+
+		res, _ := ds.CheckHealth(
+			context.Background(),
+			&backend.CheckHealthRequest{},
+		)
+
+		require.Equal(t, res.Status, backend.HealthStatusUnknown)
+		require.Equal(t, res.Message, "MQTT Connecting (last error: connection lost: EOF)")
+	})
+}
+
+func TestQueryData_Latest(t *testing.T) {
+	query := func(ds *plugin.MQTTDatasource, model map[string]any) backend.DataResponse {
+		queryJSON, err := json.Marshal(model)
+		require.NoError(t, err)
+		res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: queryJSON}},
+		})
+		require.NoError(t, err)
+		return res.Responses["A"]
+	}
+
+	t.Run("returns the latest messages", func(t *testing.T) {
+		client := &fakeMQTTClient{}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		res := query(ds, map[string]any{"topic": "dGVzdC90b3BpYw", "qos": 1, "mode": "latest", "topicMode": "field"})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Equal(t, "mqtt", res.Frames[0].Name)
+		require.Equal(t, "dGVzdC90b3BpYw", client.latestTopic.Path)
+		require.Equal(t, byte(1), client.latestTopic.QoS)
+		require.Equal(t, mqtt.TopicModeField, client.latestTopic.TopicMode)
+		require.Equal(t, 5*time.Second, client.latestTimeout)
+	})
+
+	t.Run("uses the query timeout", func(t *testing.T) {
+		client := &fakeMQTTClient{}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		res := query(ds, map[string]any{"topic": "dGVzdC90b3BpYw", "mode": "latest", "timeout": "500ms"})
+		require.NoError(t, res.Error)
+		require.Equal(t, 500*time.Millisecond, client.latestTimeout)
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{}, "xyz")
+
+		res := query(ds, map[string]any{"topic": "dGVzdC90b3BpYw", "mode": "latest", "timeout": "2h"})
+		require.ErrorContains(t, res.Error, "invalid timeout")
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		ds := plugin.NewMQTTDatasource(&fakeMQTTClient{}, "xyz")
+
+		res := query(ds, map[string]any{"topic": "dGVzdC90b3BpYw", "mode": "history"})
+		require.ErrorContains(t, res.Error, "invalid query mode")
+	})
+}
+
+func TestQueryData_Range(t *testing.T) {
+	to := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	from := to.Add(-time.Hour)
+	query := func(ds *plugin.MQTTDatasource, headers map[string]string, model map[string]any) backend.DataResponse {
+		queryJSON, err := json.Marshal(model)
+		require.NoError(t, err)
+		res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Headers: headers,
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      queryJSON,
+				TimeRange: backend.TimeRange{From: from, To: to},
+			}},
+		})
+		require.NoError(t, err)
+		return res.Responses["A"]
+	}
+
+	t.Run("returns the messages of the time range", func(t *testing.T) {
+		client := &fakeMQTTClient{}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		res := query(ds, nil, map[string]any{"topic": "dGVzdC90b3BpYw", "mode": "range"})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Equal(t, "range", res.Frames[0].Name)
+		require.Equal(t, "dGVzdC90b3BpYw", client.rangeTopic.Path)
+		require.Equal(t, from, client.rangeFrom)
+		require.Equal(t, to, client.rangeTo)
+	})
+
+	t.Run("alert queries use the time range", func(t *testing.T) {
+		client := &fakeMQTTClient{}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		res := query(ds, map[string]string{"FromAlert": "true"}, map[string]any{"topic": "dGVzdC90b3BpYw"})
+		require.NoError(t, res.Error)
+		require.Len(t, res.Frames, 1)
+		require.Equal(t, "range", res.Frames[0].Name)
+		require.Nil(t, res.Frames[0].Meta)
+	})
+
+	t.Run("alert queries keep the latest mode", func(t *testing.T) {
+		client := &fakeMQTTClient{}
+		ds := plugin.NewMQTTDatasource(client, "xyz")
+
+		res := query(ds, map[string]string{"FromAlert": "true"}, map[string]any{"topic": "dGVzdC90b3BpYw", "mode": "latest"})
+		require.NoError(t, res.Error)
+		require.Equal(t, "mqtt", res.Frames[0].Name)
+		require.Nil(t, client.rangeTopic)
+	})
 }
 
 type fakeMQTTClient struct {
-	connected bool
+	status mqtt.ConnectionStatus
+
+	// latestTopic and latestTimeout record the last call to Latest.
+	latestTopic   *mqtt.Topic
+	latestTimeout time.Duration
+	// rangeTopic, rangeFrom and rangeTo record the last call to Range.
+	rangeTopic         *mqtt.Topic
+	rangeFrom, rangeTo time.Time
 }
 
 func (c *fakeMQTTClient) GetTopic(_ string) (*mqtt.Topic, bool) {
@@ -50,9 +248,30 @@ func (c *fakeMQTTClient) GetTopic(_ string) (*mqtt.Topic, bool) {
 }
 
 func (c *fakeMQTTClient) IsConnected() bool {
-	return c.connected
+	return c.status.State == mqtt.StateConnected
+}
+
+func (c *fakeMQTTClient) Status() mqtt.ConnectionStatus {
+	return c.status
+}
+
+func (c *fakeMQTTClient) WaitConnected(_ context.Context) error { return nil }
+
+func (c *fakeMQTTClient) Subscribe(_ string, _ mqtt.FrameOptions, _ log.Logger) (*mqtt.Topic, error) {
+	return nil, nil
+}
+func (c *fakeMQTTClient) Latest(_ context.Context, t *mqtt.Topic, timeout time.Duration, _ log.Logger) (data.Frames, error) {
+	c.latestTopic = t
+	c.latestTimeout = timeout
+	return data.Frames{data.NewFrame("mqtt")}, nil
+}
+
+func (c *fakeMQTTClient) Range(_ context.Context, t *mqtt.Topic, from, to time.Time, timeout time.Duration, _ log.Logger) (data.Frames, error) {
+	c.rangeTopic = t
+	c.rangeFrom, c.rangeTo = from, to
+	c.latestTimeout = timeout
+	return data.Frames{data.NewFrame("range")}, nil
 }
 
-func (c *fakeMQTTClient) Subscribe(_ string, _ log.Logger) (*mqtt.Topic, error) { return nil, nil }
-func (c *fakeMQTTClient) Unsubscribe(_ string, _ log.Logger) error              { return nil }
-func (c *fakeMQTTClient) Dispose()                                              {}
+func (c *fakeMQTTClient) Unsubscribe(_ string, _ log.Logger) error { return nil }
+func (c *fakeMQTTClient) Dispose()                                 {}
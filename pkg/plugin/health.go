@@ -2,20 +2,66 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 )
 
 func (ds *MQTTDatasource) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	if !ds.Client.IsConnected() {
+	status := ds.Client.Status()
+
+	switch status.State {
+	case mqtt.StateConnected:
+		message := "MQTT Connected"
+		if status.Broker != "" {
+			message = "MQTT Connected to " + status.Broker
+		}
+		if len(status.FailedSubscriptions) > 0 {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: message + ", but restoring subscriptions failed: " + failedSubscriptions(status.FailedSubscriptions),
+			}, nil
+		}
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusOk,
+			Message: message,
+		}, nil
+	case mqtt.StateConnecting:
+		message := "MQTT Connecting"
+		if status.LastError != nil {
+			message = fmt.Sprintf("MQTT Connecting (last error: %s)", status.LastError)
+		}
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusUnknown,
+			Message: message,
+		}, nil
+	default:
+		message := "MQTT Disconnected"
+		if status.LastError != nil {
+			message = fmt.Sprintf("MQTT connection failed, retrying: %s", status.LastError)
+		}
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
-			Message: "MQTT Disconnected",
+			Message: message,
 		}, nil
 	}
+}
 
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "MQTT Connected",
-	}, nil
+// failedSubscriptions lists the failed subscriptions sorted by topic.
+func failedSubscriptions(failed map[string]error) string {
+	topics := make([]string, 0, len(failed))
+	for topic := range failed {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	msgs := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		msgs = append(msgs, fmt.Sprintf("%s (%s)", topic, failed[topic]))
+	}
+	return strings.Join(msgs, ", ")
 }
@@ -1,13 +1,17 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/stretchr/testify/require"
 )
 
 // Integration tests to verify end-to-end streaming key functionality
@@ -56,9 +60,9 @@ func TestStreamingKeyIntegration_TopicUniqueness(t *testing.T) {
 	}
 
 	// Process queries
-	resp1 := ds.query(query1)
-	resp2 := ds.query(query2)
-	resp3 := ds.query(query3)
+	resp1 := ds.query(context.Background(), query1, false)
+	resp2 := ds.query(context.Background(), query2, false)
+	resp3 := ds.query(context.Background(), query3, false)
 
 	// Verify no errors
 	if resp1.Error != nil {
@@ -88,17 +92,17 @@ func TestStreamingKeyIntegration_TopicUniqueness(t *testing.T) {
 	}
 
 	// Verify channel format
-	expectedChannel1 := "ds/test-uid/1s/sensor/temperature/user1/hash123/org456"
+	expectedChannel1 := "ds/test-uid/1s/0/sensor/temperature/user1/hash123/org456"
 	if channel1 != expectedChannel1 {
 		t.Errorf("Expected channel1 %s, got %s", expectedChannel1, channel1)
 	}
 
-	expectedChannel2 := "ds/test-uid/1s/sensor/temperature/user2/hash456/org456"
+	expectedChannel2 := "ds/test-uid/1s/0/sensor/temperature/user2/hash456/org456"
 	if channel2 != expectedChannel2 {
 		t.Errorf("Expected channel2 %s, got %s", expectedChannel2, channel2)
 	}
 
-	expectedChannel3 := "ds/test-uid/1s/sensor/temperature/user1/hash123/org789"
+	expectedChannel3 := "ds/test-uid/1s/0/sensor/temperature/user1/hash123/org789"
 	if channel3 != expectedChannel3 {
 		t.Errorf("Expected channel3 %s, got %s", expectedChannel3, channel3)
 	}
@@ -109,25 +113,25 @@ func TestStreamingKeyIntegration_ClientSubscription(t *testing.T) {
 
 	// Create mock client
 	client := &mockMQTTClient{
-		topics:        make(map[string]*mqtt.Topic),
+		topics:        &mqtt.TopicMap{},
 		subscriptions: make(map[string]bool),
 	}
 
 	// Topic keys that would come from the streaming system
-	topicKey1 := "1s/dGVzdC90b3BpYw/user1/hash123/org456"
-	topicKey2 := "1s/dGVzdC90b3BpYw/user2/hash456/org456"
-	topicKey3 := "1s/dGVzdC90b3BpYw/user1/hash123/org789"
+	topicKey1 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+	topicKey2 := "1s/0/dGVzdC90b3BpYw/user2/hash456/org456"
+	topicKey3 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org789"
 
 	// Subscribe to all three
-	topic1, err := client.Subscribe(topicKey1, log.DefaultLogger)
+	topic1, err := client.Subscribe(topicKey1, mqtt.FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic2, err := client.Subscribe(topicKey2, log.DefaultLogger)
+	topic2, err := client.Subscribe(topicKey2, mqtt.FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic3, err := client.Subscribe(topicKey3, log.DefaultLogger)
+	topic3, err := client.Subscribe(topicKey3, mqtt.FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -161,23 +165,24 @@ func TestStreamingKeyIntegration_ClientSubscription(t *testing.T) {
 	}
 }
 
-func TestStreamingKeyIntegration_MessageIsolation(t *testing.T) {
-	// Test that messages are properly isolated between different streaming keys
+func TestStreamingKeyIntegration_MessageSharing(t *testing.T) {
+	// Test that topics with the same MQTT path but different streaming keys
+	// each receive every message of the path
 
 	client := &mockMQTTClient{
-		topics:        make(map[string]*mqtt.Topic),
+		topics:        &mqtt.TopicMap{},
 		subscriptions: make(map[string]bool),
 	}
 
 	// Create topics with same MQTT path but different streaming keys
-	topicKey1 := "1s/dGVzdC90b3BpYw/user1/hash123/org456"
-	topicKey2 := "1s/dGVzdC90b3BpYw/user2/hash456/org456"
+	topicKey1 := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+	topicKey2 := "1s/0/dGVzdC90b3BpYw/user2/hash456/org456"
 
-	topic1, err := client.Subscribe(topicKey1, log.DefaultLogger)
+	topic1, err := client.Subscribe(topicKey1, mqtt.FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
-	topic2, err := client.Subscribe(topicKey2, log.DefaultLogger)
+	topic2, err := client.Subscribe(topicKey2, mqtt.FrameOptions{}, log.DefaultLogger)
 	if err != nil {
 		t.Fatalf("Subscribe failed: %v", err)
 	}
@@ -186,32 +191,28 @@ func TestStreamingKeyIntegration_MessageIsolation(t *testing.T) {
 		t.Fatal("Expected both topics to be created")
 	}
 
-	// Manually add messages to test isolation
-	// In real implementation, messages would be routed based on MQTT topic matching
-	topic1.Messages = append(topic1.Messages, mqtt.Message{
-		Timestamp: time.Now(),
-		Value:     []byte("message for user1"),
-	})
-
-	topic2.Messages = append(topic2.Messages, mqtt.Message{
-		Timestamp: time.Now(),
-		Value:     []byte("message for user2"),
-	})
+	client.HandleMessage("dGVzdC90b3BpYw", []byte("first"))
 
-	// Verify topics maintain separate message stores
-	if len(topic1.Messages) != 1 {
-		t.Errorf("Expected 1 message in topic1, got %d", len(topic1.Messages))
+	// topic1 drains before the second message arrives
+	messages1, _ := topic1.Drain()
+	if len(messages1) != 1 || string(messages1[0].Value) != "first" {
+		t.Errorf("Expected topic1 to receive 'first', got %v", messages1)
 	}
-	if len(topic2.Messages) != 1 {
-		t.Errorf("Expected 1 message in topic2, got %d", len(topic2.Messages))
+
+	client.HandleMessage("dGVzdC90b3BpYw", []byte("second"))
+
+	messages1, _ = topic1.Drain()
+	if len(messages1) != 1 || string(messages1[0].Value) != "second" {
+		t.Errorf("Expected topic1 to receive 'second', got %v", messages1)
 	}
 
-	// Verify message content
-	if string(topic1.Messages[0].Value) != "message for user1" {
-		t.Errorf("Expected 'message for user1', got '%s'", string(topic1.Messages[0].Value))
+	// topic2 drains independently and still receives both messages
+	messages2, _ := topic2.Drain()
+	if len(messages2) != 2 {
+		t.Fatalf("Expected 2 messages in topic2, got %d", len(messages2))
 	}
-	if string(topic2.Messages[0].Value) != "message for user2" {
-		t.Errorf("Expected 'message for user2', got '%s'", string(topic2.Messages[0].Value))
+	if string(messages2[0].Value) != "first" || string(messages2[1].Value) != "second" {
+		t.Errorf("Expected 'first' and 'second', got '%s' and '%s'", messages2[0].Value, messages2[1].Value)
 	}
 
 	// Verify topics are still separate instances
@@ -222,35 +223,42 @@ func TestStreamingKeyIntegration_MessageIsolation(t *testing.T) {
 
 // Mock MQTT client for integration testing
 type mockMQTTClient struct {
-	topics        map[string]*mqtt.Topic
+	topics        *mqtt.TopicMap
 	subscriptions map[string]bool
 }
 
 func (m *mockMQTTClient) GetTopic(reqPath string) (*mqtt.Topic, bool) {
-	topic, found := m.topics[reqPath]
-	return topic, found
+	return m.topics.Load(reqPath)
 }
 
 func (m *mockMQTTClient) IsConnected() bool {
 	return true
 }
 
-func (m *mockMQTTClient) Subscribe(reqPath string, logger log.Logger) (*mqtt.Topic, error) {
+func (m *mockMQTTClient) Status() mqtt.ConnectionStatus {
+	return mqtt.ConnectionStatus{State: mqtt.StateConnected}
+}
+
+func (m *mockMQTTClient) WaitConnected(_ context.Context) error {
+	return nil
+}
+
+func (m *mockMQTTClient) Subscribe(reqPath string, options mqtt.FrameOptions, logger log.Logger) (*mqtt.Topic, error) {
 	// Check if already exists
-	if topic, exists := m.topics[reqPath]; exists {
+	if topic, exists := m.topics.Load(reqPath); exists {
 		return topic, nil
 	}
 
 	// Parse the reqPath (simplified version)
 	// For testing, assume the encoded topic is "dGVzdC90b3BpYw" which decodes to "test/topic"
 	topic := &mqtt.Topic{
-		Path:     "dGVzdC90b3BpYw", // This would be the full path with streaming key
-		Interval: 1 * time.Second,
-		Messages: []mqtt.Message{},
+		Path:         "dGVzdC90b3BpYw",
+		Interval:     1 * time.Second,
+		FrameOptions: options,
 	}
 
 	// Store with reqPath as key
-	m.topics[reqPath] = topic
+	m.topics.Store(reqPath, topic)
 
 	// Simulate MQTT subscription (would normally decode the topic)
 	m.subscriptions["test/topic"] = true
@@ -258,13 +266,21 @@ func (m *mockMQTTClient) Subscribe(reqPath string, logger log.Logger) (*mqtt.Top
 	return topic, nil
 }
 
+func (m *mockMQTTClient) Latest(_ context.Context, _ *mqtt.Topic, _ time.Duration, _ log.Logger) (data.Frames, error) {
+	return data.Frames{data.NewFrame("mqtt")}, nil
+}
+
+func (m *mockMQTTClient) Range(_ context.Context, _ *mqtt.Topic, _, _ time.Time, _ time.Duration, _ log.Logger) (data.Frames, error) {
+	return data.Frames{data.NewFrame("mqtt")}, nil
+}
+
 func (m *mockMQTTClient) Unsubscribe(reqPath string, logger log.Logger) error {
-	delete(m.topics, reqPath)
+	m.topics.Delete(reqPath)
 	return nil
 }
 
 func (m *mockMQTTClient) Dispose() {
-	m.topics = make(map[string]*mqtt.Topic)
+	m.topics = &mqtt.TopicMap{}
 	m.subscriptions = make(map[string]bool)
 }
 
@@ -274,12 +290,135 @@ func (m *mockMQTTClient) HandleMessage(topicPath string, payload []byte) {
 		Value:     payload,
 	}
 
-	// Find topics that match this path and add message
-	for key, topic := range m.topics {
-		if topic.Path == topicPath {
-			topic.Messages = append(topic.Messages, message)
-			// Update the stored topic
-			m.topics[key] = topic
-		}
+	m.topics.AddMessage(topicPath, message)
+}
+
+// streamPackets collects the packets sent to a stream.
+type streamPackets struct {
+	mu      sync.Mutex
+	packets []string
+}
+
+func (s *streamPackets) Send(packet *backend.StreamPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packets = append(s.packets, string(packet.Data))
+	return nil
+}
+
+func (s *streamPackets) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.packets)
+}
+
+func (s *streamPackets) last() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.packets[len(s.packets)-1]
+}
+
+func TestStreamingKeyIntegration_StreamOptions(t *testing.T) {
+	ds := &MQTTDatasource{
+		channelPrefix: "ds/test-uid",
 	}
+
+	t.Run("options are recorded for the stream", func(t *testing.T) {
+		queryJSON, _ := json.Marshal(map[string]interface{}{
+			"topic":        "plant/+/temperature",
+			"topicMode":    "label",
+			"streamingKey": "user1/hash123/org456",
+		})
+		now := time.Now()
+		resp := ds.query(context.Background(), backend.DataQuery{
+			JSON:      queryJSON,
+			Interval:  time.Second,
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: now.Add(-time.Hour), To: now},
+		}, false)
+		if resp.Error != nil {
+			t.Fatalf("Query failed: %v", resp.Error)
+		}
+
+		options, _ := ds.getStreamOptions("1s/0/plant/+/temperature/user1/hash123/org456")
+		if options.frame.TopicMode != mqtt.TopicModeLabel {
+			t.Errorf("Expected topic mode %q, got %q", mqtt.TopicModeLabel, options.frame.TopicMode)
+		}
+		if options.timeRange != time.Hour {
+			t.Errorf("Expected time range %s, got %s", time.Hour, options.timeRange)
+		}
+	})
+
+	t.Run("options are forgotten when the stream stops", func(t *testing.T) {
+		client := &mockMQTTClient{topics: &mqtt.TopicMap{}, subscriptions: make(map[string]bool)}
+		ds := &MQTTDatasource{Client: client, channelPrefix: "ds/test-uid"}
+		topicKey := "1s/0/dGVzdC90b3BpYw/user1/hash123/org456"
+		runStream := func(ctx context.Context) chan error {
+			done := make(chan error, 1)
+			go func() {
+				done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "ds/test-uid/" + topicKey}, nil)
+			}()
+			require.Eventually(t, func() bool {
+				_, ok := client.GetTopic(topicKey)
+				return ok
+			}, time.Second, time.Millisecond)
+			return done
+		}
+
+		ds.setStreamOptions(topicKey, streamOptions{frame: mqtt.FrameOptions{TopicMode: mqtt.TopicModeLabel}})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := runStream(ctx)
+		// A query starting the stream again records the options while the
+		// stream stops.
+		ds.setStreamOptions(topicKey, streamOptions{frame: mqtt.FrameOptions{TopicMode: mqtt.TopicModeField}})
+		cancel()
+		require.NoError(t, <-done)
+		options, _ := ds.getStreamOptions(topicKey)
+		require.Equal(t, mqtt.TopicModeField, options.frame.TopicMode)
+
+		client.Unsubscribe(topicKey, log.DefaultLogger)
+		ctx, cancel = context.WithCancel(context.Background())
+		done = runStream(ctx)
+		cancel()
+		require.NoError(t, <-done)
+		require.Empty(t, ds.streams)
+	})
+
+	t.Run("unknown streams use the default options until the query runs", func(t *testing.T) {
+		client := &mockMQTTClient{topics: &mqtt.TopicMap{}, subscriptions: make(map[string]bool)}
+		ds := &MQTTDatasource{Client: client, channelPrefix: "ds/test-uid"}
+		topicKey := "10ms/0/dGVzdC90b3BpYw/user1/hash123/org456"
+		packets := &streamPackets{}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "ds/test-uid/" + topicKey}, backend.NewStreamSender(packets))
+		}()
+		require.Eventually(t, func() bool { return packets.count() > 0 }, time.Second, time.Millisecond)
+		require.Contains(t, packets.last(), unknownOptionsNotice.Text)
+
+		ds.setStreamOptions(topicKey, streamOptions{frame: mqtt.FrameOptions{TopicMode: mqtt.TopicModeLabel}})
+		require.Eventually(t, func() bool {
+			topic, ok := client.GetTopic(topicKey)
+			return ok && topic.TopicMode == mqtt.TopicModeLabel
+		}, time.Second, time.Millisecond)
+		sent := packets.count()
+		require.Eventually(t, func() bool { return packets.count() > sent }, time.Second, time.Millisecond)
+		require.NotContains(t, packets.last(), unknownOptionsNotice.Text)
+
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	t.Run("invalid topic mode", func(t *testing.T) {
+		queryJSON, _ := json.Marshal(map[string]interface{}{
+			"topic":     "plant/+/temperature",
+			"topicMode": "columns",
+		})
+		resp := ds.query(context.Background(), backend.DataQuery{JSON: queryJSON, Interval: time.Second, RefID: "A"}, false)
+		if resp.Error == nil {
+			t.Error("Expected an error for an invalid topic mode")
+		}
+	})
 }
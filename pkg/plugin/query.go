@@ -4,39 +4,111 @@ import (
 	"context"
 	"encoding/json"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 
 	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 )
 
-func (ds *MQTTDatasource) QueryData(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+const (
+	// queryModeStream returns a Grafana Live channel streaming the messages.
+	// It is the default.
+	queryModeStream = "stream"
+	// queryModeLatest returns the retained or latest message of every topic.
+	queryModeLatest = "latest"
+	// queryModeRange returns the messages of the query time range from the
+	// topic history. Alert rules cannot stream, so they use it for stream
+	// queries.
+	queryModeRange = "range"
+)
+
+// fromAlertHeader is set by Grafana on queries evaluated by alert rules.
+const fromAlertHeader = "FromAlert"
+
+const (
+	defaultLatestTimeout = 5 * time.Second
+	maxLatestTimeout     = time.Minute
+)
+
+type queryModel struct {
+	mqtt.Topic
+	Mode string `json:"mode,omitempty"`
+	// Timeout is how long latest and range queries wait for messages, as a
+	// duration such as "5s".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func (ds *MQTTDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	response := backend.NewQueryDataResponse()
 
+	fromAlert := req.Headers[fromAlertHeader] == "true"
+
+	// Latest queries wait for messages, so the queries run concurrently.
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
 	for _, q := range req.Queries {
-		res := ds.query(q)
-		response.Responses[q.RefID] = res
+		wg.Add(1)
+		go func(q backend.DataQuery) {
+			defer wg.Done()
+			res := ds.query(ctx, q, fromAlert)
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Responses[q.RefID] = res
+		}(q)
 	}
+	wg.Wait()
 
 	return response, nil
 }
 
-func (ds *MQTTDatasource) query(query backend.DataQuery) backend.DataResponse {
+func (ds *MQTTDatasource) query(ctx context.Context, query backend.DataQuery, fromAlert bool) backend.DataResponse {
 	var (
-		t        mqtt.Topic
+		qm       queryModel
 		response backend.DataResponse
 	)
 
-	if err := json.Unmarshal(query.JSON, &t); err != nil {
+	if err := json.Unmarshal(query.JSON, &qm); err != nil {
 		return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("failed to unmarshal query: %w", err))
 	}
+	t := qm.Topic
 
 	if t.Path == "" {
 		return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("topic path is required"))
 	}
 
+	if t.QoS > 2 {
+		return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("invalid QoS %d, must be 0, 1 or 2", t.QoS))
+	}
+
+	if err := t.FrameOptions.Validate(); err != nil {
+		return backend.ErrorResponseWithErrorSource(err)
+	}
+
+	mode := qm.Mode
+	if fromAlert && (mode == "" || mode == queryModeStream) {
+		mode = queryModeRange
+	}
+
+	switch mode {
+	case "", queryModeStream:
+	case queryModeLatest, queryModeRange:
+		return ds.queryMessages(ctx, query, &t, mode, qm.Timeout)
+	default:
+		return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("invalid query mode %q: must be %q, %q or %q", qm.Mode, queryModeStream, queryModeLatest, queryModeRange))
+	}
+
 	t.Interval = query.Interval
+	ds.setStreamOptions(t.Key(), streamOptions{
+		frame:     t.FrameOptions,
+		timeRange: query.TimeRange.Duration(),
+	})
 
 	frame := data.NewFrame("")
 	frame.SetMeta(&data.FrameMeta{
@@ -46,3 +118,31 @@ func (ds *MQTTDatasource) query(query backend.DataQuery) backend.DataResponse {
 	response.Frames = append(response.Frames, frame)
 	return response
 }
+
+// queryMessages returns the retained or latest message of every topic matching
+// the topic filter, or the messages of the query time range.
+func (ds *MQTTDatasource) queryMessages(ctx context.Context, query backend.DataQuery, t *mqtt.Topic, mode, timeout string) backend.DataResponse {
+	wait := defaultLatestTimeout
+	if timeout != "" {
+		var err error
+		wait, err = time.ParseDuration(timeout)
+		if err != nil || wait <= 0 || wait > maxLatestTimeout {
+			return backend.ErrorResponseWithErrorSource(backend.DownstreamErrorf("invalid timeout %q: must be a duration between 0s and %s", timeout, maxLatestTimeout))
+		}
+	}
+
+	logger := log.DefaultLogger.FromContext(ctx)
+	var (
+		frames data.Frames
+		err    error
+	)
+	if mode == queryModeRange {
+		frames, err = ds.Client.Range(ctx, t, query.TimeRange.From, query.TimeRange.To, wait, logger)
+	} else {
+		frames, err = ds.Client.Latest(ctx, t, wait, logger)
+	}
+	if err != nil {
+		return backend.ErrorResponseWithErrorSource(err)
+	}
+	return backend.DataResponse{Frames: frames}
+}
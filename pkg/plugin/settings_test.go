@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/mqtt-datasource/pkg/mqtt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDatasourceSettings_HistoryDir(t *testing.T) {
+	s := backend.DataSourceInstanceSettings{UID: "abc", JSONData: []byte(`{"historyStorage":"disk"}`)}
+
+	t.Run("in the Grafana data directory", func(t *testing.T) {
+		t.Setenv("GF_PATHS_DATA", "data")
+		settings, err := getDatasourceSettings(s)
+		require.NoError(t, err)
+		require.Equal(t, mqtt.HistoryDisk, settings.HistoryStorage)
+		require.True(t, filepath.IsAbs(settings.HistoryDir))
+		want, err := filepath.Abs(filepath.Join("data", "mqtt-datasource", "abc"))
+		require.NoError(t, err)
+		require.Equal(t, want, settings.HistoryDir)
+	})
+
+	t.Run("in memory without a data directory", func(t *testing.T) {
+		t.Setenv("GF_PATHS_DATA", "")
+		settings, err := getDatasourceSettings(s)
+		require.NoError(t, err)
+		require.Equal(t, mqtt.HistoryMemory, settings.HistoryStorage)
+		require.Empty(t, settings.HistoryDir)
+		require.NoError(t, settings.Validate())
+	})
+}
@@ -9,10 +9,15 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
-
-	"github.com/grafana/mqtt-datasource/pkg/mqtt"
 )
 
+// unknownOptionsNotice is added to the frames of streams whose query has not
+// run since the plugin started, which are read with the default options.
+var unknownOptionsNotice = data.Notice{
+	Severity: data.NoticeSeverityWarning,
+	Text:     "The messages are read with the default options until the query runs again, for example after refreshing the dashboard.",
+}
+
 func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
 	// Extract the topic key from the channel path
 	// Channel path format: "ds/{uid}/{topicKey}" where topicKey includes streaming key
@@ -30,7 +35,15 @@ func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamR
 		return backend.DownstreamErrorf("invalid interval: %s", chunks[0])
 	}
 
-	_, err = ds.Client.Subscribe(topicKey, logger)
+	// The client connects in the background, so the broker may not be
+	// reachable yet when the first panel subscribes.
+	if err := ds.Client.WaitConnected(ctx); err != nil {
+		logger.Debug("stopped streaming before connecting (context canceled)", "path", req.Path, "topicKey", topicKey)
+		return nil
+	}
+
+	options, known := ds.getStreamOptions(topicKey)
+	topic, err := ds.Client.Subscribe(topicKey, options.frame, logger)
 	if err != nil {
 		return err
 	}
@@ -40,6 +53,20 @@ func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamR
 		}
 	}()
 
+	// Start with the messages of the dashboard time range received before
+	// subscribing, then continue with the new ones.
+	if options.timeRange > 0 {
+		now := time.Now()
+		frame, err := topic.HistoryFrame(now.Add(-options.timeRange), now, logger)
+		if err != nil {
+			logger.Error("failed to read topic history", "path", req.Path, "error", err)
+		} else if frame.Rows() > 0 {
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				logger.Error("failed to send data frame", "path", req.Path, "error", backend.DownstreamError(err))
+			}
+		}
+	}
+
 	ticker := time.NewTicker(interval)
 
 	for {
@@ -47,8 +74,23 @@ func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamR
 		case <-ctx.Done():
 			logger.Debug("stopped streaming (context canceled)", "path", req.Path, "topicKey", topicKey)
 			ticker.Stop()
+			// Grafana runs the stream again after an error, so the options
+			// are only forgotten when it stops.
+			ds.deleteStreamOptions(topicKey, options)
 			return nil
 		case <-ticker.C:
+			if !known {
+				if options, known = ds.getStreamOptions(topicKey); known {
+					// The query ran again, subscribe with its options.
+					logger.Debug("using the options of the query", "path", req.Path, "topicKey", topicKey)
+					if err := ds.Client.Unsubscribe(topicKey, logger); err != nil {
+						logger.Error("Failed to unsubscribe from MQTT topic", "topicKey", topicKey, "error", err)
+					}
+					if _, err := ds.Client.Subscribe(topicKey, options.frame, logger); err != nil {
+						return err
+					}
+				}
+			}
 			topic, ok := ds.Client.GetTopic(topicKey)
 			if !ok {
 				logger.Debug("topic not found", "path", req.Path, "topicKey", topicKey)
@@ -59,7 +101,9 @@ func (ds *MQTTDatasource) RunStream(ctx context.Context, req *backend.RunStreamR
 				logger.Error("failed to convert topic to data frame", "path", req.Path, "error", backend.DownstreamError(err))
 				break
 			}
-			topic.Messages = []mqtt.Message{}
+			if !known {
+				frame.AppendNotices(unknownOptionsNotice)
+			}
 			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
 				logger.Error("failed to send data frame", "path", req.Path, "error", backend.DownstreamError(err))
 			}
@@ -2,17 +2,40 @@ import React, { SyntheticEvent } from 'react';
 
 import {
   DataSourcePluginOptionsEditorProps,
+  SelectableValue,
   onUpdateDatasourceJsonDataOption,
   onUpdateDatasourceSecureJsonDataOption,
   updateDatasourcePluginJsonDataOption,
   updateDatasourcePluginResetOption,
 } from '@grafana/data';
 import { ConfigSection, DataSourceDescription } from '@grafana/plugin-ui';
-import { Field, Input, SecretInput, Switch } from '@grafana/ui';
+import { Field, Input, RadioButtonGroup, SecretInput, SecretTextArea, Select, Switch, TagsInput } from '@grafana/ui';
 import { Divider } from './Divider';
 import { TLSSecretsConfig } from './TLSConfig';
 import { MqttDataSourceOptions, MqttSecureJsonData } from './types';
 
+const protocolVersions: Array<SelectableValue<number>> = [
+  { label: '3.1.1', value: 4 },
+  { label: '3.1', value: 3 },
+  { label: '5', value: 5 },
+];
+
+const overflowPolicies: Array<SelectableValue<'dropOldest' | 'dropNewest'>> = [
+  { label: 'Drop oldest', value: 'dropOldest', description: 'Replace the oldest buffered message' },
+  { label: 'Drop newest', value: 'dropNewest', description: 'Discard the incoming message' },
+];
+
+const historyStorages: Array<SelectableValue<'memory' | 'disk'>> = [
+  { label: 'Memory', value: 'memory', description: 'Keep the history in memory, it is lost on restarts' },
+  { label: 'Disk', value: 'disk', description: 'Keep the history in the Grafana data directory across restarts' },
+];
+
+const qosOptions: Array<SelectableValue<number>> = [
+  { label: '0', value: 0, description: 'At most once' },
+  { label: '1', value: 1, description: 'At least once' },
+  { label: '2', value: 2, description: 'Exactly once' },
+];
+
 export const ConfigEditor = (props: DataSourcePluginOptionsEditorProps<MqttDataSourceOptions, MqttSecureJsonData>) => {
   const { options } = props;
   const jsonData = options.jsonData;
@@ -27,7 +50,25 @@ export const ConfigEditor = (props: DataSourcePluginOptionsEditorProps<MqttDataS
     };
   };
 
+  const onNumberChanged = (property: keyof MqttDataSourceOptions) => {
+    return (event: SyntheticEvent<HTMLInputElement>) => {
+      const value = event.currentTarget.value.trim();
+      const number = Number(value);
+      // The backend reads whole numbers only, so other values are truncated
+      // and text that is not a number leaves the default.
+      updateDatasourcePluginJsonDataOption(
+        props,
+        property,
+        value === '' || !Number.isFinite(number) ? undefined : Math.trunc(number)
+      );
+    };
+  };
+
+  const isInvalidSeconds = (value?: number, max?: number, min = 0) =>
+    value !== undefined && (!Number.isInteger(value) || value < min || (max !== undefined && value > max));
+
   const WIDTH_LONG = 40;
+  const WIDTH_SHORT = 20;
 
   return (
     <>
@@ -50,6 +91,27 @@ export const ConfigEditor = (props: DataSourcePluginOptionsEditorProps<MqttDataS
             placeholder="TCP (tcp://), TLS (tls://), or WebSocket (ws://)"
           />
         </Field>
+
+        <Field
+          label="Failover URIs"
+          description="Brokers of the same cluster, tried in order after the URI above when the connection fails or is lost."
+        >
+          <TagsInput
+            width={WIDTH_LONG}
+            tags={jsonData.failoverURIs || []}
+            onChange={(uris) => updateDatasourcePluginJsonDataOption(props, 'failoverURIs', uris)}
+            placeholder="tcp://broker-2:1883"
+          />
+        </Field>
+
+        <Field label="Protocol version" description="MQTT protocol version to use when connecting to the broker.">
+          <Select
+            width={WIDTH_LONG}
+            options={protocolVersions}
+            value={jsonData.protocolVersion || 4}
+            onChange={(v) => updateDatasourcePluginJsonDataOption(props, 'protocolVersion', v.value)}
+          />
+        </Field>
       </ConfigSection>
 
       <Field label="Client ID" description="If not set, a random client ID is used.">
@@ -103,6 +165,284 @@ export const ConfigEditor = (props: DataSourcePluginOptionsEditorProps<MqttDataS
         </Field>
       </ConfigSection>
 
+      <Divider />
+
+      <ConfigSection
+        title="Connection tuning"
+        description="Timeouts and intervals are in seconds. Leave a field empty to use its default."
+        isCollapsible
+        isInitiallyOpen={false}
+      >
+        <Field
+          label="Keep alive"
+          description="Maximum time between control packets sent to the broker. Default: 60."
+          invalid={isInvalidSeconds(jsonData.keepAlive, 65535, 1)}
+          error="Must be a whole number of seconds between 1 and 65535"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={1}
+            max={65535}
+            value={jsonData.keepAlive ?? ''}
+            placeholder="60"
+            onChange={onNumberChanged('keepAlive')}
+          />
+        </Field>
+
+        <Field
+          label="Ping timeout"
+          description="Time to wait for a ping response before the connection is considered lost. Default: 60."
+          invalid={isInvalidSeconds(jsonData.pingTimeout, undefined, 1)}
+          error="Must be a whole, positive number of seconds"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={1}
+            value={jsonData.pingTimeout ?? ''}
+            placeholder="60"
+            onChange={onNumberChanged('pingTimeout')}
+          />
+        </Field>
+
+        <Field
+          label="Connect timeout"
+          description="Time to wait for a connection attempt to complete. Default: 30."
+          invalid={isInvalidSeconds(jsonData.connectTimeout, undefined, 1)}
+          error="Must be a whole, positive number of seconds"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={1}
+            value={jsonData.connectTimeout ?? ''}
+            placeholder="30"
+            onChange={onNumberChanged('connectTimeout')}
+          />
+        </Field>
+
+        <Field
+          label="Max reconnect interval"
+          description="Upper bound for the delay between reconnect attempts. Default: 10."
+          invalid={isInvalidSeconds(jsonData.maxReconnectInterval, undefined, 1)}
+          error="Must be a whole, positive number of seconds"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={1}
+            value={jsonData.maxReconnectInterval ?? ''}
+            placeholder="10"
+            onChange={onNumberChanged('maxReconnectInterval')}
+          />
+        </Field>
+
+        <Field
+          label="Clean session"
+          description="When enabled, the broker discards the session and its subscriptions when the connection closes."
+        >
+          <Switch onChange={onSwitchChanged('cleanSession')} value={jsonData.cleanSession || false} />
+        </Field>
+      </ConfigSection>
+
+      <Divider />
+
+      <ConfigSection
+        title="Message buffer"
+        description="Messages are buffered per topic until the next frame is sent to the panel."
+        isCollapsible
+        isInitiallyOpen={false}
+      >
+        <Field
+          label="Buffer size"
+          description="Maximum number of messages buffered per topic. Default: 10000."
+          invalid={isInvalidSeconds(jsonData.bufferSize)}
+          error="Must be a whole, non-negative number"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={0}
+            value={jsonData.bufferSize ?? ''}
+            placeholder="10000"
+            onChange={onNumberChanged('bufferSize')}
+          />
+        </Field>
+
+        <Field label="Overflow policy" description="Which message to drop when the buffer of a topic is full.">
+          <RadioButtonGroup
+            options={overflowPolicies}
+            value={jsonData.bufferOverflow || 'dropOldest'}
+            onChange={(v) => updateDatasourcePluginJsonDataOption(props, 'bufferOverflow', v)}
+          />
+        </Field>
+      </ConfigSection>
+
+      <Divider />
+
+      <ConfigSection
+        title="History"
+        description="Keep the recent messages of every topic, so panels open with the messages of their time range instead of waiting for new ones."
+        isCollapsible
+        isInitiallyOpen={Boolean(jsonData.historyDuration)}
+      >
+        <Field
+          label="History duration"
+          description="How long to keep the messages of every topic, in seconds. Topics stay subscribed for this long after their last panel closed. Default: 0 (disabled)."
+          invalid={isInvalidSeconds(jsonData.historyDuration)}
+          error="Must be a whole, non-negative number of seconds"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={0}
+            value={jsonData.historyDuration ?? ''}
+            placeholder="0"
+            onChange={onNumberChanged('historyDuration')}
+          />
+        </Field>
+
+        <Field
+          label="History size"
+          description="Maximum number of messages kept per topic. Default: 10000."
+          invalid={isInvalidSeconds(jsonData.historySize)}
+          error="Must be a whole, non-negative number"
+        >
+          <Input
+            width={WIDTH_SHORT}
+            type="number"
+            min={0}
+            value={jsonData.historySize ?? ''}
+            placeholder="10000"
+            onChange={onNumberChanged('historySize')}
+          />
+        </Field>
+
+        <Field
+          label="History storage"
+          description="Where to keep the history. On disk, it survives Grafana and plugin restarts."
+        >
+          <RadioButtonGroup
+            options={historyStorages}
+            value={jsonData.historyStorage || 'memory'}
+            onChange={(v) => updateDatasourcePluginJsonDataOption(props, 'historyStorage', v)}
+          />
+        </Field>
+
+        {jsonData.historyStorage === 'disk' && (
+          <Field
+            label="History disk size"
+            description="Maximum size of the history of every topic on disk, in megabytes. Default: 100."
+            invalid={isInvalidSeconds(jsonData.historyDiskSize)}
+            error="Must be a whole, non-negative number"
+          >
+            <Input
+              width={WIDTH_SHORT}
+              type="number"
+              min={0}
+              value={jsonData.historyDiskSize ?? ''}
+              placeholder="100"
+              onChange={onNumberChanged('historyDiskSize')}
+            />
+          </Field>
+        )}
+      </ConfigSection>
+
+      <Divider />
+
+      <ConfigSection
+        title="Protobuf"
+        description="Message types for queries decoding protobuf payloads."
+        isCollapsible
+        isInitiallyOpen={Boolean(options.secureJsonFields?.protoDescriptorSet)}
+      >
+        <Field
+          label="Descriptor set"
+          description="Base64 encoded FileDescriptorSet, such as the output of protoc --include_imports --descriptor_set_out=set.pb followed by base64 set.pb. Concatenate several sets before encoding them."
+        >
+          <SecretTextArea
+            cols={45}
+            rows={7}
+            isConfigured={Boolean(options.secureJsonFields?.protoDescriptorSet)}
+            onChange={onUpdateDatasourceSecureJsonDataOption(props, 'protoDescriptorSet')}
+            onReset={() => updateDatasourcePluginResetOption(props, 'protoDescriptorSet')}
+          />
+        </Field>
+      </ConfigSection>
+
+      <Divider />
+
+      <ConfigSection
+        title="Presence"
+        description="Messages that let other MQTT clients track whether Grafana is connected. Leave a topic empty to disable its message."
+        isCollapsible
+        isInitiallyOpen={Boolean(jsonData.willTopic || jsonData.birthTopic)}
+      >
+        <Field
+          label="Will topic"
+          description="Topic the broker publishes the will message to when the connection drops without a clean disconnect."
+        >
+          <Input
+            width={WIDTH_LONG}
+            value={jsonData.willTopic || ''}
+            placeholder="grafana/status"
+            onChange={onUpdateDatasourceJsonDataOption(props, 'willTopic')}
+          />
+        </Field>
+
+        <Field label="Will payload">
+          <Input
+            width={WIDTH_LONG}
+            value={jsonData.willPayload || ''}
+            placeholder="offline"
+            onChange={onUpdateDatasourceJsonDataOption(props, 'willPayload')}
+          />
+        </Field>
+
+        <Field label="Will QoS">
+          <RadioButtonGroup
+            options={qosOptions}
+            value={jsonData.willQoS ?? 0}
+            onChange={(v) => updateDatasourcePluginJsonDataOption(props, 'willQoS', v)}
+          />
+        </Field>
+
+        <Field label="Retain will message">
+          <Switch onChange={onSwitchChanged('willRetain')} value={jsonData.willRetain || false} />
+        </Field>
+
+        <Field label="Birth topic" description="Topic a birth message is published to after every successful connect.">
+          <Input
+            width={WIDTH_LONG}
+            value={jsonData.birthTopic || ''}
+            placeholder="grafana/status"
+            onChange={onUpdateDatasourceJsonDataOption(props, 'birthTopic')}
+          />
+        </Field>
+
+        <Field label="Birth payload">
+          <Input
+            width={WIDTH_LONG}
+            value={jsonData.birthPayload || ''}
+            placeholder="online"
+            onChange={onUpdateDatasourceJsonDataOption(props, 'birthPayload')}
+          />
+        </Field>
+
+        <Field label="Birth QoS">
+          <RadioButtonGroup
+            options={qosOptions}
+            value={jsonData.birthQoS ?? 0}
+            onChange={(v) => updateDatasourcePluginJsonDataOption(props, 'birthQoS', v)}
+          />
+        </Field>
+
+        <Field label="Retain birth message">
+          <Switch onChange={onSwitchChanged('birthRetain')} value={jsonData.birthRetain || false} />
+        </Field>
+      </ConfigSection>
+
       {jsonData.tlsAuth || jsonData.tlsAuthWithCACert ? (
         <>
           <Divider />
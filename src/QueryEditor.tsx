@@ -1,13 +1,87 @@
 import React from 'react';
-import { Input, InlineFieldRow, InlineField } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import { Button, IconButton, Input, InlineFieldRow, InlineField, InlineSwitch, RadioButtonGroup, Select } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from './datasource';
-import { MqttDataSourceOptions, MqttQuery } from './types';
+import {
+  ArrayMode,
+  FieldSelector,
+  MqttDataSourceOptions,
+  MqttQuery,
+  PayloadFormat,
+  QueryMode,
+  TopicMode,
+  TypeMismatchPolicy,
+} from './types';
 
 type Props = QueryEditorProps<DataSource, MqttQuery, MqttDataSourceOptions>;
 
+const qosOptions: Array<SelectableValue<number>> = [
+  { label: '0', value: 0, description: 'At most once' },
+  { label: '1', value: 1, description: 'At least once' },
+  { label: '2', value: 2, description: 'Exactly once' },
+];
+
+const modeOptions: Array<SelectableValue<QueryMode>> = [
+  { label: 'Stream', value: 'stream', description: 'Stream the messages as they arrive' },
+  { label: 'Latest', value: 'latest', description: 'Return the retained or latest message of every topic' },
+  { label: 'Range', value: 'range', description: 'Return the messages of the time range from the history' },
+];
+
+const topicModeOptions: Array<SelectableValue<TopicMode | ''>> = [
+  { label: 'Merge', value: '', description: 'Merge the messages of all topics into the same fields' },
+  { label: 'Field', value: 'field', description: 'Add the topic of each message as a field' },
+  { label: 'Labels', value: 'label', description: 'Separate fields per topic, labeled with the topic' },
+  { label: 'Frames', value: 'frame', description: 'One frame per topic' },
+];
+
+const formatOptions: Array<SelectableValue<PayloadFormat | ''>> = [
+  { label: 'JSON', value: '', description: 'JSON payloads, other payloads are string values' },
+  { label: 'Protobuf', value: 'protobuf', description: 'Binary protobuf payloads of a message type of the data source' },
+  { label: 'Sparkplug B', value: 'sparkplug', description: 'Sparkplug B payloads, with a field per metric' },
+  { label: 'CBOR', value: 'cbor', description: 'CBOR payloads' },
+  { label: 'MessagePack', value: 'msgpack', description: 'MessagePack payloads' },
+  { label: 'Auto', value: 'auto', description: 'JSON payloads, and CBOR and MessagePack maps and arrays' },
+  { label: 'Line protocol', value: 'influx', description: 'InfluxDB line protocol, with a row per line' },
+];
+
+const timeFormatOptions: Array<SelectableValue<string>> = [
+  { label: 'Auto', value: '', description: 'RFC 3339 strings, or Unix time in a unit guessed from its magnitude' },
+  { label: 'RFC 3339', value: 'rfc3339' },
+  { label: 'Unix seconds', value: 'unix' },
+  { label: 'Unix milliseconds', value: 'unix_ms' },
+  { label: 'Unix microseconds', value: 'unix_us' },
+  { label: 'Unix nanoseconds', value: 'unix_ns' },
+];
+
+const arrayModeOptions: Array<SelectableValue<ArrayMode | ''>> = [
+  { label: 'JSON', value: '', description: 'Keep arrays as JSON fields' },
+  { label: 'Index', value: 'index', description: 'One field per array element, named after its index' },
+];
+
+const typeMismatchOptions: Array<SelectableValue<TypeMismatchPolicy>> = [
+  { label: 'Null', value: 'null', description: 'Leave the value null and report it in a notice' },
+  { label: 'Coerce', value: 'coerce', description: 'Convert the value to the type of the field, such as "12.5" to 12.5' },
+  { label: 'String', value: 'string', description: 'Turn the field into a string field' },
+  { label: 'Split', value: 'split', description: 'Add a field per type, such as temperature_string' },
+];
+
 export const QueryEditor = (props: Props) => {
   const { query, onChange, onRunQuery } = props;
+  const fields = query.fields ?? [];
+  // Custom time layouts are shown as options of their own
+  const timeFormats =
+    query.timeFormat && !timeFormatOptions.some((o) => o.value === query.timeFormat)
+      ? [...timeFormatOptions, { label: query.timeFormat, value: query.timeFormat }]
+      : timeFormatOptions;
+
+  const onFieldChange = (index: number, field: FieldSelector) => {
+    onChange({ ...query, fields: fields.map((f, i) => (i === index ? field : f)) });
+  };
+  const onFieldRemove = (index: number) => {
+    const remaining = fields.filter((_, i) => i !== index);
+    onChange({ ...query, fields: remaining.length ? remaining : undefined });
+    onRunQuery();
+  };
 
   return (
     <>
@@ -22,6 +96,269 @@ export const QueryEditor = (props: Props) => {
             onChange={(e) => onChange({...query, topic: e.currentTarget.value })}
           />
         </InlineField>
+        <InlineField label="QoS" tooltip="Quality of service level used to subscribe to the topic">
+          <RadioButtonGroup
+            options={qosOptions}
+            value={query.qos ?? 0}
+            onChange={(qos) => {
+              onChange({ ...query, qos });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField
+          label="Topics"
+          labelWidth={8}
+          tooltip="How messages of the different topics matched by a wildcard subscription are told apart"
+        >
+          <RadioButtonGroup
+            options={topicModeOptions}
+            value={query.topicMode ?? ''}
+            onChange={(topicMode) => {
+              onChange({ ...query, topicMode: topicMode || undefined });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField label="Format" labelWidth={8} tooltip="The encoding of the payloads">
+          <RadioButtonGroup
+            options={formatOptions}
+            value={query.format ?? ''}
+            onChange={(format) => {
+              onChange({ ...query, format: format || undefined });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+        {query.format === 'protobuf' && (
+          <InlineField
+            label="Message type"
+            tooltip="Full name of the message type of the payloads, from the descriptor set of the data source"
+          >
+            <Input
+              name="messageType"
+              width={32}
+              placeholder="acme.telemetry.Reading"
+              value={query.messageType}
+              onBlur={onRunQuery}
+              onChange={(e) => onChange({ ...query, messageType: e.currentTarget.value || undefined })}
+            />
+          </InlineField>
+        )}
+        {query.format === 'influx' && (
+          <InlineField label="Precision" tooltip="Unit of the line timestamps, guessed from their magnitude when Auto">
+            <Select
+              width={24}
+              options={timeFormatOptions.filter((o) => o.value !== 'rfc3339')}
+              value={query.timeFormat ?? ''}
+              onChange={(v) => {
+                onChange({ ...query, timeFormat: v.value || undefined });
+                onRunQuery();
+              }}
+            />
+          </InlineField>
+        )}
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField
+          label="Flatten"
+          labelWidth={8}
+          tooltip="Turn the values of nested JSON objects into fields of their own, named after their path"
+        >
+          <InlineSwitch
+            value={query.flatten ?? false}
+            onChange={(e) => {
+              onChange({ ...query, flatten: e.currentTarget.checked || undefined });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+        {query.flatten && (
+          <>
+            <InlineField label="Separator" tooltip="Joins the keys of flattened values">
+              <Input
+                name="separator"
+                width={6}
+                placeholder="."
+                value={query.separator}
+                onBlur={onRunQuery}
+                onChange={(e) => onChange({ ...query, separator: e.currentTarget.value || undefined })}
+              />
+            </InlineField>
+            <InlineField label="Max depth" tooltip="The number of nested levels flattened. Deeper values are JSON fields.">
+              <Input
+                name="maxDepth"
+                type="number"
+                min={0}
+                width={8}
+                placeholder="all"
+                value={query.maxDepth ?? ''}
+                onBlur={onRunQuery}
+                onChange={(e) =>
+                  onChange({ ...query, maxDepth: e.currentTarget.value ? Number(e.currentTarget.value) : undefined })
+                }
+              />
+            </InlineField>
+            <InlineField label="Arrays">
+              <RadioButtonGroup
+                options={arrayModeOptions}
+                value={query.arrays ?? ''}
+                onChange={(arrays) => {
+                  onChange({ ...query, arrays: arrays || undefined });
+                  onRunQuery();
+                }}
+              />
+            </InlineField>
+          </>
+        )}
+      </InlineFieldRow>
+      {fields.map((field, index) => (
+        <InlineFieldRow key={index}>
+          <InlineField label="Field" labelWidth={8} tooltip="JSONPath to a value of the payload, such as $.sensor.temperature">
+            <Input
+              width={40}
+              placeholder="$.sensor.temperature"
+              value={field.path}
+              onBlur={onRunQuery}
+              onChange={(e) => onFieldChange(index, { ...field, path: e.currentTarget.value })}
+            />
+          </InlineField>
+          <InlineField label="Alias" tooltip="Name of the field, the path when empty">
+            <Input
+              width={20}
+              value={field.alias}
+              onBlur={onRunQuery}
+              onChange={(e) => onFieldChange(index, { ...field, alias: e.currentTarget.value || undefined })}
+            />
+          </InlineField>
+          <IconButton name="trash-alt" aria-label="Remove field" onClick={() => onFieldRemove(index)} />
+        </InlineFieldRow>
+      ))}
+      <InlineFieldRow>
+        <Button
+          variant="secondary"
+          size="sm"
+          icon="plus"
+          tooltip="Only turn the selected values of JSON payloads into fields"
+          onClick={() => onChange({ ...query, fields: [...fields, { path: '' }] })}
+        >
+          Select field
+        </Button>
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField
+          label="Explode"
+          labelWidth={8}
+          tooltip="Turn every element of an array into a row of its own: $ for payloads that are arrays, or a JSONPath to an array in the payload, such as $.samples"
+        >
+          <Input
+            name="explode"
+            width={20}
+            placeholder="off"
+            value={query.explode}
+            onBlur={onRunQuery}
+            onChange={(e) => onChange({ ...query, explode: e.currentTarget.value || undefined })}
+          />
+        </InlineField>
+        <InlineField
+          label="Time field"
+          labelWidth={12}
+          tooltip="JSONPath to the timestamp in the payload, such as $.ts. Messages without a valid timestamp use the time they were received."
+        >
+          <Input
+            name="timeField"
+            width={20}
+            placeholder="receive time"
+            value={query.timeField}
+            onBlur={onRunQuery}
+            onChange={(e) => onChange({ ...query, timeField: e.currentTarget.value || undefined })}
+          />
+        </InlineField>
+        {query.timeField && (
+          <>
+            <InlineField label="Time format" tooltip="How the timestamp is written. Enter a Go time layout for other formats.">
+              <Select
+                width={24}
+                options={timeFormats}
+                value={query.timeFormat ?? ''}
+                allowCustomValue
+                onChange={(v) => {
+                  onChange({ ...query, timeFormat: v.value || undefined });
+                  onRunQuery();
+                }}
+              />
+            </InlineField>
+            <InlineField label="Time zone" tooltip="Time zone of timestamps whose layout has no time zone, such as Europe/Berlin">
+              <Input
+                name="timeZone"
+                width={20}
+                placeholder="UTC"
+                value={query.timeZone}
+                onBlur={onRunQuery}
+                onChange={(e) => onChange({ ...query, timeZone: e.currentTarget.value || undefined })}
+              />
+            </InlineField>
+          </>
+        )}
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField
+          label="Type mismatch"
+          labelWidth={14}
+          tooltip="What happens to values whose type differs from the type of their field, such as a NaN string between numbers"
+        >
+          <RadioButtonGroup
+            options={typeMismatchOptions}
+            value={query.typeMismatch ?? 'null'}
+            onChange={(typeMismatch) => {
+              onChange({ ...query, typeMismatch: typeMismatch === 'null' ? undefined : typeMismatch });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+        <InlineField
+          label="Float numbers"
+          tooltip="Read all numbers as floats. By default integers are 64-bit integers, so counters and IDs above 2^53 keep their precision."
+        >
+          <InlineSwitch
+            value={query.forceFloat ?? false}
+            onChange={(e) => {
+              onChange({ ...query, forceFloat: e.currentTarget.checked || undefined });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+      </InlineFieldRow>
+      <InlineFieldRow>
+        <InlineField label="Mode" labelWidth={8}>
+          <RadioButtonGroup
+            options={modeOptions}
+            value={query.mode ?? 'stream'}
+            onChange={(mode) => {
+              onChange({ ...query, mode });
+              onRunQuery();
+            }}
+          />
+        </InlineField>
+        {(query.mode === 'latest' || query.mode === 'range') && (
+          <InlineField
+            label="Timeout"
+            tooltip="How long to wait for messages. Topic filters with wildcards collect messages until the timeout."
+          >
+            <Input
+              name="timeout"
+              width={10}
+              placeholder="5s"
+              value={query.timeout}
+              onBlur={onRunQuery}
+              onChange={(e) => onChange({ ...query, timeout: e.currentTarget.value || undefined })}
+            />
+          </InlineField>
+        )}
       </InlineFieldRow>
     </>
   );
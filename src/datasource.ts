@@ -1,4 +1,5 @@
 import {
+  DataFrame,
   DataQueryRequest,
   DataQueryResponse,
   DataSourceInstanceSettings,
@@ -6,8 +7,9 @@ import {
 } from '@grafana/data';
 import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
 import { MqttDataSourceOptions, MqttQuery } from './types';
-import { Observable, from, switchMap } from 'rxjs';
-import { getLiveStreamKey } from './streaming';
+import { Observable, from, map, switchMap } from 'rxjs';
+import { getLiveStreamKey, getStreamOptions } from './streaming';
+import { splitByTopic } from './frames';
 
 export class DataSource extends DataSourceWithBackend<MqttQuery, MqttDataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<MqttDataSourceOptions>) {
@@ -20,7 +22,7 @@ export class DataSource extends DataSourceWithBackend<MqttQuery, MqttDataSourceO
       Promise.all(
         request.targets.map(async (target) => ({
           ...target,
-          streamingKey: await getLiveStreamKey(this.uid, target.topic),
+          streamingKey: await getLiveStreamKey(this.uid, target.topic, getStreamOptions(target)),
         }))
       )
     ).pipe(
@@ -29,7 +31,20 @@ export class DataSource extends DataSourceWithBackend<MqttQuery, MqttDataSourceO
           ...request,
           targets: updatedTargets,
         };
-        return super.query(updatedRequest);
+        // Queries asking for one frame per topic get their frames split here
+        const splitRefIds = new Set(updatedTargets.filter((t) => t.topicMode === 'frame').map((t) => t.refId));
+        return super.query(updatedRequest).pipe(
+          map((response) =>
+            splitRefIds.size === 0
+              ? response
+              : {
+                  ...response,
+                  data: response.data.flatMap((frame: DataFrame) =>
+                    splitRefIds.has(frame.refId ?? '') ? splitByTopic(frame) : [frame]
+                  ),
+                }
+          )
+        );
       })
     );
   }
@@ -37,9 +52,12 @@ export class DataSource extends DataSourceWithBackend<MqttQuery, MqttDataSourceO
   applyTemplateVariables(query: MqttQuery, scopedVars: ScopedVars, filters?: any[]): MqttQuery {
     let resolvedTopic = getTemplateSrv().replace(query.topic, scopedVars);
     resolvedTopic = this.base64UrlSafeEncode(resolvedTopic);
+    // Fields are added to the editor before their path is typed
+    const fields = query.fields?.filter((field) => field.path);
     const resolvedQuery: MqttQuery = {
       ...query,
       topic: resolvedTopic,
+      fields: fields?.length ? fields : undefined,
       refId: query.refId,
     };
 
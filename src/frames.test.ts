@@ -0,0 +1,40 @@
+import { createDataFrame, FieldType } from '@grafana/data';
+import { splitByTopic } from './frames';
+
+describe('splitByTopic', () => {
+  it('should return one frame per topic', () => {
+    const frame = createDataFrame({
+      refId: 'A',
+      name: 'mqtt',
+      fields: [
+        { name: 'Time', type: FieldType.time, values: [1000, 2000, 3000] },
+        { name: 'Topic', type: FieldType.string, values: ['plant/a', 'plant/b', 'plant/a'] },
+        { name: 'value', type: FieldType.number, values: [1, 2, 3] },
+        { name: 'unit', type: FieldType.string, values: [null, null, 'C'] },
+      ],
+    });
+
+    const frames = splitByTopic(frame);
+
+    expect(frames).toHaveLength(2);
+    expect(frames[0].name).toBe('plant/a');
+    expect(frames[0].refId).toBe('A');
+    expect(frames[0].length).toBe(2);
+    expect(frames[0].fields.map((field) => field.name)).toEqual(['Time', 'value', 'unit']);
+    expect(frames[0].fields[1].values).toEqual([1, 3]);
+    expect(frames[1].name).toBe('plant/b');
+    expect(frames[1].fields.map((field) => field.name)).toEqual(['Time', 'value']);
+    expect(frames[1].fields[0].values).toEqual([2000]);
+  });
+
+  it('should keep frames without a topic field', () => {
+    const frame = createDataFrame({
+      fields: [
+        { name: 'Time', type: FieldType.time, values: [1000] },
+        { name: 'value', type: FieldType.number, values: [1] },
+      ],
+    });
+
+    expect(splitByTopic(frame)).toEqual([frame]);
+  });
+});
@@ -0,0 +1,37 @@
+import { DataFrame, FieldType } from '@grafana/data';
+
+/** The field holding the topic of each message, see TopicModeField in the backend. */
+export const TOPIC_FIELD = 'Topic';
+
+/**
+ * Split a frame into one frame per topic. Live channels carry a single frame, so the backend
+ * streams the messages of all topics with a topic field and the frames are split here.
+ * Fields that have no values for a topic are left out of its frame.
+ */
+export function splitByTopic(frame: DataFrame): DataFrame[] {
+  const topicField = frame.fields.find((field) => field.name === TOPIC_FIELD && field.type === FieldType.string);
+  if (!topicField) {
+    return [frame];
+  }
+
+  const rowsByTopic = new Map<string, number[]>();
+  topicField.values.forEach((topic: string, row: number) => {
+    const rows = rowsByTopic.get(topic);
+    if (rows) {
+      rows.push(row);
+    } else {
+      rowsByTopic.set(topic, [row]);
+    }
+  });
+
+  return Array.from(rowsByTopic, ([topic, rows]) => ({
+    name: topic,
+    refId: frame.refId,
+    meta: frame.meta,
+    length: rows.length,
+    fields: frame.fields
+      .filter((field) => field !== topicField)
+      .map((field) => ({ ...field, state: undefined, values: rows.map((row) => field.values[row]) }))
+      .filter((field) => field.type === FieldType.time || field.values.some((value) => value != null)),
+  }));
+}
@@ -1,4 +1,4 @@
-import { getLiveStreamKey } from './streaming';
+import { getLiveStreamKey, getStreamOptions } from './streaming';
 import { config } from '@grafana/runtime';
 
 // Mock the @grafana/runtime module
@@ -163,6 +163,30 @@ describe('getLiveStreamKey', () => {
     );
   });
 
+  it('should include the stream options in the hash', async () => {
+    const datasourceUid = 'mqtt-datasource-uid';
+    const topic = 'plant/+/temperature';
+
+    await getLiveStreamKey(datasourceUid, topic, { topicMode: 'label' });
+
+    expect(mockDigest).toHaveBeenCalledWith(
+      'SHA-1',
+      new TextEncoder().encode(JSON.stringify({ topic: 'plant/+/temperature', topicMode: 'label' }))
+    );
+  });
+
+  it('should keep the key of queries without stream options', async () => {
+    const datasourceUid = 'mqtt-datasource-uid';
+    const topic = 'sensor/temperature';
+
+    await getLiveStreamKey(datasourceUid, topic, { topicMode: undefined });
+
+    expect(mockDigest).toHaveBeenCalledWith(
+      'SHA-1',
+      new TextEncoder().encode(JSON.stringify({ topic: 'sensor/temperature' }))
+    );
+  });
+
   it('should only use first 8 bytes of hash', async () => {
     // Create a mock hash buffer with all bytes set to different values
     const mockHashBuffer = new ArrayBuffer(20);
@@ -222,3 +246,23 @@ describe('getLiveStreamKey', () => {
     });
   });
 });
+
+describe('getStreamOptions', () => {
+  it('should pick the options that change the frames', () => {
+    expect(
+      getStreamOptions({
+        refId: 'A',
+        topic: 'sensor/temperature',
+        qos: 1,
+        flatten: true,
+        separator: '_',
+        arrays: 'index',
+        typeMismatch: 'split',
+      })
+    ).toEqual({ flatten: true, separator: '_', arrays: 'index', typeMismatch: 'split' });
+  });
+
+  it('should keep the key of queries without stream options', () => {
+    expect(JSON.stringify(getStreamOptions({ refId: 'A', topic: 'sensor/temperature' }))).toBe('{}');
+  });
+});
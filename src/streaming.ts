@@ -1,12 +1,50 @@
 import { config } from '@grafana/runtime';
+import { MqttQuery, StreamOptions } from './types';
+
+/** Pick the stream options of a query. */
+export function getStreamOptions(query: MqttQuery): StreamOptions {
+  const {
+    topicMode,
+    format,
+    messageType,
+    flatten,
+    separator,
+    maxDepth,
+    arrays,
+    fields,
+    timeField,
+    timeFormat,
+    timeZone,
+    explode,
+    forceFloat,
+    typeMismatch,
+  } = query;
+  return {
+    topicMode,
+    format,
+    messageType,
+    flatten,
+    separator,
+    maxDepth,
+    arrays,
+    fields,
+    timeField,
+    timeFormat,
+    timeZone,
+    explode,
+    forceFloat,
+    typeMismatch,
+  };
+}
 
 /**
  * Calculate a unique key for the query.  The key is used to pick a channel and should
  * be unique for each distinct query execution plan.  This key is not secure and is only picked to avoid
  * possible collisions
  */
-export async function getLiveStreamKey(datasourceUid: string, topic?: string): Promise<string> {
-  const str = JSON.stringify({ topic });
+export async function getLiveStreamKey(datasourceUid: string, topic?: string, options: StreamOptions = {}): Promise<string> {
+  // Unset options are left out, so queries without options keep their key
+  const str = JSON.stringify({ topic, ...options });
 
   const orgId = config.bootData.user.orgId;
   const msgUint8 = new TextEncoder().encode(str); // encode as (utf-8) Uint8Array
@@ -1,16 +1,105 @@
 import { DataSourceJsonData } from '@grafana/data';
 import { DataQuery } from '@grafana/schema';
 
+export type TopicMode = 'field' | 'label' | 'frame';
+
+export type QueryMode = 'stream' | 'latest' | 'range';
+
+export type ArrayMode = 'index';
+
+export type PayloadFormat = 'protobuf' | 'sparkplug' | 'cbor' | 'msgpack' | 'auto' | 'influx';
+
+export type TypeMismatchPolicy = 'null' | 'coerce' | 'string' | 'split';
+
+export interface FieldSelector {
+  /** JSONPath to the value, such as "$.sensor.temperature". */
+  path: string;
+  alias?: string;
+}
+
 export interface MqttQuery extends DataQuery {
   topic?: string;
+  qos?: number;
+  topicMode?: TopicMode;
+  /** The encoding of the payloads, JSON when unset. */
+  format?: PayloadFormat;
+  /** Full name of the protobuf message type of the payloads, such as "acme.telemetry.Reading". */
+  messageType?: string;
+  /** Turn the values of nested JSON objects into fields of their own. */
+  flatten?: boolean;
+  /** Joins the keys of flattened values, "." when unset. */
+  separator?: string;
+  /** The number of nested levels flattened, all when unset. */
+  maxDepth?: number;
+  arrays?: ArrayMode;
+  /** The values of JSON payloads that become fields, all when unset. */
+  fields?: FieldSelector[];
+  /** JSONPath to the timestamp in the payload, the receive time when unset. */
+  timeField?: string;
+  /** 'rfc3339', 'unix', 'unix_ms', 'unix_us', 'unix_ns' or a Go time layout, guessed when unset. */
+  timeFormat?: string;
+  /** IANA time zone of timestamps whose layout has no time zone, UTC when unset. */
+  timeZone?: string;
+  /** "$" or a JSONPath to an array in the payload whose elements become rows. */
+  explode?: string;
+  /** Read all numbers as floats instead of reading integers as 64-bit integers. */
+  forceFloat?: boolean;
+  /** What happens to values whose type differs from the type of their field, 'null' when unset. */
+  typeMismatch?: TypeMismatchPolicy;
+  mode?: QueryMode;
+  /** How long latest and range queries wait for messages, e.g. "5s". */
+  timeout?: string;
   stream?: boolean;
   streamingKey?: string;
 }
 
+/**
+ * The query options that change the frames of a stream. The backend reads them from the query
+ * that returned the channel, so they are part of the streaming key.
+ */
+export type StreamOptions = Pick<
+  MqttQuery,
+  | 'topicMode'
+  | 'format'
+  | 'messageType'
+  | 'flatten'
+  | 'separator'
+  | 'maxDepth'
+  | 'arrays'
+  | 'fields'
+  | 'timeField'
+  | 'timeFormat'
+  | 'timeZone'
+  | 'explode'
+  | 'forceFloat'
+  | 'typeMismatch'
+>;
+
 export interface MqttDataSourceOptions extends DataSourceJsonData {
   uri: string;
+  failoverURIs?: string[];
   username?: string;
   clientID?: string;
+  protocolVersion?: number;
+  keepAlive?: number;
+  pingTimeout?: number;
+  maxReconnectInterval?: number;
+  connectTimeout?: number;
+  cleanSession?: boolean;
+  bufferSize?: number;
+  bufferOverflow?: 'dropOldest' | 'dropNewest';
+  historyDuration?: number;
+  historySize?: number;
+  historyStorage?: 'memory' | 'disk';
+  historyDiskSize?: number;
+  willTopic?: string;
+  willPayload?: string;
+  willQoS?: number;
+  willRetain?: boolean;
+  birthTopic?: string;
+  birthPayload?: string;
+  birthQoS?: number;
+  birthRetain?: boolean;
   tlsAuth: boolean;
   tlsAuthWithCACert: boolean;
   tlsSkipVerify: boolean;
@@ -21,4 +110,6 @@ export interface MqttSecureJsonData {
   tlsCACert?: string;
   tlsClientKey?: string;
   tlsClientCert?: string;
+  /** Base64 encoded protobuf FileDescriptorSet. */
+  protoDescriptorSet?: string;
 }